@@ -1,7 +1,9 @@
 package dbase
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"sync"
 )
 
@@ -18,9 +20,33 @@ var (
 	// {11111110, 11111101, 11111011, 11110111, 11101111, 11011111, 10111111, 01111111}
 )
 
+// AllocationStrategy decides which run of free bits Allocate takes.
+type AllocationStrategy int
+
+const (
+	// FirstFit takes the first run long enough.
+	FirstFit AllocationStrategy = iota
+	// BestFit takes the shortest run long enough, the first of them if there are several, leaving
+	// the longer runs for longer allocations.
+	BestFit
+	// NextFit takes the first run long enough from the end of the last allocation, wrapping round to
+	// the start of the bit map.
+	NextFit
+)
+
+// ErrNoSpace is an error type - an allocation bit map has no run of free bits long enough.
+type ErrNoSpace struct {
+	Runlength uint16
+}
+
+func (e ErrNoSpace) Error() string {
+	return fmt.Sprintf("No space to allocate %d bits", e.Runlength)
+}
+
 // AllocationBitMap is a bit map containing 8 * 1000 * 8 = 64,000 allocation bits.
 type AllocationBitMap interface {
-	// Allocate runlength pages. Function will search for first available space runlength in length, returns starting bit if successful, -1 + err if not
+	// Allocate runlength pages. Function will search for available space runlength in length, using the bit map's
+	// AllocationStrategy, returns starting bit if successful, ErrNoSpace if not
 	Allocate(runlength uint16) (bit uint16, err error)
 	// AllocateExplicit allocates pages explicitly starting at bit for runlength length.
 	AllocateExplicit(bit uint16, runlength uint16) (err error)
@@ -38,58 +64,70 @@ type AllocationBitMap interface {
 
 type allocationBitMap struct {
 	sync.Mutex
-	bytes  []byte
-	maxBit uint16
+	bytes    []byte
+	maxBit   uint16
+	strategy AllocationStrategy
+	cursor   int // NextFit only, the bit following the last allocation
 }
 
 // NewAllocationBitMap returns a new allocation bit map from the provided []byte. Bitmap will be not be initialised - the assumption
 // is that bytes contains a pre-existing bit map.
 // It is intended that bytes is provided from an AllocationPage
 func NewAllocationBitMap(bytes []byte) AllocationBitMap {
+	return NewAllocationBitMapWithStrategy(bytes, FirstFit)
+}
+
+// NewAllocationBitMapWithStrategy returns an allocation bit map from the provided []byte, as NewAllocationBitMap,
+// that allocates runs using strategy.
+func NewAllocationBitMapWithStrategy(bytes []byte, strategy AllocationStrategy) AllocationBitMap {
 
 	return &allocationBitMap{
-		bytes:  bytes, // make([]byte, bitMapLen, bitMapLen),
-		maxBit: uint16((len(bytes) * 8) - 1),
+		bytes:    bytes, // make([]byte, bitMapLen, bitMapLen),
+		maxBit:   uint16((len(bytes) * 8) - 1),
+		strategy: strategy,
 		//	l:      &sync.Mutex{},
 	}
 }
 
 func (bitmap *allocationBitMap) Allocate(runlength uint16) (bit uint16, err error) {
 
+	if runlength == 0 {
+		return 0, fmt.Errorf("Allocate: Invalid args: runlength %v", runlength)
+	}
 	if (runlength - 1) > bitmap.maxBit {
 		return 0, fmt.Errorf("Allocate: Invalid args: runlength %v passes bitmap.maxBit %v (0 based)", runlength, bitmap.maxBit)
 	}
 	bitmap.Lock()
 	defer bitmap.Unlock()
 
-	bit = 0
-
-	var short bool
-	allocated := false
-	var probe uint16
-	for bit = 0; bit < (bitmap.maxBit - runlength); bit++ {
-		if !bitmap.getBit(bit) {
-			short = false
-			for probe = bit; ((probe - bit) < runlength) && (probe < bitmap.maxBit); probe++ {
-				if bitmap.getBit(probe) {
-					short = true
-					break
-				}
-			}
-			if short {
-				bit = probe
-			} else {
-				bitmap.setBits(bit, probe-bit, true)
-				allocated = true
+	n := int(runlength)
+	start := -1
+	switch bitmap.strategy {
+	case BestFit:
+		// look at each run long enough, until an exact fit, which can't be bettered
+		for bit, best := 0, 0; best != n; {
+			run := bitmap.firstFit(bit, n)
+			if run < 0 {
 				break
 			}
+			bit = bitmap.nextAllocated(run)
+			if start < 0 || bit-run < best {
+				start, best = run, bit-run
+			}
+		}
+	case NextFit:
+		if start = bitmap.firstFit(bitmap.cursor, n); start < 0 {
+			start = bitmap.firstFit(0, n)
 		}
+	default:
+		start = bitmap.firstFit(0, n)
 	}
-	if !allocated {
-		return 0, fmt.Errorf("Allocate: unable to allocate %v bits", runlength) // TODO: make this a typed error so can distinguish
+	if start < 0 {
+		return 0, ErrNoSpace{Runlength: runlength}
 	}
-
-	return bit, nil
+	bitmap.setBits(uint16(start), runlength, true)
+	bitmap.cursor = (start + n) % bitmap.len()
+	return uint16(start), nil
 }
 
 // AllocateExplicit forces allocations for bit:runlength to true
@@ -132,12 +170,7 @@ func (bitmap *allocationBitMap) IsAllocated(bit uint16, runlength uint16) (bool,
 	bitmap.Lock()
 	defer bitmap.Unlock()
 
-	result := false
-	for i := uint16(0); i < runlength; i++ {
-		result = result || bitmap.getBit(bit)
-		bit++
-	}
-	return result, nil
+	return bitmap.nextAllocated(int(bit)) < int(bit)+int(runlength), nil
 }
 
 //
@@ -145,6 +178,93 @@ func (bitmap *allocationBitMap) IsAllocated(bit uint16, runlength uint16) (bool,
 //
 //
 
+// len returns the number of bits in the bit map.
+func (bitmap *allocationBitMap) len() int {
+	return int(bitmap.maxBit) + 1
+}
+
+// word returns the 64 bits from bit w*64, bit i of the word being bit w*64+i. Bits past the end of
+// the bit map read as allocated.
+func (bitmap *allocationBitMap) word(w int) uint64 {
+	b := bitmap.bytes[w*8:]
+	if len(b) >= 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	x := ^uint64(0)
+	for i, c := range b {
+		x &^= 0xFF << (8 * i)
+		x |= uint64(c) << (8 * i)
+	}
+	return x
+}
+
+// nextFree returns the first free bit from bit on, or the bit map's length if there are none,
+// scanning a word at a time.
+func (bitmap *allocationBitMap) nextFree(bit int) int {
+	n := bitmap.len()
+	for w := bit / 64; w*64 < n; w++ {
+		x := ^bitmap.word(w)
+		if w == bit/64 {
+			x &= ^uint64(0) << (bit % 64)
+		}
+		if x != 0 {
+			return min(w*64+bits.TrailingZeros64(x), n)
+		}
+	}
+	return n
+}
+
+// nextAllocated returns the first allocated bit from bit on, or the bit map's length if there are
+// none, scanning a word at a time.
+func (bitmap *allocationBitMap) nextAllocated(bit int) int {
+	n := bitmap.len()
+	for w := bit / 64; w*64 < n; w++ {
+		x := bitmap.word(w)
+		if w == bit/64 {
+			x &= ^uint64(0) << (bit % 64)
+		}
+		if x != 0 {
+			return min(w*64+bits.TrailingZeros64(x), n)
+		}
+	}
+	return n
+}
+
+// firstFit returns the start of the first run of at least n free bits from bit on, or -1. It works
+// a word at a time: runs within a word are found by ANDing its free bits with themselves shifted,
+// and runs across words by carrying the free bits at the top of each word into the next.
+func (bitmap *allocationBitMap) firstFit(bit int, n int) int {
+	length := bitmap.len()
+	run := 0 // free bits at the top of the previous word
+	for w := bit / 64; w*64 < length; w++ {
+		free := ^bitmap.word(w)
+		if w == bit/64 {
+			free &= ^uint64(0) << (bit % 64)
+		}
+		if free == ^uint64(0) {
+			if run += 64; run >= n {
+				return w*64 + 64 - run
+			}
+			continue
+		}
+		if run+bits.TrailingZeros64(^free) >= n {
+			return w*64 - run
+		}
+		// bit i of starts is set when bits i to i+k-1 are free
+		starts := free
+		for k := 1; k < n && starts != 0; {
+			s := min(k, n-k)
+			starts &= starts >> s
+			k += s
+		}
+		if starts != 0 {
+			return w*64 + bits.TrailingZeros64(starts)
+		}
+		run = bits.LeadingZeros64(^free)
+	}
+	return -1
+}
+
 func (bitmap *allocationBitMap) getBytes() []byte {
 	return bitmap.bytes
 }
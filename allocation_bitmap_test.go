@@ -1,6 +1,9 @@
 package dbase
 
 import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"testing"
 )
 
@@ -452,3 +455,142 @@ func Test_AllocationBitMap_IsAllocated(t *testing.T) {
 		})
 	}
 }
+
+// runsBitMap returns a bit map of 64,000 bits, allocated but for the runs given as start and length.
+func runsBitMap(strategy AllocationStrategy, runs ...[2]int) AllocationBitMap {
+	bytes := make([]byte, allocationBitMapLen)
+	for i := range bytes {
+		bytes[i] = 0xFF
+	}
+	bitmap := NewAllocationBitMapWithStrategy(bytes, strategy)
+	for _, run := range runs {
+		bitmap.Deallocate(uint16(run[0]), uint16(run[1]))
+	}
+	return bitmap
+}
+
+func Test_AllocationBitMap_Strategies(t *testing.T) {
+	runs := [][2]int{{100, 10}, {200, 4}, {300, 6}, {63990, 10}}
+	tests := []struct {
+		strategy   AllocationStrategy
+		runlengths []uint16
+		wantBits   []uint16
+	}{
+		{FirstFit, []uint16{4, 4, 4, 5, 2, 8}, []uint16{100, 104, 200, 300, 108, 63990}},
+		{BestFit, []uint16{4, 4, 4, 5, 2, 8}, []uint16{200, 300, 100, 104, 304, 63990}},
+		{NextFit, []uint16{4, 4, 4, 5, 2, 8}, []uint16{100, 104, 200, 300, 63990, 63992}},
+	}
+	for _, tt := range tests {
+		bitmap := runsBitMap(tt.strategy, runs...)
+		for i, runlength := range tt.runlengths {
+			bit, err := bitmap.Allocate(runlength)
+			if err != nil {
+				t.Fatalf("strategy %d: Allocate(%d) error = %v", tt.strategy, runlength, err)
+			}
+			if bit != tt.wantBits[i] {
+				t.Errorf("strategy %d: Allocate(%d) = %d, want %d", tt.strategy, runlength, bit, tt.wantBits[i])
+			}
+		}
+		// what's left is too short
+		if _, err := bitmap.Allocate(8); err != (ErrNoSpace{Runlength: 8}) {
+			t.Errorf("strategy %d: Allocate(8) error = %v, want ErrNoSpace", tt.strategy, err)
+		}
+	}
+}
+
+func Test_AllocationBitMap_ErrNoSpace(t *testing.T) {
+	bitmap := NewAllocationBitMap([]byte{255, 254, 253, 251, 247, 239, 223, 191, 127, 1, 2, 4, 8, 16, 32, 64, 128})
+	_, err := bitmap.Allocate(16)
+	var noSpace ErrNoSpace
+	if !errors.As(err, &noSpace) || noSpace.Runlength != 16 {
+		t.Fatalf("Allocate(16) error = %v, want ErrNoSpace", err)
+	}
+	// the last bits can be allocated
+	bitmap = runsBitMap(FirstFit, [2]int{63995, 5})
+	if bit, err := bitmap.Allocate(5); err != nil || bit != 63995 {
+		t.Errorf("Allocate(5) = %d, %v, want 63995", bit, err)
+	}
+}
+
+func Test_AllocationBitMap_ZeroRunlength(t *testing.T) {
+	for _, strategy := range []AllocationStrategy{FirstFit, BestFit, NextFit} {
+		bitmap := NewAllocationBitMapWithStrategy(make([]byte, 8192), strategy)
+		if _, err := bitmap.Allocate(0); err == nil {
+			t.Errorf("strategy %d: Allocate(0) error = nil, want an error", strategy)
+		}
+	}
+}
+
+// allocateByBit is a first fit testing a bit at a time, as Allocate used to, to check and benchmark
+// against. Unlike the old Allocate it can take the last bits of the bit map, as Allocate now can.
+func allocateByBit(bitmap *allocationBitMap, runlength uint16) (uint16, error) {
+	for bit := uint16(0); bit <= bitmap.maxBit-runlength+1; bit++ {
+		found := true
+		for probe := bit; probe < bit+runlength; probe++ {
+			if bitmap.getBit(probe) {
+				bit = probe
+				found = false
+				break
+			}
+		}
+		if found {
+			return bit, nil
+		}
+	}
+	return 0, ErrNoSpace{Runlength: runlength}
+}
+
+func Test_AllocationBitMap_FirstFitByBit(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 300; i++ {
+		bytes := make([]byte, 1+random.IntN(200))
+		for j := range bytes {
+			// mostly allocated, half allocated or mostly free
+			switch i % 3 {
+			case 0:
+				bytes[j] = byte(random.Uint32() | random.Uint32())
+			case 1:
+				bytes[j] = byte(random.Uint32())
+			case 2:
+				bytes[j] = byte(random.Uint32() & random.Uint32() & random.Uint32())
+			}
+		}
+		runlength := uint16(min(1+random.IntN(8*(i%3)+4), 8*len(bytes)))
+		want, wantErr := allocateByBit(NewAllocationBitMap(bytes).(*allocationBitMap), runlength)
+		got, err := NewAllocationBitMap(bytes).Allocate(runlength)
+		if got != want || err != wantErr {
+			t.Fatalf("%v: Allocate(%d) = %d, %v, want %d, %v", bytes, runlength, got, err, want, wantErr)
+		}
+	}
+}
+
+// BenchmarkAllocationBitMapAllocate allocates, then deallocates, runs in a full bit map, but for
+// runs of 1 bit every 7 bits and, near the end, one run long enough.
+func BenchmarkAllocationBitMapAllocate(b *testing.B) {
+	runs := [][2]int{{63000, 16}}
+	for bit := 0; bit < 63000; bit += 7 {
+		runs = append(runs, [2]int{bit, 1})
+	}
+	for _, runlength := range []uint16{1, 8} {
+		b.Run(fmt.Sprintf("runlength=%d/bybit", runlength), func(b *testing.B) {
+			bitmap := runsBitMap(FirstFit, runs...).(*allocationBitMap)
+			for b.Loop() {
+				bit, _ := allocateByBit(bitmap, runlength)
+				bitmap.AllocateExplicit(bit, runlength)
+				bitmap.Deallocate(bit, runlength)
+			}
+		})
+		for _, strategy := range []struct {
+			name     string
+			strategy AllocationStrategy
+		}{{"firstfit", FirstFit}, {"bestfit", BestFit}, {"nextfit", NextFit}} {
+			b.Run(fmt.Sprintf("runlength=%d/%s", runlength, strategy.name), func(b *testing.B) {
+				bitmap := runsBitMap(strategy.strategy, runs...)
+				for b.Loop() {
+					bit, _ := bitmap.Allocate(runlength)
+					bitmap.Deallocate(bit, runlength)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package dbase
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// allocationPageSpan is the number of pages an allocation page can track, and tracks unless a file
+// store is given a shorter AllocationInterval.
+const allocationPageSpan = allocationBitMapLen * 8
+
+// ErrPageFree is returned when reading or writing a page that has been freed, see PageStore.Free.
+var ErrPageFree = errors.New("Page is free")
+
+// allocationMap tracks which of a store's pages are allocated, in allocation pages each covering
+// span pages: bit n of the k-th page is set when page k * span + n is allocated. Pages are
+// allocated by New, Append and Allocate, and freed by Free and Deallocate.
+//
+// As with a GAM and SGAM pair, the bitmaps say which pages are in use, and a count of free pages
+// for each allocation page lets searches pass over allocation pages that are full.
+type allocationMap struct {
+	span    int64
+	pages   []AllocationPage
+	bitmaps []AllocationBitMap
+	bytes   [][]byte // the bytes of each bitmap, for reading bits and counting
+	dirty   []bool   // allocation pages changed since they were last written
+	free    []int64  // free pages below the store's count, for each allocation page
+}
+
+func newAllocationMap(span int64) *allocationMap {
+	return &allocationMap{span: span}
+}
+
+// locate returns the allocation page and bit tracking page id.
+func (m *allocationMap) locate(id PageID) (int, uint16) {
+	return int(int64(id) / m.span), uint16(int64(id) % m.span)
+}
+
+// cover adds allocation pages, with nothing allocated, until there are at least n.
+func (m *allocationMap) cover(n int) {
+	for len(m.pages) < n {
+		page := NewAllocationPage()
+		bitmap := page.GetAllocationBitMap()
+		m.pages = append(m.pages, page)
+		m.bitmaps = append(m.bitmaps, bitmap)
+		m.bytes = append(m.bytes, bitmap.(*allocationBitMap).getBytes())
+		m.dirty = append(m.dirty, true)
+		m.free = append(m.free, 0)
+	}
+}
+
+// set replaces allocation page k, read from the store.
+func (m *allocationMap) set(k int, page AllocationPage) {
+	m.cover(k + 1)
+	m.pages[k] = page
+	m.bitmaps[k] = page.GetAllocationBitMap()
+	m.bytes[k] = m.bitmaps[k].(*allocationBitMap).getBytes()
+	m.dirty[k] = false
+}
+
+// isAllocated returns true if page id is allocated.
+func (m *allocationMap) isAllocated(id PageID) bool {
+	k, bit := m.locate(id)
+	if id < 0 || k >= len(m.pages) {
+		return false
+	}
+	return m.bytes[k][bit/8]&orMasks[bit%8] != 0
+}
+
+// allocate marks the n pages from id allocated. Those below count, the store's page count, must
+// have been free.
+func (m *allocationMap) allocate(id PageID, n int64, count int64) error {
+	return m.mark(id, n, count, true)
+}
+
+// deallocate marks the n pages from id, allocated pages below count, free.
+func (m *allocationMap) deallocate(id PageID, n int64, count int64) error {
+	return m.mark(id, n, count, false)
+}
+
+// mark sets the n pages from id allocated or free, an allocation page at a time, keeping the free
+// counts for the pages below count.
+func (m *allocationMap) mark(id PageID, n int64, count int64, allocated bool) error {
+	for from, to := int64(id), int64(id)+n; from < to; {
+		k, bit := m.locate(PageID(from))
+		m.cover(k + 1)
+		run := min(to, int64(k+1)*m.span) - from
+		var err error
+		if allocated {
+			err = m.bitmaps[k].AllocateExplicit(bit, uint16(run))
+		} else {
+			err = m.bitmaps[k].Deallocate(bit, uint16(run))
+		}
+		if err != nil {
+			return err
+		}
+		if below := min(from+run, count) - from; below > 0 {
+			if allocated {
+				m.free[k] -= below
+			} else {
+				m.free[k] += below
+			}
+		}
+		m.dirty[k] = true
+		from += run
+	}
+	return nil
+}
+
+// count counts the free pages below count, once the allocation pages have been read.
+func (m *allocationMap) count(count int64) {
+	for k := range m.pages {
+		n := min(int64(k+1)*m.span, count) - int64(k)*m.span
+		if n <= 0 {
+			m.free[k] = 0
+			continue
+		}
+		allocated := 0
+		b := m.bytes[k]
+		for _, x := range b[0 : n/8] {
+			allocated += bits.OnesCount8(x)
+		}
+		if n%8 != 0 {
+			allocated += bits.OnesCount8(b[n/8] & (1<<(n%8) - 1))
+		}
+		m.free[k] = n - int64(allocated)
+	}
+}
+
+// findRun returns the first page of the lowest run of n free pages, counting the pages from count,
+// the store's page count, on as free; the run may go on past the end of the store.
+func (m *allocationMap) findRun(count int64, n int64) PageID {
+	start := int64(0)
+	for k := 0; int64(k)*m.span < count; k++ {
+		first, end := int64(k)*m.span, min(int64(k+1)*m.span, count)
+		if m.free[k] == 0 {
+			// every page in it is allocated
+			start = end
+			continue
+		}
+		b := m.bitmaps[k].(*allocationBitMap)
+		for bit, limit := 0, int(end-first); bit < limit; {
+			// skip the allocated pages, then the free pages, a word at a time
+			free := min(b.nextFree(bit), limit)
+			if free > bit {
+				start = first + int64(free)
+			}
+			if free == limit {
+				break
+			}
+			bit = min(b.nextAllocated(free), limit)
+			if first+int64(bit)-start >= n {
+				return PageID(start)
+			}
+		}
+	}
+	return PageID(start)
+}
+
+// checkRun checks that the runlength pages from id are allocated pages, of the store's count.
+func (m *allocationMap) checkRun(id PageID, runlength int, count int64) error {
+	if runlength < 1 {
+		return errors.New("Invalid run length")
+	}
+	if id < 0 || int64(id)+int64(runlength) > count {
+		return errors.New("Invalid page ID")
+	}
+	for p := id; p < id+PageID(runlength); p++ {
+		if !m.isAllocated(p) {
+			return ErrPageFree
+		}
+	}
+	return nil
+}
+
+// trailing returns the store's count with the free pages at the end, below count, left out.
+func (m *allocationMap) trailing(count int64) int64 {
+	for count > 0 && !m.isAllocated(PageID(count-1)) {
+		count--
+	}
+	return count
+}
+
+// drop stops counting the free pages from to to as free, once the store has dropped them.
+func (m *allocationMap) drop(from int64, to int64) {
+	for id := from; id < to; id++ {
+		m.free[id/m.span]--
+	}
+}
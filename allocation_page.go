@@ -58,13 +58,8 @@ func (page *allocationPage) MarshalBinary() ([]byte, error) {
 func (page *allocationPage) UnmarshalBinary(buf []byte) error {
 	page.Lock()
 	defer page.Unlock()
-	if len(buf) != int(PageSize) {
-		panic("Invalid buffer")
-	}
-	// check page type, panic if wrong
-	pageType := PageType(buf[pageTypeOffset])
-	if pageType != pageTypeAllocationMap {
-		panic("Invalid page type")
+	if err := checkUnmarshal(buf, pageTypeAllocationMap); err != nil {
+		return err
 	}
 	copy(page.bytes, buf)
 	page.header = page.bytes[0:pageHeaderLength]
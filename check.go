@@ -0,0 +1,407 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	PageID      PageID
+	Slot        int16 // 0 unless the problem is with a record slot
+	Description string
+}
+
+func (p Problem) String() string {
+	if p.Slot != 0 {
+		return fmt.Sprintf("page %d slot %d: %s", p.PageID, p.Slot, p.Description)
+	}
+	return fmt.Sprintf("page %d: %s", p.PageID, p.Description)
+}
+
+// CheckReport is the result of checking a heap store.
+type CheckReport struct {
+	Pages     int64              // pages in the store
+	PageTypes map[PageType]int64 // pages of each type, readable pages only
+	Records   int64              // live records found
+	Problems  []Problem
+}
+
+// OK returns true if no problems were found.
+func (report *CheckReport) OK() bool {
+	return len(report.Problems) == 0
+}
+
+func (report *CheckReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "pages: %d, records: %d, problems: %d\n", report.Pages, report.Records, len(report.Problems))
+	types := make([]int, 0, len(report.PageTypes))
+	for t := range report.PageTypes {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		fmt.Fprintf(&sb, "  %s pages: %d\n", PageType(t), report.PageTypes[PageType(t)])
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintf(&sb, "%s\n", p)
+	}
+	return sb.String()
+}
+
+func (t PageType) String() string {
+	switch t {
+	case dbHeaderPage:
+		return "db header"
+	case dbDirectoryPage:
+		return "db directory"
+	case pageTypeHeap:
+		return "heap"
+	case pageTypeHeapHeader:
+		return "heap header"
+	case pageTypeOverflow:
+		return "overflow"
+	case pageTypeAllocationMap:
+		return "allocation"
+	}
+	return fmt.Sprintf("type 0x%02x", byte(t))
+}
+
+// CheckOptions is used to control Check
+type CheckOptions struct {
+	// SlotVersions is the heap's HeapOptions.SlotVersions, which decides the deleted slots its
+	// pages count as free for reuse.
+	SlotVersions int
+}
+
+// Check examines every page of a heap store and reports every problem found: unreadable pages,
+// page types, slot tables with records out of bounds or overlapping, header counters that don't
+// match the records found, forwarding stubs that don't lead to a moved record, broken overflow
+// chains, and allocation bits that don't match the pages in use.
+func Check(store PageStore) *CheckReport {
+	return CheckWithOptions(store, nil)
+}
+
+// CheckWithOptions checks a heap store, as Check, for a heap opened with options.
+func CheckWithOptions(store PageStore, options *CheckOptions) *CheckReport {
+	if options == nil {
+		options = &CheckOptions{}
+	}
+	c := &checker{
+		store:    store,
+		report:   &CheckReport{Pages: store.Count(), PageTypes: make(map[PageType]int64)},
+		page:     newRawPage(),
+		heapPage: NewHeapPage(),
+		buf:      make([]byte, PageSize),
+		types:    make([]PageType, store.Count()),
+		stubs:    make(map[RID]RID),
+		moved:    make(map[RID]bool),
+		overflow: make(map[PageID]overflowLinks),
+	}
+	var err error
+	if c.maxVersion, err = slotVersionLimit(options.SlotVersions); err != nil {
+		c.problem(0, 0, "%s", err)
+		return c.report
+	}
+	if c.report.Pages == 0 {
+		c.problem(0, 0, "store is empty, expected a heap header page")
+	}
+	for id := PageID(0); int64(id) < c.report.Pages; id++ {
+		c.checkPage(id)
+	}
+	c.checkHeader()
+	c.checkForwarding()
+	c.checkOverflow()
+	c.checkAllocation()
+	return c.report
+}
+
+// pageUnreadable marks pages in checker.types that couldn't be read
+const pageUnreadable = PageType(0xFF)
+
+type overflowLinks struct {
+	previous PageID
+	next     PageID
+}
+
+type checker struct {
+	store    PageStore
+	report   *CheckReport
+	page     *rawPage
+	heapPage HeapPage
+	buf      []byte
+	types    []PageType // type of each page
+
+	maxVersion byte // deleted slots at this version are retired, see CheckOptions.SlotVersions
+
+	header      bool // page 0 is a heap header
+	lastPageID  PageID
+	recordCount int64
+
+	stubs      map[RID]RID // forwarding stub target -> home
+	moved      map[RID]bool
+	overflow   map[PageID]overflowLinks
+	allocation [][]byte // allocation page bitmaps, in page order
+}
+
+func (c *checker) problem(id PageID, slot int16, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, Problem{PageID: id, Slot: slot, Description: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) checkPage(id PageID) {
+	if err := c.store.Read(id, c.page); err == ErrPageFree {
+		c.checkFreePage(id)
+		return
+	} else if err != nil {
+		c.types[id] = pageUnreadable
+		c.problem(id, 0, "unreadable: %s", err)
+		return
+	}
+	b := c.page.bytes
+	t := c.page.GetType()
+	c.types[id] = t
+	c.report.PageTypes[t]++
+
+	if id == 0 {
+		if t != pageTypeHeapHeader {
+			c.problem(id, 0, "expected a heap header page, got: %s", t)
+			return
+		}
+		c.header = true
+		c.lastPageID = PageID(binary.LittleEndian.Uint64(b[heapLastPageIDOffset:]))
+		c.recordCount = int64(binary.LittleEndian.Uint64(b[heapRecordCountOffset:]))
+		return
+	}
+	switch t {
+	case pageTypeHeap:
+		c.checkHeapPage(id, b)
+	case pageTypeOverflow:
+		links := overflowLinks{
+			previous: PageID(binary.LittleEndian.Uint64(b[overflowPreviousIDOffset:])),
+			next:     PageID(binary.LittleEndian.Uint64(b[overflowNextIDOffset:])),
+		}
+		c.overflow[id] = links
+		if length := binary.LittleEndian.Uint16(b[overflowSegmentLenOffset:]); length > uint16(maxSegmentLen) {
+			c.problem(id, 0, "overflow segment length %d exceeds %d", length, maxSegmentLen)
+		}
+	case pageTypeAllocationMap:
+		c.allocation = append(c.allocation, append([]byte(nil), b[allocationBitMapOffset:allocationBitMapOffset+allocationBitMapLen]...))
+	case pageTypeHeapHeader:
+		c.problem(id, 0, "heap header page found after page 0")
+	default:
+		c.problem(id, 0, "unexpected page type: %s", t)
+	}
+}
+
+// checkFreePage checks that free page id is empty, as freeing a page leaves it, if the store can
+// read a free page; a page in use whose bit the allocation map lost holds what was written to it.
+func (c *checker) checkFreePage(id PageID) {
+	raw, ok := c.store.(RawPageReader)
+	if !ok {
+		return
+	}
+	if err := raw.ReadRaw(id, c.page.bytes); err != nil {
+		c.types[id] = pageUnreadable
+		c.problem(id, 0, "unreadable: %s", err)
+		return
+	}
+	// a freed page is written as zeros, stamped with a checksum and LSN
+	clear(c.page.bytes[pageChecksumOffset:pageHeaderLength])
+	if slices.ContainsFunc(c.page.bytes, func(b byte) bool { return b != 0 }) {
+		c.problem(id, 0, "free, but holds a %s page", c.page.GetType())
+	}
+}
+
+// extent is the part of the slot table area used by a slot
+type extent struct {
+	slot   int16
+	offset int16
+	length int16
+}
+
+func (c *checker) checkHeapPage(id PageID, b []byte) {
+	slotTable := b[slotTableOffset:]
+	slotCount := int16(binary.LittleEndian.Uint16(b[slotCountOffset:]))
+	deletedCount := int16(binary.LittleEndian.Uint16(b[deletedCountOffset:]))
+	entryLen, ok := heapEntryLen(b)
+	if !ok {
+		c.problem(id, 0, "unknown heap page version %d", b[pageVersionOffset])
+		return
+	}
+	if slotCount < 1 || int(slotCount)*int(entryLen) > int(slotTableLen) {
+		c.problem(id, 0, "slot count %d out of range", slotCount)
+		return
+	}
+	tableStart := slotTableLen - slotCount*entryLen
+	_, _, freeOffset, freeLength := slotEntry(slotTable, entryLen, 0)
+	if freeOffset < 0 || freeLength < 0 || freeOffset > tableStart || freeOffset+freeLength > tableStart {
+		c.problem(id, 0, "free space offset %d length %d overlaps slot table at %d", freeOffset, freeLength, tableStart)
+		return
+	}
+
+	checkRecords := false
+	var extents []extent
+	deleted := int16(0)
+	for slot := int16(1); slot < slotCount; slot++ {
+		flags, version, offset, length := slotEntry(slotTable, entryLen, slot)
+		switch {
+		case flags == recordDeleted:
+			if version < c.maxVersion {
+				deleted++
+			}
+			continue
+		case flags == recordForwarded:
+			if length != forwardStubLen {
+				c.problem(id, slot, "forwarding stub length %d, expected %d", length, forwardStubLen)
+			} else if offset >= 0 && offset+length <= freeOffset {
+				to := RID{
+					PageID: PageID(binary.LittleEndian.Uint64(slotTable[offset:])),
+					Slot:   int16(binary.LittleEndian.Uint16(slotTable[offset+8:])),
+				}
+				if home, ok := c.stubs[to]; ok {
+					c.problem(id, slot, "forwards to %d:%d, as does %d:%d", to.PageID, to.Slot, home.PageID, home.Slot)
+				}
+				c.stubs[to] = RID{PageID: id, Slot: slot}
+			}
+			c.report.Records++
+		case flags&recordOnPage != 0 && flags&^(recordOnPage|recordMoved|recordCompressed) == 0:
+			if flags&recordMoved != 0 {
+				c.moved[RID{PageID: id, Slot: slot}] = true
+			} else {
+				c.report.Records++
+			}
+			if flags&recordCompressed != 0 {
+				checkRecords = true
+			}
+		default:
+			c.problem(id, slot, "invalid slot flags 0x%02x", flags)
+			continue
+		}
+		if offset < 0 || length < 0 || offset+length > freeOffset {
+			c.problem(id, slot, "record offset %d length %d outside record area 0:%d", offset, length, freeOffset)
+			continue
+		}
+		extents = append(extents, extent{slot: slot, offset: offset, length: length})
+	}
+	if deleted != deletedCount {
+		c.problem(id, 0, "deleted count %d, found %d deleted slots", deletedCount, deleted)
+	}
+
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+	for i := 1; i < len(extents); i++ {
+		if prev := extents[i-1]; prev.offset+prev.length > extents[i].offset {
+			c.problem(id, extents[i].slot, "record overlaps slot %d", prev.slot)
+		}
+	}
+
+	if checkRecords && c.heapPage.UnmarshalBinary(b) == nil {
+		for _, e := range extents {
+			if c.heapPage.IsCompressed(e.slot) {
+				if _, err := getRecord(c.heapPage, e.slot, c.buf); err != nil {
+					c.problem(id, e.slot, "%s", err)
+				}
+			}
+		}
+	}
+}
+
+func (c *checker) checkHeader() {
+	if !c.header {
+		return
+	}
+	if c.lastPageID < 1 || int64(c.lastPageID) >= c.report.Pages {
+		c.problem(0, 0, "last page ID %d out of range, store has %d pages", c.lastPageID, c.report.Pages)
+	} else if t := c.types[c.lastPageID]; t != pageTypeHeap && t != pageUnreadable {
+		c.problem(0, 0, "last page ID %d is a %s page", c.lastPageID, t)
+	}
+	for id := c.lastPageID + 1; int64(id) < c.report.Pages; id++ {
+		if id > 0 && c.types[id] == pageTypeHeap {
+			c.problem(id, 0, "heap page after last page ID %d", c.lastPageID)
+		}
+	}
+	if c.recordCount != c.report.Records {
+		c.problem(0, 0, "record count %d, found %d records", c.recordCount, c.report.Records)
+	}
+}
+
+func (c *checker) checkForwarding() {
+	for to, home := range c.stubs {
+		if to.PageID < 0 || int64(to.PageID) >= c.report.Pages {
+			c.problem(home.PageID, home.Slot, "forwards to page %d, out of range", to.PageID)
+		} else if c.types[to.PageID] != pageUnreadable && !c.moved[to] {
+			c.problem(home.PageID, home.Slot, "forwards to %d:%d, which isn't a moved record", to.PageID, to.Slot)
+		}
+	}
+	for rid := range c.moved {
+		if _, ok := c.stubs[rid]; !ok {
+			c.problem(rid.PageID, rid.Slot, "moved record has no forwarding stub")
+		}
+	}
+}
+
+func (c *checker) checkOverflow() {
+	for id, links := range c.overflow {
+		if links.next != 0 {
+			if next, ok := c.overflow[links.next]; !ok {
+				c.problem(id, 0, "next overflow page %d isn't an overflow page", links.next)
+			} else if next.previous != id {
+				c.problem(id, 0, "next overflow page %d links back to %d", links.next, next.previous)
+			}
+		}
+		if links.previous != 0 {
+			if previous, ok := c.overflow[links.previous]; !ok {
+				c.problem(id, 0, "previous overflow page %d isn't an overflow page", links.previous)
+			} else if previous.next != id {
+				c.problem(id, 0, "previous overflow page %d links on to %d", links.previous, previous.next)
+			}
+		}
+	}
+}
+
+// checkAllocation checks allocation bitmaps against the pages in use: those of the store's own
+// allocation map, if it keeps one, and any allocation pages among the store's pages, where bit n
+// of the k-th allocation page is set when page k * allocationPageSpan + n is allocated.
+func (c *checker) checkAllocation() {
+	for k, bitmap := range c.allocation {
+		c.checkBitmap(PageID(int64(k)*allocationPageSpan), allocationPageSpan, bitmap)
+	}
+	store, ok := c.store.(AllocationMapReader)
+	if !ok {
+		return
+	}
+	span, pages := store.AllocationSpan()
+	if pages == 0 {
+		return
+	}
+	page := NewAllocationPage()
+	for k := 0; k < pages; k++ {
+		if err := store.ReadAllocationPage(k, page); err != nil {
+			c.problem(allocationPageID(k), 0, "unreadable allocation page: %s", err)
+			continue
+		}
+		c.checkBitmap(PageID(int64(k)*span), span, page.GetAllocationBitMap().(*allocationBitMap).getBytes())
+	}
+	if end := int64(pages) * span; end < c.report.Pages {
+		c.problem(PageID(end), 0, "pages %d to %d not tracked by the allocation map", end, c.report.Pages-1)
+	}
+}
+
+// checkBitmap checks allocation bitmap, tracking the span pages from first, against the pages in
+// use.
+func (c *checker) checkBitmap(first PageID, span int64, bitmap []byte) {
+	for n := int64(0); n < span; n++ {
+		id := first + PageID(n)
+		allocated := bitmap[n/8]&orMasks[n%8] != 0
+		switch {
+		case int64(id) >= c.report.Pages:
+			if allocated {
+				c.problem(id, 0, "allocated beyond the end of the store")
+			}
+		case !allocated && c.types[id] != 0 && c.types[id] != pageUnreadable:
+			c.problem(id, 0, "%s page in use but not allocated", c.types[id])
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newCheckedHeap returns a memory store holding a heap with forwarded, deleted and compressed records.
+func newCheckedHeap(t *testing.T) (PageStore, []RID) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	heap := NewHeapWithOptions(store, &HeapOptions{Compress: true, CompressionLevel: 1})
+	var rids []RID
+	for i := 0; i < 1000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	for i, rid := range rids {
+		switch i % 10 {
+		case 0:
+			if err := heap.Delete(rid); err != nil {
+				t.Fatalf("heap.Delete, err: %s", err)
+			}
+		case 1:
+			// random bytes don't compress, so the record grows and moves
+			record := make([]byte, 1500)
+			rand.New(rand.NewSource(int64(i))).Read(record)
+			if err := heap.Set(rid, record); err != nil {
+				t.Fatalf("heap.Set, err: %s", err)
+			}
+		}
+	}
+	return store, rids
+}
+
+func TestCheck(t *testing.T) {
+
+	store, _ := newCheckedHeap(t)
+	report := Check(store)
+	if !report.OK() {
+		t.Fatalf("Check healthy heap, expected: no problems, got:\n%s", report)
+	}
+	if report.Records != 900 {
+		t.Errorf("Check records, expected: 900, got: %d", report.Records)
+	}
+	if report.PageTypes[pageTypeHeap] != store.Count()-1 {
+		t.Errorf("Check heap pages, expected: %d, got: %d", store.Count()-1, report.PageTypes[pageTypeHeap])
+	}
+}
+
+func TestCheckProblems(t *testing.T) {
+
+	page := newRawPage()
+	slotEntry := func(slot int16) []byte {
+		return page.bytes[slotTableOffset+slotTableLen-(slot+1)*slotTableEntryLen:]
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, store PageStore, rids []RID)
+		want    string
+	}{
+		{"page type", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(2, page)
+			page.bytes[pageTypeOffset] = 0x42
+			store.Write(2, page)
+		}, "unexpected page type"},
+		{"overlap", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(1, page)
+			copy(slotEntry(3)[2:4], slotEntry(2)[2:4])
+			store.Write(1, page)
+		}, "overlaps"},
+		{"out of bounds", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(1, page)
+			binary.LittleEndian.PutUint16(slotEntry(2)[4:], uint16(slotTableLen))
+			store.Write(1, page)
+		}, "outside record area"},
+		{"record count", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(0, page)
+			binary.LittleEndian.PutUint64(page.bytes[heapRecordCountOffset:], 5)
+			store.Write(0, page)
+		}, "record count 5"},
+		{"last page", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(0, page)
+			binary.LittleEndian.PutUint64(page.bytes[heapLastPageIDOffset:], uint64(store.Count()))
+			store.Write(0, page)
+		}, "last page ID"},
+		{"forwarding", func(t *testing.T, store PageStore, rids []RID) {
+			for _, rid := range rids {
+				store.Read(rid.PageID, page)
+				if slotEntry(rid.Slot)[0] == recordForwarded {
+					slotEntry(rid.Slot)[0] = recordDeleted
+					store.Write(rid.PageID, page)
+					return
+				}
+			}
+			t.Fatal("no forwarded record")
+		}, "moved record has no forwarding stub"},
+		{"compressed", func(t *testing.T, store PageStore, rids []RID) {
+			store.Read(rids[5].PageID, page)
+			e := slotEntry(rids[5].Slot)
+			offset := binary.LittleEndian.Uint16(e[2:])
+			page.bytes[slotTableOffset+int(offset)+compressedLenLen] ^= 0xFF
+			store.Write(rids[5].PageID, page)
+		}, "corrupt"},
+		{"overflow chain", func(t *testing.T, store PageStore, rids []RID) {
+			first, second := NewOverflowPage(), NewOverflowPage()
+			firstID, _ := store.Append(first)
+			secondID, _ := store.Append(second)
+			first.SetNextPageID(secondID)
+			second.SetPreviousPageID(firstID + 100)
+			store.Write(firstID, first)
+			store.Write(secondID, second)
+		}, "links back"},
+		{"allocation", func(t *testing.T, store PageStore, rids []RID) {
+			allocation := NewAllocationPage()
+			allocation.GetAllocationBitMap().AllocateExplicit(0, uint16(store.Count()+5))
+			store.Append(allocation)
+		}, "allocated beyond the end of the store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, rids := newCheckedHeap(t)
+			tt.corrupt(t, store, rids)
+			report := Check(store)
+			if !strings.Contains(report.String(), tt.want) {
+				t.Errorf("Check, expected a problem containing %q, got:\n%s", tt.want, report)
+			}
+		})
+	}
+}
+
+func TestCheckAllocationMap(t *testing.T) {
+
+	store, err := Open(filepath.Join(t.TempDir(), "store"), 0666, &FileStoreOptions{AllocationMap: true, AllocationInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	heap := NewHeap(store)
+	for i := 0; i < 200; i++ {
+		if _, err := heap.Put(make([]byte, 500)); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+	overflowID, _ := store.Append(NewOverflowPage())
+	if err := store.Free(overflowID); err != nil {
+		t.Fatal(err)
+	}
+	if report := Check(store); !report.OK() {
+		t.Fatalf("Check healthy store, expected: no problems, got:\n%s", report)
+	}
+
+	// the store's map, past its first allocation page, is checked against the pages
+	fs := store.(*fileStore)
+	end := PageID(store.Count())
+	fs.alloc.allocate(end+1, 1, store.Count())
+	report := Check(store)
+	if want := fmt.Sprintf("page %d: allocated beyond the end of the store", end+1); !strings.Contains(report.String(), want) {
+		t.Errorf("Check, expected a problem containing %q, got:\n%s", want, report)
+	}
+}
+
+func TestCheckFreePageInUse(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := Open(path, 0666, &FileStoreOptions{AllocationMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heap := NewHeap(store)
+	for i := 0; i < 20; i++ {
+		if _, err := heap.Put(make([]byte, 500)); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+
+	// clear the bit of a live heap page, leaving the page as it is, and write the map to disk
+	fs := store.(*fileStore)
+	if err := fs.alloc.deallocate(2, 1, fs.count); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.flushAllocation(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err = Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	report := Check(store)
+	if want := "page 2: free, but holds a heap page"; !strings.Contains(report.String(), want) {
+		t.Errorf("Check, expected a problem containing %q, got:\n%s", want, report)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/trpedersen/dbase"
+)
+
+// backup copies the file store at src to a new file at dst, or with -since writes an incremental
+// backup of the pages changed since the given LSN; -since 0 writes a full backup to start a chain.
+// The copy is consistent provided no other process is writing to the store.
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	since := flags.Int64("since", -1, "write an incremental backup of pages changed since this LSN")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: dbase [-key hex] backup [-since lsn] <src> <dst>")
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+	store, err := openStore(src, &dbase.FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *since < 0 {
+		if err := store.Snapshot(dst); err != nil {
+			return err
+		}
+		log.Printf("backed up %d pages from %s to %s", store.Count(), src, dst)
+		return nil
+	}
+
+	file, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	lsn, err := store.BackupIncremental(file, dbase.LSN(*since))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	log.Printf("backed up pages changed since LSN %d from %s to %s, next backup: -since %d", *since, src, dst, lsn)
+	return nil
+}
+
+// restore creates a new file store at dst from a full backup followed by a chain of incremental
+// backups. With -archive it then replays the archived log up to -lsn or -time, or to its end.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	archive := flags.String("archive", "", "replay the log archived in this directory")
+	lsn := flags.Uint64("lsn", 0, "replay the log up to this LSN")
+	at := flags.String("time", "", "replay the log up to this RFC 3339 time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return errors.New("usage: dbase [-key hex] restore [-archive dir [-lsn lsn | -time time]] <dst> <full> [incremental...]")
+	}
+	options, err := withKey(nil)
+	if err != nil {
+		return err
+	}
+	target := dbase.LSN(math.MaxUint64)
+	if *lsn != 0 {
+		target = dbase.LSN(*lsn)
+	} else if *at != "" {
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return fmt.Errorf("-time: %s", err)
+		}
+		target = dbase.LSNAt(t)
+	}
+
+	var backups []io.Reader
+	for _, path := range flags.Args()[1:] {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		backups = append(backups, file)
+	}
+	dst := flags.Arg(0)
+	if *archive == "" {
+		if err := dbase.Restore(dst, options, backups...); err != nil {
+			return err
+		}
+		log.Printf("restored %s from %d backups", dst, len(backups))
+		return nil
+	}
+	restored, err := dbase.RestoreToPoint(dst, options, *archive, target, backups...)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored %s from %d backups and the log in %s, to LSN %d (%s)", dst, len(backups), *archive, restored,
+		time.Unix(0, int64(restored)).Format(time.RFC3339Nano))
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/trpedersen/dbase"
+)
+
+// check reports every problem found in the heap file store at args[0]. -slot-versions gives the
+// heap's HeapOptions.SlotVersions, if set.
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	slotVersions := flags.Int("slot-versions", 0, "the heap's SlotVersions option")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: dbase [-key hex] check [-slot-versions n] <file>")
+	}
+	path := flags.Arg(0)
+	store, err := openStore(path, &dbase.FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report := dbase.CheckWithOptions(store, &dbase.CheckOptions{SlotVersions: *slotVersions})
+	fmt.Fprint(os.Stdout, report)
+	if !report.OK() {
+		return fmt.Errorf("%d problems found in %s", len(report.Problems), path)
+	}
+	return nil
+}
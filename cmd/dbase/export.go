@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/trpedersen/dbase"
+)
+
+// export writes every record in the heap file store at src to dst, or to stdout, as jsonl, csv or
+// length-prefixed binary, with -rid including each record's RID.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "export format: jsonl, csv or binary")
+	rid := flags.Bool("rid", false, "include each record's RID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: dbase [-key hex] export [-format jsonl|csv|binary] [-rid] <src> [dst]")
+	}
+	options := &dbase.ExportOptions{IncludeRID: *rid}
+	var err error
+	if options.Format, err = dbase.ParseExportFormat(*format); err != nil {
+		return err
+	}
+	store, err := openStore(flags.Arg(0), &dbase.FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if store.Count() == 0 {
+		return fmt.Errorf("%s is empty", flags.Arg(0))
+	}
+	heap, err := dbase.OpenHeap(store)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if flags.NArg() == 2 {
+		file, err := os.OpenFile(flags.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	count, err := dbase.Export(heap, w, options)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d records from %s", count, flags.Arg(0))
+	return nil
+}
+
+// importHeap bulk loads the records exported to src, or read from stdin, into a new heap file store at dst,
+// with -compress compressing the records.
+func importHeap(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "import format: jsonl, csv or binary")
+	compress := flags.Bool("compress", false, "compress records")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: dbase [-key hex] import [-format jsonl|csv|binary] [-compress] <dst> [src]")
+	}
+	options := &dbase.ExportOptions{}
+	if *compress {
+		options.HeapOptions = &dbase.HeapOptions{Compress: true, CompressionLevel: flate.DefaultCompression}
+	}
+	var err error
+	if options.Format, err = dbase.ParseExportFormat(*format); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() == 2 {
+		file, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	dst := flags.Arg(0)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	store, err := openStore(dst, nil)
+	if err != nil {
+		return err
+	}
+	count, err := dbase.Import(store, r, options)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	log.Printf("imported %d records into %s", count, dst)
+	return nil
+}
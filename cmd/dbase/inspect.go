@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/trpedersen/dbase"
+)
+
+// inspect prints the decoded contents of page args[1] of the file store at args[0], or a summary
+// of every page if no page is given, starting with the allocation pages, at negative page IDs, of
+// a store with an allocation map.
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print as JSON")
+	raw := flags.Bool("hex", false, "print a hex dump of the raw page")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: dbase [-key hex] inspect [-json] [-hex] <file> [pageID]")
+	}
+	store, err := openStore(flags.Arg(0), &dbase.FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	first, last := dbase.PageID(0), dbase.PageID(store.Count()-1)
+	if _, pages := store.AllocationSpan(); pages > 0 {
+		first = dbase.PageID(-pages)
+	}
+	if flags.NArg() == 2 {
+		id, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("pageID: %s", err)
+		}
+		first, last = dbase.PageID(id), dbase.PageID(id)
+	}
+
+	var infos []*dbase.PageInfo
+	for id := first; id <= last; id++ {
+		info, buf, err := dbase.InspectPage(store, id)
+		if err != nil {
+			return fmt.Errorf("page %d: %s", id, err)
+		}
+		if *raw {
+			fmt.Printf("page %d:\n%s", id, hex.Dump(buf))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if *raw {
+		return nil
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if flags.NArg() == 2 {
+			return enc.Encode(infos[0])
+		}
+		return enc.Encode(infos)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if flags.NArg() == 2 {
+		printPage(w, infos[0])
+	} else {
+		printSummary(w, infos)
+	}
+	return w.Flush()
+}
+
+// printSummary prints a line for each page.
+func printSummary(w io.Writer, infos []*dbase.PageInfo) {
+	fmt.Fprintln(w, "PAGE\tTYPE\tLSN\tCHECKSUM\tSLOTS\tFREE")
+	for _, info := range infos {
+		slots, free := "", ""
+		if info.Heap != nil {
+			slots, free = strconv.Itoa(int(info.Heap.SlotCount)), strconv.Itoa(int(info.Heap.FreeSpace))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", info.ID, info.Type, info.LSN, checksum(info), slots, free)
+	}
+}
+
+// printPage prints the header and type specific fields of a page.
+func printPage(w io.Writer, info *dbase.PageInfo) {
+	fmt.Fprintf(w, "page:\t%d\n", info.ID)
+	fmt.Fprintf(w, "header page ID:\t%d\n", info.HeaderID)
+	fmt.Fprintf(w, "type:\t%s (0x%02x)\n", info.Type, info.TypeCode)
+	fmt.Fprintf(w, "LSN:\t%d\n", info.LSN)
+	fmt.Fprintf(w, "checksum:\t%s\n", checksum(info))
+
+	switch {
+	case info.HeapHeader != nil:
+		fmt.Fprintf(w, "last page ID:\t%d\n", info.HeapHeader.LastPageID)
+		fmt.Fprintf(w, "record count:\t%d\n", info.HeapHeader.RecordCount)
+	case info.Overflow != nil:
+		fmt.Fprintf(w, "previous page ID:\t%d\n", info.Overflow.PreviousPageID)
+		fmt.Fprintf(w, "next page ID:\t%d\n", info.Overflow.NextPageID)
+		fmt.Fprintf(w, "segment ID:\t%d\n", info.Overflow.SegmentID)
+		fmt.Fprintf(w, "segment length:\t%d\n", info.Overflow.SegmentLength)
+	case info.Allocation != nil:
+		fmt.Fprintf(w, "bits:\t%d\n", info.Allocation.Bits)
+		fmt.Fprintf(w, "allocated:\t%d\n", info.Allocation.Allocated)
+		fmt.Fprintf(w, "first free:\t%d\n", info.Allocation.FirstFree)
+		fmt.Fprintf(w, "largest free run:\t%d\n", info.Allocation.LargestFreeRun)
+	case info.Heap != nil:
+		fmt.Fprintf(w, "format version:\t%d\n", info.Heap.Version)
+		fmt.Fprintf(w, "slot count:\t%d\n", info.Heap.SlotCount)
+		fmt.Fprintf(w, "deleted count:\t%d\n", info.Heap.DeletedCount)
+		fmt.Fprintf(w, "free offset:\t%d\n", info.Heap.FreeOffset)
+		fmt.Fprintf(w, "free space:\t%d\n", info.Heap.FreeSpace)
+		fmt.Fprintln(w, "\nSLOT\tFLAGS\tSTATE\tVERSION\tOFFSET\tLENGTH\tTO")
+		for _, s := range info.Heap.Slots {
+			to := ""
+			if s.To != nil {
+				to = fmt.Sprintf("%d:%d", s.To.PageID, s.To.Slot)
+			}
+			fmt.Fprintf(w, "%d\t0x%02x\t%s\t%d\t%d\t%d\t%s\n", s.Slot, s.Flags, s.State, s.Version, s.Offset, s.Length, to)
+		}
+	}
+}
+
+func checksum(info *dbase.PageInfo) string {
+	switch {
+	case info.Checksum == 0:
+		return "none"
+	case !info.ChecksumOK:
+		return fmt.Sprintf("%08x BAD", info.Checksum)
+	}
+	return fmt.Sprintf("%08x ok", info.Checksum)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
@@ -12,10 +14,34 @@ import (
 	randstr "github.com/trpedersen/rand"
 )
 
+var key = flag.String("key", "", "hex encoded encryption key for encrypted stores")
+
+// commands are the dbase subcommands, e.g. dbase backup <src> <dst>
+var commands = map[string]func(args []string) error{
+	"backup":  backup,
+	"check":   check,
+	"export":  export,
+	"import":  importHeap,
+	"inspect": inspect,
+	"restore": restore,
+	"salvage": salvage,
+}
+
 func main() {
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("unknown command: %s", flag.Arg(0))
+		}
+		if err := command(flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %s", flag.Arg(0), err)
+		}
+		return
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -87,16 +113,16 @@ func Test_HeapWrite(store dbase.PageStore) {
 		log.Fatalf("Record count, expected: %d, got: %d", heapRuns, count)
 	}
 
-	log.Println(heap.Statistics())
-	log.Println(store.Statistics())
+	log.Println(heap.Stats())
+	log.Println(store.Stats())
 
 	count = heap.Count()
 	if count != int64(heapRuns) {
 		log.Fatalf("Record count, expected: %d, got: %d", heapRuns, count)
 	}
 
-	log.Println(heap.Statistics())
-	log.Println(store.Statistics())
+	log.Println(heap.Stats())
+	log.Println(store.Stats())
 }
 
 func Test_CreateHeap() {
@@ -127,6 +153,30 @@ func Test_CreateHeap() {
 
 }
 
+// openStore opens the file store at path, using the -key flag if given.
+func openStore(path string, options *dbase.FileStoreOptions) (dbase.FileStore, error) {
+	options, err := withKey(options)
+	if err != nil {
+		return nil, err
+	}
+	return dbase.Open(path, 0666, options)
+}
+
+// withKey returns options with the encryption key from the -key flag, if given.
+func withKey(options *dbase.FileStoreOptions) (*dbase.FileStoreOptions, error) {
+	if options == nil {
+		options = &dbase.FileStoreOptions{}
+	}
+	if *key != "" {
+		k, err := hex.DecodeString(*key)
+		if err != nil {
+			return nil, fmt.Errorf("-key: %s", err)
+		}
+		options.EncryptionKey = k
+	}
+	return options, nil
+}
+
 // tempfile returns a temporary file path.
 func tempfile() string {
 
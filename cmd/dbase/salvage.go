@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/trpedersen/dbase"
+)
+
+// salvage copies every readable record in the heap file store at args[0] to a new heap file store at args[1].
+func salvage(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: dbase [-key hex] salvage <src> <dst>")
+	}
+	src, err := openStore(args[0], &dbase.FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := os.Stat(args[1]); err == nil {
+		return fmt.Errorf("%s already exists", args[1])
+	}
+	dst, err := openStore(args[1], nil)
+	if err != nil {
+		return err
+	}
+	report, err := dbase.Salvage(src, dst)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if report != nil {
+		fmt.Fprintln(os.Stdout, report)
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package dbase
+
+import "context"
+
+// ctxMutex is a mutex whose waiters can give up when a context is done. The zero value isn't
+// usable; use newCtxMutex.
+type ctxMutex struct {
+	ch chan struct{}
+}
+
+func newCtxMutex() *ctxMutex {
+	return &ctxMutex{ch: make(chan struct{}, 1)}
+}
+
+// Lock locks m, waiting until it is available.
+func (m *ctxMutex) Lock() {
+	m.ch <- struct{}{}
+}
+
+// LockContext locks m, or returns ctx.Err() if ctx is done first.
+func (m *ctxMutex) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks m.
+func (m *ctxMutex) Unlock() {
+	<-m.ch
+}
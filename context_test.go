@@ -0,0 +1,309 @@
+package dbase
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeapContext(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+	for i := 0; i < 1000; i++ {
+		if _, err := heap.Put(jsonRecord(i)); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+	buf := make([]byte, PageSize)
+
+	// a put waiting for the heap gives up at its deadline
+	heapLock(heap).Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := heap.PutContext(ctx, jsonRecord(0)); err != context.DeadlineExceeded {
+		t.Errorf("PutContext locked heap, expected: %v, got: %v", context.DeadlineExceeded, err)
+	}
+	heapLock(heap).Unlock()
+	if _, err := heap.PutContext(context.Background(), jsonRecord(1000)); err != nil {
+		t.Errorf("PutContext, err: %s", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := heap.GetContext(cancelled, RID{PageID: 1, Slot: 1}, buf); err != context.Canceled {
+		t.Errorf("GetContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	if err := heap.DeleteContext(cancelled, RID{PageID: 1, Slot: 1}); err != context.Canceled {
+		t.Errorf("DeleteContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	if rids, err := heap.PutBatchContext(cancelled, [][]byte{jsonRecord(0)}); err != context.Canceled || len(rids) != 0 {
+		t.Errorf("PutBatchContext, expected: no RIDs and %v, got: %v and %v", context.Canceled, rids, err)
+	}
+	if _, err := heap.GetBatchContext(cancelled, []RID{{PageID: 1, Slot: 1}}, [][]byte{buf}); err != context.Canceled {
+		t.Errorf("GetBatchContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	if err := heap.DeleteBatchContext(cancelled, []RID{{PageID: 1, Slot: 1}}); err != context.Canceled {
+		t.Errorf("DeleteBatchContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	if err := store.ReadContext(cancelled, 0, NewHeapHeaderPage()); err != context.Canceled {
+		t.Errorf("ReadContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	if heap.Count() != 1001 {
+		t.Errorf("heap.Count, expected: 1001, got: %d", heap.Count())
+	}
+
+	// a cancelled scan carries on where it stopped
+	scanner := NewHeapScanner(heap)
+	var count int
+	for {
+		_, _, err := scanner.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		count++
+		if count%100 == 0 {
+			if _, _, err := scanner.NextContext(cancelled, buf); err != context.Canceled && err != nil {
+				t.Fatalf("scanner.NextContext, expected: %v or nil, got: %v", context.Canceled, err)
+			} else if err == nil {
+				count++
+			}
+		}
+	}
+	if count != 1001 {
+		t.Errorf("scan count, expected: 1001, got: %d", count)
+	}
+}
+
+func TestHeapBatchContextCancelled(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+	var rids []RID
+	for i := 0; i < 1000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+
+	// a batch put cancelled part way keeps the records added before then; ctx is checked taking the
+	// heap lock, then before each record
+	bufs := make([][]byte, 100)
+	for i := range bufs {
+		bufs[i] = jsonRecord(1000 + i)
+	}
+	added, err := heap.PutBatchContext(cancelAfter(51), bufs)
+	if err != context.Canceled || len(added) != 50 {
+		t.Errorf("PutBatchContext, expected: 50 RIDs and %v, got: %d and %v", context.Canceled, len(added), err)
+	}
+	checkUnlocked(t, heapLock(heap))
+	if heap.Count() != 1050 {
+		t.Errorf("heap.Count, expected: 1050, got: %d", heap.Count())
+	}
+
+	// a batch get cancelled part way has read the records on the pages it got to
+	reads := make([][]byte, len(rids))
+	for i := range reads {
+		reads[i] = make([]byte, PageSize)
+	}
+	ns, err := heap.GetBatchContext(cancelAfter(2), rids, reads)
+	if err != context.Canceled {
+		t.Errorf("GetBatchContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	var got int
+	for i, n := range ns {
+		if n == 0 {
+			continue
+		}
+		got++
+		if string(reads[i][0:n]) != string(jsonRecord(i)) {
+			t.Fatalf("GetBatchContext %v, expected: %s, got: %s", rids[i], jsonRecord(i), reads[i][0:n])
+		}
+	}
+	if got == 0 || got == len(rids) {
+		t.Errorf("GetBatchContext, expected: some of %d records read, got: %d", len(rids), got)
+	}
+
+	// a batch delete cancelled part way counts the records it deleted
+	if err := heap.DeleteBatchContext(cancelAfter(2), rids); err != context.Canceled {
+		t.Errorf("DeleteBatchContext, expected: %v, got: %v", context.Canceled, err)
+	}
+	checkUnlocked(t, heapLock(heap))
+	if heap.Count() <= 50 || heap.Count() >= 1050 {
+		t.Errorf("heap.Count, expected: some of 1000 records deleted, got: %d left", heap.Count())
+	}
+	if report := Check(store); !report.OK() {
+		t.Errorf("Check, expected: no problems, got:\n%s", report)
+	}
+	if err := heap.DeleteBatch(rids); err != nil {
+		t.Errorf("DeleteBatch, err: %s", err)
+	}
+	if heap.Count() != 50 {
+		t.Errorf("heap.Count, expected: 50, got: %d", heap.Count())
+	}
+}
+
+func TestScannerNextContext(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+	for i := 0; i < 1000; i++ {
+		if _, err := heap.Put(jsonRecord(i)); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+	buf := make([]byte, PageSize)
+
+	for _, readAhead := range []int{0, 4} {
+		t.Run(fmt.Sprintf("read ahead %d", readAhead), func(t *testing.T) {
+			scanner := NewHeapScannerWithOptions(heap, &HeapScannerOptions{ReadAhead: readAhead})
+			defer scanner.Close()
+
+			// a call waiting for another to finish gives up at its deadline
+			lock := scanner.(*heapScanner).l
+			lock.Lock()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, _, err := scanner.NextContext(ctx, buf); err != context.DeadlineExceeded {
+				t.Errorf("NextContext locked scanner, expected: %v, got: %v", context.DeadlineExceeded, err)
+			}
+			lock.Unlock()
+
+			// calls cancelled part way, at each point they check ctx, neither skip nor repeat records
+			seen := make(map[RID]bool)
+			var cancels int
+			for i := 0; ; i++ {
+				rid, _, err := scanner.NextContext(cancelAfter(int64(i%4)), buf)
+				if err == io.EOF {
+					break
+				}
+				if err == context.Canceled {
+					cancels++
+					continue
+				}
+				if err != nil {
+					t.Fatalf("NextContext, err: %s", err)
+				}
+				if seen[rid] {
+					t.Fatalf("NextContext, record %v returned twice", rid)
+				}
+				seen[rid] = true
+			}
+			checkUnlocked(t, lock)
+			if len(seen) != 1000 || cancels == 0 {
+				t.Errorf("scan, expected: 1000 records and some cancelled calls, got: %d and %d", len(seen), cancels)
+			}
+		})
+	}
+}
+
+func TestStoreContext(t *testing.T) {
+
+	memory, _ := NewMemoryStore()
+	file, err := Open(filepath.Join(t.TempDir(), "store"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, store := range map[string]PageStore{"memory": memory, "file": file} {
+		t.Run(name, func(t *testing.T) {
+			appendPages(t, store, 2)
+			if err := store.ReadContext(cancelled, 0, NewHeapPage()); err != context.Canceled {
+				t.Errorf("ReadContext, expected: %v, got: %v", context.Canceled, err)
+			}
+			if err := store.WriteContext(cancelled, 0, NewHeapPage()); err != context.Canceled {
+				t.Errorf("WriteContext, expected: %v, got: %v", context.Canceled, err)
+			}
+			if _, err := store.NewContext(cancelled); err != context.Canceled {
+				t.Errorf("NewContext, expected: %v, got: %v", context.Canceled, err)
+			}
+			if _, err := store.AppendContext(cancelled, NewHeapPage()); err != context.Canceled {
+				t.Errorf("AppendContext, expected: %v, got: %v", context.Canceled, err)
+			}
+
+			// nothing was changed, and the store isn't left locked
+			if store.Count() != 2 {
+				t.Errorf("store.Count, expected: 2, got: %d", store.Count())
+			}
+			checkPages(t, store)
+			appendPages(t, store, 1)
+			checkPages(t, store)
+		})
+	}
+}
+
+func TestCtxMutex(t *testing.T) {
+
+	m := newCtxMutex()
+	m.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.LockContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("LockContext held mutex, expected: %v, got: %v", context.DeadlineExceeded, err)
+	}
+
+	// a waiter that gives up doesn't take the mutex when it is unlocked
+	waiting, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.LockContext(waiting) }()
+	stop()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("LockContext cancelled while waiting, expected: %v, got: %v", context.Canceled, err)
+	}
+	m.Unlock()
+	checkUnlocked(t, m)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.LockContext(cancelled); err != context.Canceled {
+		t.Errorf("LockContext cancelled, expected: %v, got: %v", context.Canceled, err)
+	}
+	checkUnlocked(t, m)
+}
+
+// heapLock returns the lock held by heap operations.
+func heapLock(h Heap) *ctxMutex {
+	return h.(*heap).l
+}
+
+// checkUnlocked fails t if m is held, taking and releasing it to find out.
+func checkUnlocked(t *testing.T, m *ctxMutex) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.LockContext(ctx); err != nil {
+		t.Fatalf("lock left held, err: %s", err)
+	}
+	m.Unlock()
+}
+
+// countdownContext is a context that is cancelled once Err has been called n times, so an
+// operation checking it is cancelled part way through.
+type countdownContext struct {
+	context.Context
+	n atomic.Int64
+}
+
+func cancelAfter(n int64) context.Context {
+	ctx := &countdownContext{Context: context.Background()}
+	ctx.n.Store(n)
+	return ctx
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
@@ -6,8 +6,9 @@
 //
 // Records are stored in a [Heap], which manages a sequence of [HeapPage]
 // instances. Each record is identified by a [RID] (record ID) combining
-// a page ID and slot number. The [HeapScanner] provides sequential
-// iteration over all stored records.
+// a page ID, slot number and slot version; the version tells a deleted
+// record's RID from that of the record that reused its slot. The
+// [HeapScanner] provides sequential iteration over all stored records.
 //
 // Large records that exceed the heap page payload are stored as linked
 // chains of [OverflowPage] instances.
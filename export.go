@@ -0,0 +1,389 @@
+package dbase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ExportFormat is a format records are exported in, and imported from.
+//
+// The text formats hold one record per line. A record that is JSON, on one line, is written as is
+// in jsonl; other UTF-8 text is written as a string; anything else is base64 encoded, so any record
+// round trips:
+//
+//	jsonl:  {"page_id":1,"slot":1,"record":{"id":1}}
+//	        {"page_id":1,"slot":2,"text":"plain text"}
+//	        {"page_id":1,"slot":3,"base64":"AAEC"}
+//	csv:    page_id,slot,record,base64  (a header line, then one line per record, with the record
+//	        in the record column if it is UTF-8 text without carriage returns, else in base64)
+//
+// The binary format starts with an 8 byte magic, a uint16 format version and uint16 flags, then each
+// record as a uint32 length followed by the record, all little endian. If the flags include
+// exportRID, each length is preceded by the record's uint64 page ID and int16 slot.
+//
+// RIDs are for reference only; imported records are given new RIDs.
+type ExportFormat int
+
+// Export formats
+const (
+	ExportJSONL ExportFormat = iota
+	ExportCSV
+	ExportBinary
+)
+
+const (
+	exportMagic     = "dbase\x00ex"
+	exportVersion   = uint16(1)
+	exportHeaderLen = 12
+
+	exportRID = uint16(0x1) // binary export flag, records are preceded by their RID
+)
+
+var exportFormatNames = []string{"jsonl", "csv", "binary"}
+
+func (format ExportFormat) String() string {
+	if format < 0 || int(format) >= len(exportFormatNames) {
+		return fmt.Sprintf("ExportFormat(%d)", int(format))
+	}
+	return exportFormatNames[format]
+}
+
+// ParseExportFormat returns the format named s, one of jsonl, csv or binary.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	for i, name := range exportFormatNames {
+		if s == name {
+			return ExportFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown export format: %q, expected jsonl, csv or binary", s)
+}
+
+// ExportOptions control Export and Import.
+type ExportOptions struct {
+	Format     ExportFormat
+	IncludeRID bool // export each record's RID; ignored by Import, which reads whatever is there
+	// HeapOptions are the options of the heap Import loads into, e.g. to compress records as the
+	// heap exported did; ignored by Export.
+	HeapOptions *HeapOptions
+}
+
+// exportRecord is a record in the jsonl format, with one of Record, Text and Base64 set.
+type exportRecord struct {
+	PageID PageID          `json:"page_id,omitempty"`
+	Slot   int16           `json:"slot,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+	Text   *string         `json:"text,omitempty"`
+	Base64 []byte          `json:"base64,omitempty"`
+}
+
+// recordEncoder writes records to an export.
+type recordEncoder interface {
+	encode(rid RID, record []byte) error
+	flush() error
+}
+
+// recordDecoder reads records from an export, returning io.EOF after the last one.
+type recordDecoder interface {
+	decode() ([]byte, error)
+}
+
+// Export writes every record in heap to w, in the order a HeapScanner returns them, and returns
+// the number of records written. Options nil exports jsonl without RIDs.
+func Export(heap Heap, w io.Writer, options *ExportOptions) (int64, error) {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+	bw := bufio.NewWriter(w)
+	var enc recordEncoder
+	switch options.Format {
+	case ExportJSONL:
+		enc = &jsonlEncoder{bw, options.IncludeRID}
+	case ExportCSV:
+		e := &csvEncoder{csv.NewWriter(bw), bw, options.IncludeRID}
+		header := []string{"record", "base64"}
+		if options.IncludeRID {
+			header = []string{"page_id", "slot", "record", "base64"}
+		}
+		if err := e.w.Write(header); err != nil {
+			return 0, err
+		}
+		enc = e
+	case ExportBinary:
+		var flags uint16
+		if options.IncludeRID {
+			flags |= exportRID
+		}
+		header := make([]byte, exportHeaderLen)
+		copy(header, exportMagic)
+		binary.LittleEndian.PutUint16(header[8:], exportVersion)
+		binary.LittleEndian.PutUint16(header[10:], flags)
+		if _, err := bw.Write(header); err != nil {
+			return 0, err
+		}
+		enc = &binaryEncoder{bw, options.IncludeRID}
+	default:
+		return 0, fmt.Errorf("Unknown export format: %s", options.Format)
+	}
+
+	scanner := NewHeapScanner(heap)
+	buf := make([]byte, PageSize)
+	var count int64
+	for {
+		rid, n, err := scanner.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("Export, record %v: %s", rid, err)
+		}
+		if n > len(buf) {
+			// compressed records can be longer than a page
+			buf = make([]byte, n)
+			if n, err = heap.Get(rid, buf); err != nil {
+				return count, fmt.Errorf("Export, record %v: %s", rid, err)
+			}
+		}
+		if err := enc.encode(rid, buf[0:n]); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, enc.flush()
+}
+
+// Import bulk loads the records exported to r in the given format into the heap in store, see
+// BulkLoadWithOptions, and returns the number of records loaded. Options nil imports jsonl.
+func Import(store PageStore, r io.Reader, options *ExportOptions) (int64, error) {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+	br := bufio.NewReader(r)
+	var dec recordDecoder
+	switch options.Format {
+	case ExportJSONL:
+		dec = &jsonlDecoder{json.NewDecoder(br)}
+	case ExportCSV:
+		d, err := newCSVDecoder(br)
+		if err != nil {
+			return 0, err
+		}
+		dec = d
+	case ExportBinary:
+		header := make([]byte, exportHeaderLen)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return 0, err
+		}
+		if string(header[0:len(exportMagic)]) != exportMagic || binary.LittleEndian.Uint16(header[8:]) > exportVersion {
+			return 0, ErrBadFileFormat
+		}
+		dec = &binaryDecoder{br, binary.LittleEndian.Uint16(header[10:])&exportRID != 0}
+	default:
+		return 0, fmt.Errorf("Unknown export format: %s", options.Format)
+	}
+
+	var line int64
+	return BulkLoadWithOptions(store, options.HeapOptions, func() ([]byte, error) {
+		line++
+		record, err := dec.decode()
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Import, record %d: %s", line, err)
+		}
+		return record, err
+	})
+}
+
+type jsonlEncoder struct {
+	bw  *bufio.Writer
+	rid bool
+}
+
+func (e *jsonlEncoder) encode(rid RID, record []byte) error {
+	line := []byte("{")
+	if e.rid {
+		line = fmt.Appendf(line, `"page_id":%d,"slot":%d,`, rid.PageID, rid.Slot)
+	}
+	switch {
+	case isJSONLine(record):
+		line = append(append(line, `"record":`...), record...)
+	case utf8.Valid(record):
+		text, err := json.Marshal(string(record))
+		if err != nil {
+			return err
+		}
+		line = append(append(line, `"text":`...), text...)
+	default:
+		line = append(line, `"base64":"`...)
+		line = append(base64.StdEncoding.AppendEncode(line, record), '"')
+	}
+	_, err := e.bw.Write(append(line, "}\n"...))
+	return err
+}
+
+func (e *jsonlEncoder) flush() error {
+	return e.bw.Flush()
+}
+
+// isJSONLine returns true if record is a JSON value that reads back byte for byte from a jsonl
+// line: one line, without whitespace around it.
+func isJSONLine(record []byte) bool {
+	if len(record) == 0 || bytes.ContainsAny(record, "\r\n") {
+		return false
+	}
+	if isJSONSpace(record[0]) || isJSONSpace(record[len(record)-1]) {
+		return false
+	}
+	return json.Valid(record)
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+type jsonlDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *jsonlDecoder) decode() ([]byte, error) {
+	var r exportRecord
+	if err := d.dec.Decode(&r); err != nil {
+		return nil, err
+	}
+	switch {
+	case r.Record != nil:
+		return r.Record, nil
+	case r.Text != nil:
+		return []byte(*r.Text), nil
+	case r.Base64 != nil:
+		return r.Base64, nil
+	}
+	return nil, errors.New("no record, text or base64")
+}
+
+type csvEncoder struct {
+	w   *csv.Writer
+	bw  *bufio.Writer
+	rid bool
+}
+
+func (e *csvEncoder) encode(rid RID, record []byte) error {
+	// csv reads carriage returns in quoted fields back as newlines
+	var fields []string
+	if e.rid {
+		fields = []string{strconv.FormatInt(int64(rid.PageID), 10), strconv.Itoa(int(rid.Slot))}
+	}
+	if utf8.Valid(record) && !bytes.ContainsRune(record, '\r') {
+		fields = append(fields, string(record), "")
+	} else {
+		fields = append(fields, "", base64.StdEncoding.EncodeToString(record))
+	}
+	return e.w.Write(fields)
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		return err
+	}
+	return e.bw.Flush()
+}
+
+type csvDecoder struct {
+	r      *csv.Reader
+	column int // index of the record column
+	base64 int // index of the base64 column
+}
+
+func newCSVDecoder(r io.Reader) (*csvDecoder, error) {
+	d := &csvDecoder{r: csv.NewReader(r), column: -1, base64: -1}
+	d.r.ReuseRecord = true
+	header, err := d.r.Read()
+	if err == io.EOF {
+		return nil, errors.New("Import: missing csv header line")
+	} else if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		switch name {
+		case "record":
+			d.column = i
+		case "base64":
+			d.base64 = i
+		}
+	}
+	if d.column < 0 || d.base64 < 0 {
+		return nil, errors.New("Import: csv header has no record or base64 column")
+	}
+	return d, nil
+}
+
+func (d *csvDecoder) decode() ([]byte, error) {
+	fields, err := d.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if fields[d.column] != "" {
+		return []byte(fields[d.column]), nil
+	}
+	return base64.StdEncoding.DecodeString(fields[d.base64])
+}
+
+type binaryEncoder struct {
+	bw  *bufio.Writer
+	rid bool
+}
+
+func (e *binaryEncoder) encode(rid RID, record []byte) error {
+	var prefix [14]byte
+	n := 0
+	if e.rid {
+		binary.LittleEndian.PutUint64(prefix[0:], uint64(rid.PageID))
+		binary.LittleEndian.PutUint16(prefix[8:], uint16(rid.Slot))
+		n = 10
+	}
+	binary.LittleEndian.PutUint32(prefix[n:], uint32(len(record)))
+	if _, err := e.bw.Write(prefix[0 : n+4]); err != nil {
+		return err
+	}
+	_, err := e.bw.Write(record)
+	return err
+}
+
+func (e *binaryEncoder) flush() error {
+	return e.bw.Flush()
+}
+
+type binaryDecoder struct {
+	br  *bufio.Reader
+	rid bool
+}
+
+func (d *binaryDecoder) decode() ([]byte, error) {
+	var prefix [14]byte
+	n := 4
+	if d.rid {
+		n = 14
+	}
+	if _, err := io.ReadFull(d.br, prefix[0:n]); err != nil {
+		return nil, err // io.EOF between records is the end of the export
+	}
+	length := binary.LittleEndian.Uint32(prefix[n-4:])
+	if length > uint32(maxRecordLen) {
+		return nil, RecordExceedsMaxSize{Len: int(length)}
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(d.br, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,140 @@
+package dbase
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestExportImportRecordKinds(t *testing.T) {
+
+	records := [][]byte{
+		[]byte(`{"id": 1, "tags": ["a", "b"]}`),
+		[]byte(`null`),
+		[]byte(`"a JSON string"`),
+		[]byte(` {"padded": true} `),
+		[]byte("{\"multi\":\n1}"),
+		[]byte("plain text, with a <tag> & a \"quote\""),
+		[]byte("text with\r\nline ends"),
+		{0xff, 0x00, 0xfe, 0x01},
+	}
+	for _, format := range []ExportFormat{ExportJSONL, ExportCSV} {
+		src, _ := NewMemoryStore()
+		heap := NewHeap(src)
+		for _, record := range records {
+			if _, err := heap.Put(record); err != nil {
+				t.Fatalf("heap.Put, err: %s", err)
+			}
+		}
+		var buf bytes.Buffer
+		if _, err := Export(heap, &buf, &ExportOptions{Format: format}); err != nil {
+			t.Fatalf("%s: Export, err: %s", format, err)
+		}
+		dst, _ := NewMemoryStore()
+		if _, err := Import(dst, &buf, &ExportOptions{Format: format}); err != nil {
+			t.Fatalf("%s: Import, err: %s", format, err)
+		}
+		scanner := NewHeapScanner(NewHeap(dst))
+		record := make([]byte, PageSize)
+		for _, expected := range records {
+			_, n, err := scanner.Next(record)
+			if err != nil {
+				t.Fatalf("%s: scanner.Next, err: %s", format, err)
+			}
+			if !bytes.Equal(expected, record[0:n]) {
+				t.Errorf("%s: record, expected: %q, got: %q", format, expected, record[0:n])
+			}
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeapWithOptions(store, &HeapOptions{Compress: true})
+	var records [][]byte
+	for i := 0; i < 1000; i++ {
+		record := jsonRecord(i)
+		if i%10 == 0 {
+			// a record that spans lines and quotes in the text formats
+			record = append(record, []byte("\r\n\",\x00")...)
+		}
+		if _, err := heap.Put(record); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records = append(records, record)
+	}
+	heap.Delete(RID{PageID: 1, Slot: 1})
+	records = records[1:]
+
+	for _, format := range []ExportFormat{ExportJSONL, ExportCSV, ExportBinary} {
+		for _, includeRID := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s rid %t", format, includeRID), func(t *testing.T) {
+				var buf bytes.Buffer
+				options := &ExportOptions{Format: format, IncludeRID: includeRID}
+				count, err := Export(heap, &buf, options)
+				if err != nil {
+					t.Fatalf("Export, err: %s", err)
+				}
+				if count != int64(len(records)) {
+					t.Fatalf("Export count, expected: %d, got: %d", len(records), count)
+				}
+
+				dst, _ := NewMemoryStore()
+				if count, err = Import(dst, &buf, &ExportOptions{Format: format}); err != nil {
+					t.Fatalf("Import, err: %s", err)
+				}
+				if count != int64(len(records)) {
+					t.Fatalf("Import count, expected: %d, got: %d", len(records), count)
+				}
+				scanner := NewHeapScanner(NewHeap(dst))
+				record := make([]byte, PageSize)
+				for i, expected := range records {
+					_, n, err := scanner.Next(record)
+					if err != nil {
+						t.Fatalf("scanner.Next %d, err: %s", i, err)
+					}
+					if !bytes.Equal(expected, record[0:n]) {
+						t.Fatalf("record %d, expected: %q, got: %q", i, expected, record[0:n])
+					}
+				}
+				if _, _, err := scanner.Next(record); err != io.EOF {
+					t.Errorf("scanner.Next, expected: EOF, got: %v", err)
+				}
+			})
+		}
+	}
+
+	// JSON records come out as JSON, and records are compressed on import if asked
+	var buf bytes.Buffer
+	if _, err := Export(heap, &buf, nil); err != nil {
+		t.Fatalf("Export, err: %s", err)
+	}
+	if line, _, _ := bytes.Cut(buf.Bytes(), []byte("\n")); !bytes.HasPrefix(line, append([]byte(`{"record":`), records[0]...)) {
+		t.Errorf("Export jsonl, expected: the record as JSON, got: %s", line)
+	}
+	dst, _ := NewMemoryStore()
+	if _, err := Import(dst, &buf, &ExportOptions{HeapOptions: &HeapOptions{Compress: true, CompressionLevel: flate.BestSpeed}}); err != nil {
+		t.Fatalf("Import compressed, err: %s", err)
+	}
+	page := NewHeapPage()
+	if err := dst.Read(1, page); err != nil {
+		t.Fatal(err)
+	}
+	compressed := false
+	for slot := int16(1); slot < page.GetSlotCount(); slot++ {
+		compressed = compressed || page.IsCompressed(slot)
+	}
+	if !compressed {
+		t.Errorf("Import compressed, expected: compressed records, got: uncompressed")
+	}
+
+	if _, err := ParseExportFormat("xml"); err == nil {
+		t.Errorf("ParseExportFormat xml, expected: error, got: nil")
+	}
+	if _, err := Import(store, bytes.NewReader([]byte("dbase\x00ib\x01\x00\x00\x00")), &ExportOptions{Format: ExportBinary}); err != ErrBadFileFormat {
+		t.Errorf("Import bad header, expected: %v, got: %v", ErrBadFileFormat, err)
+	}
+}
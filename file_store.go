@@ -1,21 +1,93 @@
 package dbase
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 // FileStore is a file-backed page store
 type FileStore interface {
 	PageStore
 	Path() string
+	// Backup writes a consistent copy of the store to w while writes carry on.
+	Backup(w io.Writer) error
+	// Snapshot writes a consistent copy of the store to a new file at path.
+	Snapshot(path string) error
+	// BackupIncremental writes the pages changed since LSN since to w, returning the LSN to use for the next one.
+	BackupIncremental(w io.Writer, since LSN) (LSN, error)
+	// LSN returns the last LSN stamped on a page, pages written later will have a greater LSN.
+	LSN() LSN
+	// ArchiveLog moves the store's log segments, up to now, to directory dir.
+	ArchiveLog(dir string) error
+	// Replicate sends a copy of the store, then its changes, to a follower over conn.
+	Replicate(conn net.Conn) error
+	// Compact rewrites a compressed store's file without the space left by pages that have moved.
+	Compact() error
+	BatchPageStore
+	ExtentManager
+	AllocationMapReader
+	RawPageReader
 }
 
 // FileStoreOptions is used to control a filestore
 type FileStoreOptions struct {
 	ReadOnly bool
+	// Compress pages on disk. Only used when creating a file; an existing file keeps the format it was created with.
+	Compress bool
+	// EncryptionKey encrypts pages on disk with AES-GCM; 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+	// A new file is encrypted if a key is given; an encrypted file can only be opened with the key it was created with.
+	EncryptionKey []byte
+	// LogDir, if given, is the directory for the store's write-ahead log of page images, used by
+	// RestoreToPoint. Each page written is logged before it is written to the store.
+	LogDir string
+	// LogSegmentSize is the size at which the log moves on to a new segment file; default 64 MB.
+	LogSegmentSize int64
+	// IOUring submits ReadBatch and WriteBatch through a Linux io_uring, shared by everything using
+	// the store. If io_uring isn't available the batches are made with ReadAt and WriteAt.
+	IOUring bool
+	// DirectIO opens the file with O_DIRECT, so pages bypass the OS page cache, reading and writing
+	// through buffers aligned to the file's direct I/O alignment, which PageSize must be a multiple
+	// of. Only plain files, neither compressed nor encrypted, can use direct I/O. Linux only.
+	DirectIO bool
+	// ExtentSize, if given, grows a new file ExtentSize bytes at a time, preallocating the space,
+	// rather than a page at a time. The file's data end is kept in its header. Only used when
+	// creating a file; a file created with extents keeps growing in extents, of DefaultExtentSize
+	// if ExtentSize isn't given.
+	ExtentSize int64
+	// AllocationMap keeps allocation pages in the file, tracking which pages are in use, so pages
+	// can be given back with Free, reused by New and dropped from the end with Truncate. Only used
+	// when creating a file; a file created with an allocation map always has one.
+	AllocationMap bool
+	// AllocationInterval is the number of pages each allocation page tracks, and so the interval
+	// between allocation pages in a file with an allocation map; at most, and by default, 64,000.
+	// A shorter interval keeps allocation pages nearer the pages they track. Only used when creating
+	// a file.
+	AllocationInterval int
+}
+
+// DefaultExtentSize is the extent size of a preallocated file opened without an ExtentSize.
+const DefaultExtentSize = 1 << 20
+
+// lsnReserve is how far the LSN kept in a file's header runs ahead of the LSNs stamped.
+const lsnReserve = LSN(time.Second)
+
+// ErrReadOnly is returned when writing to a file store opened read only, or to a follower.
+var ErrReadOnly = errors.New("File store is read only")
+
+// PageChecksumFailed is an error type - a page read from the store doesn't match its checksum
+type PageChecksumFailed struct {
+	PageID PageID
+}
+
+func (e PageChecksumFailed) Error() string {
+	return fmt.Sprintf("Page checksum failed, PageID: %d", e.PageID)
 }
 
 // DefaultOptions - read/write
@@ -25,61 +97,96 @@ var DefaultOptions = &FileStoreOptions{
 
 // fileStore is the concrete implementation for FileStore - internal use only
 type fileStore struct {
-	readOnly   bool
-	path       string
-	file       *os.File
-	bufferPool *sync.Pool
-	lastPageID PageID
-	count      int64
-	l          sync.Mutex
-	gets       int
-	sets       int
-	news       int
-	appends    int
-	wipes      int
-}
-
-// Open opens a FileStore. Created fresh if necessary.
+	readOnly    bool
+	path        string
+	file        *os.File
+	bufferPool  *countingPool
+	lastPageID  PageID
+	count       int64
+	l           sync.RWMutex
+	compressor  *compressor    // nil unless the file is compressed
+	sealer      *sealer        // nil unless the file is encrypted
+	frames      []frame        // compressed files only, current frame for each page
+	allocFrames []frame        // compressed files with an allocation map only, frame for each allocation page
+	alloc       *allocationMap // nil unless the file has an allocation map
+	dataOffset  int64          // uncompressed files only, offset of page 0
+	slotLen     int64          // uncompressed files only, physical length of each page
+	end         int64          // end of the data in the file
+	allocated   int64          // physical end of the file, past end if preallocated
+	extentSize  int64          // preallocated files only, bytes the file grows by
+	header      fileHeader     // files with a header only
+	snapshots   []*snapshot    // backups in progress
+	lsn         LSN            // last LSN stamped on a page
+	log         *pageLog       // nil unless the store has a log
+	subscribers []*subscriber  // followers being sent changes
+	counters    storeCounters
+	io          ioEngine // batch reads and writes
+	align       int      // buffer alignment for direct I/O, 0 if not direct
+	closed      bool     // Close has been called
+}
+
+// Open opens a FileStore. Created fresh if necessary, unless opened read only.
 func Open(path string, mode os.FileMode, options *FileStoreOptions) (FileStore, error) {
 
 	store := &fileStore{
 		readOnly: false,
 		path:     path,
-		bufferPool: &sync.Pool{
-			New: func() any {
-				return make([]byte, PageSize, PageSize)
-			},
-		},
 	}
+	store.bufferPool = newCountingPool(func() any {
+		return alignedBuffer(int(PageSize), store.align)
+	})
 
 	if options == nil {
 		options = DefaultOptions
 	}
+	if options.DirectIO && (options.Compress || options.EncryptionKey != nil) {
+		return nil, fmt.Errorf("%w: compressed and encrypted files can't use direct I/O", ErrDirectIO)
+	}
+	if options.AllocationInterval < 0 || options.AllocationInterval > allocationPageSpan {
+		return nil, fmt.Errorf("AllocationInterval %d out of range, 1 to %d", options.AllocationInterval, allocationPageSpan)
+	}
 
-	flag := os.O_RDWR
+	store.io = newIOEngine(options.IOUring)
+
+	flag := os.O_RDWR | os.O_CREATE
 	if options.ReadOnly {
 		flag = os.O_RDONLY
 		store.readOnly = true
 	}
+	if options.DirectIO {
+		flag |= directIOFlag
+	}
 
 	var err error
-	// open the file; create a new file if it doesn't exist
+	// open the file; create a new file if it doesn't exist, unless read only
 
-	if store.file, err = os.OpenFile(store.path, flag|os.O_CREATE, mode); err != nil {
+	if store.file, err = os.OpenFile(store.path, flag, mode); err != nil {
 		store.Close()
 		return nil, err
 	}
+	if options.DirectIO {
+		if err = store.checkDirectIO(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 	var fi os.FileInfo
 	if fi, err = store.file.Stat(); err != nil {
+		store.Close()
 		return nil, err
 	}
-	size := fi.Size()
-	if size != 0 {
-		store.count = int64(size / int64(PageSize))
-		store.lastPageID = PageID(store.count - 1)
-	} else {
-		store.count = 0
-		store.lastPageID = -1
+	if err = store.init(fi.Size(), options); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if options.LogDir != "" && !options.ReadOnly {
+		if store.log, err = openLog(options.LogDir, options.LogSegmentSize); err != nil {
+			store.Close()
+			return nil, err
+		}
+		if store.log.last > store.lsn {
+			store.lsn = store.log.last
+		}
 	}
 
 	// TODO: lock the file - see BoltDB's implementation
@@ -87,6 +194,428 @@ func Open(path string, mode os.FileMode, options *FileStoreOptions) (FileStore,
 	return store, nil
 }
 
+// init reads the file header, if any, and works out the page count. A new file is given a
+// header, even if options don't require a format other than plain, so it can keep its LSN.
+func (store *fileStore) init(size int64, options *FileStoreOptions) error {
+
+	store.end = size
+	store.allocated = size
+	var header fileHeader
+
+	var err error
+	if options.EncryptionKey != nil {
+		if store.sealer, err = newSealer(options.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case size == 0:
+		if options.ExtentSize > 0 {
+			header.flags |= filePreallocated
+		}
+		if options.AllocationMap {
+			header.flags |= fileAllocationMap
+			header.interval = uint32(cmp.Or(options.AllocationInterval, allocationPageSpan))
+		}
+		if options.Compress {
+			header.flags |= fileCompressed
+		}
+		if store.sealer != nil {
+			header.flags |= fileEncrypted
+			if header.keyCheck, err = store.sealer.keyCheck(); err != nil {
+				return err
+			}
+		}
+		header.version = fileVersion(header.flags)
+		store.end = fileHeaderLen
+		store.header = header
+		if err := store.writeHeader(); err != nil {
+			return err
+		}
+		store.allocated = fileHeaderLen
+	case size >= fileHeaderLen:
+		buf := alignedBuffer(int(fileHeaderLen), store.align)
+		if _, err := store.file.ReadAt(buf, 0); err != nil {
+			return err
+		}
+		if !hasFileMagic(buf) {
+			break // plain file, without a header
+		}
+		if err := header.unmarshal(buf); err != nil {
+			return err
+		}
+	}
+
+	if header.flags&(fileCompressed|fileEncrypted) != 0 && store.align != 0 {
+		return fmt.Errorf("%w: compressed and encrypted files can't use direct I/O", ErrDirectIO)
+	}
+	if header.flags&fileEncrypted != 0 {
+		if store.sealer == nil {
+			return ErrEncryptionKey
+		}
+		if err := store.sealer.checkKey(header.keyCheck, header.flags&fileAllocationMap == 0); err != nil {
+			return err
+		}
+	} else if store.sealer != nil {
+		return errors.New("EncryptionKey given for a file store that isn't encrypted")
+	}
+
+	store.slotLen = int64(PageSize)
+	if header.version != 0 {
+		store.dataOffset = fileHeaderLen
+	}
+	if store.sealer != nil {
+		store.slotLen += sealedOverhead
+	}
+
+	if header.flags&fileAllocationMap != 0 {
+		span := int64(header.interval)
+		if span == 0 {
+			span = allocationPageSpan
+		}
+		store.alloc = newAllocationMap(span)
+	}
+	preallocated := header.flags&filePreallocated != 0
+	if preallocated && header.dataEnd > 0 {
+		store.end = min(header.dataEnd, size)
+	}
+	if header.flags&fileCompressed != 0 {
+		if store.compressor, err = newCompressor(pageCompressionLevel); err != nil {
+			return err
+		}
+		var indexed bool
+		if store.frames, store.allocFrames, store.end, indexed = store.readFrameIndex(&header, size); !indexed {
+			// the frames end where the index, if any, starts
+			end := size
+			if header.index >= fileHeaderLen {
+				end = min(end, header.index)
+			}
+			if store.frames, store.allocFrames, store.end, err = readFrames(store.file, end, header.flags); err != nil {
+				return err
+			}
+		}
+		store.count = int64(len(store.frames))
+	} else {
+		if preallocated {
+			if store.end, err = store.findDataEnd(store.end, size); err != nil {
+				return err
+			}
+		}
+		store.count = (store.end - store.dataOffset) / store.slotLen
+		if store.alloc != nil {
+			// less the allocation pages, one before each span pages
+			store.count -= (store.count + store.alloc.span) / (store.alloc.span + 1)
+		}
+	}
+	store.lastPageID = PageID(store.count - 1)
+	store.header = header
+	store.header.dataEnd = store.end
+	if store.alloc != nil {
+		if err := store.readAllocation(); err != nil {
+			return err
+		}
+	}
+	if preallocated {
+		store.extentSize = options.ExtentSize
+		if store.extentSize <= 0 {
+			store.extentSize = DefaultExtentSize
+		}
+	}
+	if !store.readOnly {
+		if err := store.dropFrameIndex(); err != nil {
+			return err
+		}
+	}
+	// LSNs follow the clock, but never go back to one already stamped, even if the clock has been
+	// set back since
+	store.lsn = max(LSN(time.Now().UnixNano()), header.lsn)
+	if header.lsn == 0 && store.count > 0 {
+		// a file from before the header kept the LSN, so its pages are read for it; once the header
+		// has it, later opens needn't
+		store.lsn = max(store.lsn, store.highestLSN())
+		if !store.readOnly {
+			return store.advanceLSN(store.lsn)
+		}
+	}
+	return nil
+}
+
+// highestLSN returns the highest LSN stamped on the store's pages, reading each one. Pages that
+// can't be read or fail their checksum are passed over.
+func (store *fileStore) highestLSN() LSN {
+	var lsn LSN
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	for id := PageID(0); int64(id) < store.count; id++ {
+		if err := store.readPage(id, buf); err != nil || !checkPageChecksum(buf) {
+			continue
+		}
+		lsn = max(lsn, pageLSN(buf))
+	}
+	return lsn
+}
+
+// advanceLSN moves the store's LSN on to lsn, if it is behind. A file with a header keeps an LSN
+// in it at least as high as any stamped, bringing it lsnReserve past lsn, and syncing it, when lsn
+// gets past it, so it is written about once a second while the store is written to. Caller must
+// hold store.l.
+func (store *fileStore) advanceLSN(lsn LSN) error {
+	if store.header.version != 0 && lsn > store.header.lsn {
+		store.header.lsn = lsn + lsnReserve
+		if err := store.writeHeader(); err != nil {
+			return err
+		}
+		if err := store.file.Sync(); err != nil {
+			return err
+		}
+	}
+	store.lsn = max(store.lsn, lsn)
+	return nil
+}
+
+// nextLSN moves the store on to its next LSN, and returns it. Caller must hold store.l.
+func (store *fileStore) nextLSN() (LSN, error) {
+	lsn := max(store.lsn+1, LSN(time.Now().UnixNano()))
+	if err := store.advanceLSN(lsn); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// stamp stamps page image buf with the next LSN, and its checksum. Caller must hold store.l.
+func (store *fileStore) stamp(buf []byte) error {
+	lsn, err := store.nextLSN()
+	if err != nil {
+		return err
+	}
+	setPageLSN(buf, lsn)
+	setPageChecksum(buf)
+	return nil
+}
+
+// LSN returns the last LSN stamped on a page.
+func (store *fileStore) LSN() LSN {
+	store.l.RLock()
+	defer store.l.RUnlock()
+	return store.lsn
+}
+
+// readPage reads the PageSize image of page id into buf.
+func (store *fileStore) readPage(id PageID, buf []byte) error {
+	offset, length := store.pageExtent(id)
+	data := buf
+	if store.compressor != nil || store.sealer != nil {
+		data = make([]byte, length)
+	} else if !store.aligned(buf) {
+		data = store.bufferPool.Get().([]byte)
+		defer store.bufferPool.Put(data)
+	}
+	n, err := store.file.ReadAt(data, offset)
+	store.counters.bytesRead.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	return store.decodeExtent(id, data, buf)
+}
+
+// ReadRaw reads the image of page id into buf as it is in the file, opened and decompressed,
+// without checking its checksum or whether it has been freed. Allocation page k is page -(k+1),
+// see allocationPageID.
+func (store *fileStore) ReadRaw(id PageID, buf []byte) error {
+	if len(buf) != int(PageSize) {
+		return ErrInvalidBuffer
+	}
+
+	store.l.RLock()
+	defer store.l.RUnlock()
+
+	switch {
+	case id > store.lastPageID,
+		id < 0 && (store.alloc == nil || int(-id-1) >= len(store.alloc.pages)),
+		store.compressor != nil && store.frameOf(id) == nil:
+		return errors.New("Invalid page ID")
+	}
+	return store.readPage(id, buf)
+}
+
+// pageExtent returns the offset and length of page id in the file: its slot, or for a compressed
+// file its frame. A negative id is an allocation page, see allocationPageID.
+func (store *fileStore) pageExtent(id PageID) (int64, int) {
+	if store.compressor != nil {
+		f := store.frameOf(id)
+		return f.offset, frameHeaderLen + f.capacity
+	}
+	return store.pageOffset(id), int(store.slotLen)
+}
+
+// decodeExtent copies the page image held in data, page id's extent read from the file, into buf.
+func (store *fileStore) decodeExtent(id PageID, data []byte, buf []byte) error {
+	compressed := false
+	if store.compressor != nil {
+		var err error
+		if data, compressed, err = decodeFrame(id, data); err != nil {
+			return err
+		}
+	}
+	return store.decodePage(id, data, compressed, buf)
+}
+
+// decodePage copies the page image held in on-disk form data into buf, opening and decompressing it as necessary.
+func (store *fileStore) decodePage(id PageID, data []byte, compressed bool, buf []byte) error {
+	if store.sealer != nil {
+		var err error
+		if data, err = store.sealer.open(id, data); err != nil {
+			return err
+		}
+	}
+	return decodePage(data, compressed, buf)
+}
+
+// encodePage returns the on-disk form of page image buf, compressed and sealed as the file requires,
+// and whether it is compressed.
+func (store *fileStore) encodePage(id PageID, buf []byte) ([]byte, bool, error) {
+	data, compressed := buf, false
+	var err error
+	if store.compressor != nil {
+		if data, compressed, err = store.compressor.compress(buf); err != nil {
+			return nil, false, err
+		}
+	}
+	if store.sealer != nil {
+		if data, err = store.sealer.seal(id, data); err != nil {
+			return nil, false, err
+		}
+	}
+	return data, compressed, nil
+}
+
+// pageOffset returns the offset of page id in an uncompressed file. A negative id is an allocation
+// page, see allocationPageID.
+func (store *fileStore) pageOffset(id PageID) int64 {
+	slot := int64(id)
+	if store.alloc != nil {
+		if id < 0 {
+			slot = (-slot - 1) * (store.alloc.span + 1)
+		} else {
+			slot += slot/store.alloc.span + 1
+		}
+	}
+	return store.dataOffset + slot*store.slotLen
+}
+
+// frameOf returns the current frame of page id in a compressed file, or nil if it has none yet. A
+// negative id is an allocation page, see allocationPageID.
+func (store *fileStore) frameOf(id PageID) *frame {
+	frames := store.frames
+	if id < 0 {
+		frames, id = store.allocFrames, -id-1
+	}
+	if int(id) >= len(frames) {
+		return nil
+	}
+	return &frames[id]
+}
+
+// writePage writes the PageSize image buf as page id, which is either an existing page
+// or the page following the last page. Caller must hold store.l.
+func (store *fileStore) writePage(id PageID, buf []byte) error {
+	if err := store.preserve(id); err != nil {
+		return err
+	}
+	data, compressed, err := store.encodePage(id, buf)
+	if err != nil {
+		return err
+	}
+	return store.writeData(id, data, compressed)
+}
+
+// write stamps page image buf with the next LSN, logs it if the store has a log, syncing the log
+// before the page is written, writes it as page id, see writePage, and sends it to any followers.
+// Caller must hold store.l.
+func (store *fileStore) write(id PageID, buf []byte) error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	prev := store.lsn
+	if err := store.stamp(buf); err != nil {
+		return err
+	}
+	if store.log == nil && len(store.subscribers) == 0 {
+		return store.writePage(id, buf)
+	}
+	if err := store.preserve(id); err != nil {
+		return err
+	}
+	data, compressed, err := store.encodePage(id, buf)
+	if err != nil {
+		return err
+	}
+	rec := logRecord{lsn: store.lsn, prev: prev, id: id, data: data, compressed: compressed}
+	if store.log != nil {
+		if err := store.log.append(rec); err != nil {
+			return err
+		}
+		if err := store.log.sync(); err != nil {
+			return err
+		}
+	}
+	if err := store.writeData(id, data, compressed); err != nil {
+		return err
+	}
+	store.publish(rec)
+	return nil
+}
+
+// writeData writes data, page id in on-disk form, see writePage. Caller must hold store.l.
+func (store *fileStore) writeData(id PageID, data []byte, compressed bool) error {
+	if store.compressor == nil {
+		end := store.pageOffset(id) + store.slotLen
+		if err := store.reserve(end); err != nil {
+			return err
+		}
+		if !store.aligned(data) {
+			buf := store.bufferPool.Get().([]byte)
+			defer store.bufferPool.Put(buf)
+			data = buf[0:copy(buf, data)]
+		}
+		n, err := store.file.WriteAt(data, store.pageOffset(id))
+		store.counters.bytesWritten.Add(uint64(n))
+		if err == nil && end > store.end {
+			store.end = end
+		}
+		return err
+	}
+
+	current := store.frameOf(id)
+	if current != nil && len(data) <= current.capacity {
+		// still fits, rewrite in place
+		f := *current
+		n, err := store.file.WriteAt(encodeFrame(id, data, compressed, f.capacity), f.offset)
+		store.counters.bytesWritten.Add(uint64(n))
+		return err
+	}
+	f := frame{offset: store.end, capacity: frameCapacity(len(data))}
+	if err := store.reserve(f.offset + frameHeaderLen + int64(f.capacity)); err != nil {
+		return err
+	}
+	n, err := store.file.WriteAt(encodeFrame(id, data, compressed, f.capacity), f.offset)
+	store.counters.bytesWritten.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	store.end += frameHeaderLen + int64(f.capacity)
+	switch {
+	case current != nil:
+		*current = f
+	case id < 0:
+		store.allocFrames = append(store.allocFrames, f)
+	default:
+		store.frames = append(store.frames, f)
+	}
+	return nil
+}
+
 // Path returns the filestore path.
 func (store *fileStore) Path() string {
 	return store.path
@@ -94,49 +623,97 @@ func (store *fileStore) Path() string {
 
 // Close closes the filestore.
 func (store *fileStore) Close() error {
+	if store.io != nil {
+		store.io.close()
+	}
+	store.l.Lock()
+	var err error
+	if store.alloc != nil && !store.readOnly && !store.closed {
+		// bring the allocation pages, and the header, up to date
+		err = store.flushAllocation()
+	} else if store.extentSize > 0 && !store.readOnly && !store.closed {
+		// bring the header's data end up to date
+		err = store.writeHeader()
+	}
+	if err == nil && store.compressor != nil && !store.readOnly && !store.closed {
+		// so Open needn't walk the frames
+		err = store.writeFrameIndex()
+	}
+	store.closed = true
+	store.l.Unlock()
+	if err != nil {
+		store.file.Close()
+		return err
+	}
+	if store.log != nil {
+		if err := store.log.close(); err != nil {
+			store.file.Close()
+			return err
+		}
+	}
 	return store.file.Close()
 }
 
 // Read returns the page with ID=id. Caller's responsibility to create page.
 func (store *fileStore) Read(id PageID, page Page) error {
-	if id > store.lastPageID {
+	defer store.counters.readLatency.since(time.Now())
+
+	store.l.RLock()
+	defer store.l.RUnlock()
+
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
 	}
+	if store.isFree(id) {
+		return ErrPageFree
+	}
 
 	buf := store.bufferPool.Get().([]byte)
 	defer store.bufferPool.Put(buf)
 
-	store.gets++
-	if n, err := store.file.ReadAt(buf, int64(id)*int64(PageSize)); err != nil || n != int(PageSize) {
+	store.counters.reads.Add(1)
+	if err := store.readPage(id, buf); err != nil {
 		return err
 	}
+	if !checkPageChecksum(buf) {
+		return PageChecksumFailed{id}
+	}
 	return page.UnmarshalBinary(buf)
 
 }
 
 // Write updates the page with id=ID.
 func (store *fileStore) Write(id PageID, page Page) error {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
 
 	// NB: file.WriteAt will just write at the end of the file if offset is past the end of the file
 	// so check total pages to stop this happening
-	if id > store.lastPageID {
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
-	} else if buf, err := page.MarshalBinary(); err != nil {
+	}
+	if store.isFree(id) {
+		return ErrPageFree
+	}
+	buf, err := page.MarshalBinary()
+	if err != nil {
 		return err
-	} else if _, err := store.file.WriteAt(buf, int64(id)*int64(PageSize)); err != nil {
+	}
+	if err := store.write(id, buf); err != nil {
 		return err
 	}
-	store.sets++
+	store.counters.writes.Add(1)
 	// TODO: filestore.Set - implement algorithm to do a file.Sync at set intervals
 	return nil //store.file.Sync()
 }
 
-// New creates an empty page at the end of the database file.
-// Returns the page ID of the new page. Page count & Last page ID will be increased by 1.
+// New creates an empty page, reusing the lowest free page if the file has an allocation map and
+// there is one, otherwise at the end of the database file. Returns the page ID of the new page.
+// Page count & Last page ID will be increased by 1 if the page is added at the end.
 func (store *fileStore) New() (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
@@ -146,18 +723,31 @@ func (store *fileStore) New() (PageID, error) {
 	for i := range buf {
 		buf[i] = 0
 	}
-	if _, err := store.file.Write(buf); err != nil {
+	if id, ok, err := store.reuse(); err != nil {
+		return 0, err
+	} else if ok {
+		if err := store.write(id, buf); err != nil {
+			return 0, err
+		}
+		store.counters.news.Add(1)
+		return id, nil
+	}
+	if err := store.allocateNext(); err != nil {
+		return 0, err
+	}
+	if err := store.write(store.lastPageID+1, buf); err != nil {
 		return 0, err
 	}
 	store.lastPageID++
 	store.count++
-	store.news++
+	store.counters.news.Add(1)
 	return PageID(store.lastPageID), nil
 }
 
 // Append appends the given page at the end of the database file.
 // Returns the page ID of the new page. Page count & Last page ID will be increased by 1.
 func (store *fileStore) Append(page Page) (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
@@ -166,35 +756,73 @@ func (store *fileStore) Append(page Page) (PageID, error) {
 	if err != nil {
 		return 0, err
 	}
-	if _, err = store.file.Write(buf); err != nil {
+	if err = store.allocateNext(); err != nil {
+		return 0, err
+	}
+	if err = store.write(store.lastPageID+1, buf); err != nil {
 		return 0, err
 	}
 	store.lastPageID++
 	store.count++
 	//store.file.Sync()
-	store.appends++
+	store.counters.appends.Add(1)
 	return PageID(store.lastPageID), nil
 }
 
+// ReadContext is Read, returning ctx.Err() if ctx is done.
+func (store *fileStore) ReadContext(ctx context.Context, id PageID, page Page) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Read(id, page)
+}
+
+// WriteContext is Write, returning ctx.Err() if ctx is done.
+func (store *fileStore) WriteContext(ctx context.Context, id PageID, page Page) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Write(id, page)
+}
+
+// NewContext is New, returning ctx.Err() if ctx is done.
+func (store *fileStore) NewContext(ctx context.Context) (PageID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return store.New()
+}
+
+// AppendContext is Append, returning ctx.Err() if ctx is done.
+func (store *fileStore) AppendContext(ctx context.Context, page Page) (PageID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return store.Append(page)
+}
+
 // Wipe zeros out the specified page. It does not reduce page count. Use with care!
 func (store *fileStore) Wipe(id PageID) error {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
 
-	if id > store.lastPageID {
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
 	}
+	if store.isFree(id) {
+		return ErrPageFree
+	}
 	buf := store.bufferPool.Get().([]byte)
 	defer store.bufferPool.Put(buf)
 	for i := range buf {
 		buf[i] = 0
 	}
-
-	if _, err := store.file.WriteAt(buf, int64(id)*int64(PageSize)); err != nil {
+	if err := store.write(id, buf); err != nil {
 		return err
 	}
-	store.wipes++
+	store.counters.wipes.Add(1)
 	return nil //store.file.Sync()
 }
 
@@ -203,7 +831,20 @@ func (store *fileStore) Count() int64 {
 	return store.count
 }
 
-// Statistics returns a string with get/set/new/append counts.
+// Stats returns the store's activity counts.
+func (store *fileStore) Stats() StoreStats {
+	stats := store.counters.stats()
+	store.l.RLock()
+	stats.Pages = store.count
+	stats.Size = store.end
+	store.l.RUnlock()
+	stats.BufferPool = store.bufferPool.stats()
+	return stats
+}
+
+// Statistics returns a string with the store's activity counts.
+//
+// Deprecated: use Stats.
 func (store *fileStore) Statistics() string {
-	return fmt.Sprintf("file store: gets: %d, sets: %d, news: %d, appends: %d", store.gets, store.sets, store.news, store.appends)
+	return fmt.Sprintf("file store: %s", store.Stats())
 }
@@ -0,0 +1,350 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrNoAllocationMap is returned by Free, Allocate and Deallocate for a file store created without
+// an allocation map.
+var ErrNoAllocationMap = errors.New("File store has no allocation map")
+
+// allocationPageID returns the ID used for allocation page k in the file, see fileAllocationMap:
+// -(k+1), out of the range of the store's pages.
+func allocationPageID(k int) PageID {
+	return PageID(-k - 1)
+}
+
+// isFree returns true if page id, an existing page, has been freed. Caller must hold store.l.
+func (store *fileStore) isFree(id PageID) bool {
+	return store.alloc != nil && !store.alloc.isAllocated(id)
+}
+
+// readAllocation reads the allocation pages when the store is opened. Pages from the header's
+// mapped count on, added since the allocation pages were last written, are allocated.
+func (store *fileStore) readAllocation() error {
+	span := store.alloc.span
+	pages := len(store.allocFrames)
+	if store.compressor == nil {
+		slots := (store.end - store.dataOffset) / store.slotLen
+		pages = int((slots + span) / (span + 1))
+	}
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	for k := 0; k < pages; k++ {
+		id := allocationPageID(k)
+		if err := store.readPage(id, buf); err != nil {
+			return err
+		}
+		if !checkPageChecksum(buf) {
+			return PageChecksumFailed{id}
+		}
+		page := NewAllocationPage()
+		if err := page.UnmarshalBinary(buf); err != nil {
+			return err
+		}
+		store.alloc.set(k, page)
+	}
+	store.alloc.cover(int((store.count + span - 1) / span))
+	mapped := min(store.header.mapped, store.count)
+	if err := store.alloc.allocate(PageID(mapped), store.count-mapped, 0); err != nil {
+		return err
+	}
+	store.alloc.count(store.count)
+	return nil
+}
+
+// writeAllocation writes allocation page k, logging it and sending it to any followers as any
+// page written is. Caller must hold store.l.
+func (store *fileStore) writeAllocation(k int) error {
+	data, err := store.alloc.pages[k].MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	copy(buf, data)
+	if err := store.write(allocationPageID(k), buf); err != nil {
+		return err
+	}
+	store.alloc.dirty[k] = false
+	return nil
+}
+
+// AllocationSpan returns the number of pages each allocation page tracks, and the number of
+// allocation pages; 0 pages if the file was created without an allocation map.
+func (store *fileStore) AllocationSpan() (int64, int) {
+	store.l.RLock()
+	defer store.l.RUnlock()
+
+	if store.alloc == nil {
+		return 0, 0
+	}
+	return store.alloc.span, len(store.alloc.pages)
+}
+
+// ReadAllocationPage reads allocation page k into page, as it is in memory; the allocation page in
+// the file can be behind it, see flushAllocation. Returns ErrNoAllocationMap if the file was
+// created without an allocation map.
+func (store *fileStore) ReadAllocationPage(k int, page AllocationPage) error {
+	store.l.RLock()
+	defer store.l.RUnlock()
+
+	if store.alloc == nil {
+		return ErrNoAllocationMap
+	}
+	if k < 0 || k >= len(store.alloc.pages) {
+		return errors.New("Invalid allocation page")
+	}
+	data, err := store.alloc.pages[k].MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return page.UnmarshalBinary(data)
+}
+
+// allocationImages returns a copy of each allocation page tracking the first count pages, as it
+// is in memory, stamped with lsn, for a backup. Pages the allocation pages in the file are behind
+// on are up to date in the copies. Caller must hold store.l.
+func (store *fileStore) allocationImages(count int64, lsn LSN) ([][]byte, error) {
+	var images [][]byte
+	for k := 0; int64(k)*store.alloc.span < count; k++ {
+		data, err := store.alloc.pages[k].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf := append([]byte(nil), data...)
+		setPageLSN(buf, lsn)
+		setPageChecksum(buf)
+		images = append(images, buf)
+	}
+	return images, nil
+}
+
+// flushAllocation writes the allocation pages changed since they were last written, then the file
+// header, with the page count they are now up to date for. Caller must hold store.l.
+func (store *fileStore) flushAllocation() error {
+	for k, dirty := range store.alloc.dirty {
+		if dirty {
+			if err := store.writeAllocation(k); err != nil {
+				return err
+			}
+		}
+	}
+	store.header.mapped = store.count
+	return store.writeHeader()
+}
+
+// reuse allocates the lowest free page, if the file has an allocation map and there is one, and
+// writes the allocation pages. Caller must hold store.l.
+func (store *fileStore) reuse() (PageID, bool, error) {
+	if store.alloc == nil || store.readOnly {
+		return 0, false, nil
+	}
+	id := store.alloc.findRun(store.count, 1)
+	if int64(id) >= store.count {
+		return 0, false, nil
+	}
+	if err := store.alloc.allocate(id, 1, store.count); err != nil {
+		return 0, false, err
+	}
+	if err := store.flushAllocation(); err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// allocateNext marks the page following the last page allocated, if the file has an allocation
+// map. The allocation page tracking it is written before the first page it tracks, so it comes
+// first in the file; after that it is written when pages are freed or reused, or on Close. Caller
+// must hold store.l.
+func (store *fileStore) allocateNext() error {
+	if store.alloc == nil {
+		return nil
+	}
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	id := store.lastPageID + 1
+	if err := store.alloc.allocate(id, 1, store.count); err != nil {
+		return err
+	}
+	if int64(id)%store.alloc.span == 0 {
+		return store.writeAllocation(int(int64(id) / store.alloc.span))
+	}
+	return nil
+}
+
+// Free zeros out the specified page and marks it free in the file's allocation map, for New to
+// reuse. The page is zeroed as any write is, so it is logged, backed up and sent to followers as
+// an empty page. Returns ErrNoAllocationMap if the file was created without an allocation map.
+func (store *fileStore) Free(id PageID) error {
+	return store.Deallocate(id, 1)
+}
+
+// Deallocate zeros out the runlength pages from id and marks them free, as Free does.
+func (store *fileStore) Deallocate(id PageID, runlength int) error {
+	defer store.counters.writeLatency.since(time.Now())
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if store.alloc == nil {
+		return ErrNoAllocationMap
+	}
+	if err := store.alloc.checkRun(id, runlength, store.count); err != nil {
+		return err
+	}
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	for p := id; p < id+PageID(runlength); p++ {
+		clear(buf)
+		if err := store.write(p, buf); err != nil {
+			return err
+		}
+	}
+	if err := store.alloc.deallocate(id, int64(runlength), store.count); err != nil {
+		return err
+	}
+	if err := store.flushAllocation(); err != nil {
+		return err
+	}
+	store.counters.frees.Add(uint64(runlength))
+	return nil
+}
+
+// Allocate allocates runlength contiguous empty pages, reusing free pages, which are already empty,
+// and adding pages at the end of the file as needed. Returns the ID of the first page, or
+// ErrNoAllocationMap if the file was created without an allocation map.
+func (store *fileStore) Allocate(runlength int) (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if store.alloc == nil {
+		return 0, ErrNoAllocationMap
+	}
+	if store.readOnly {
+		return 0, ErrReadOnly
+	}
+	if runlength < 1 {
+		return 0, errors.New("Invalid run length")
+	}
+	id := store.alloc.findRun(store.count, int64(runlength))
+	end := int64(id) + int64(runlength)
+	if reused := min(end, store.count) - int64(id); reused > 0 {
+		if err := store.alloc.allocate(id, reused, store.count); err != nil {
+			return 0, err
+		}
+		if err := store.flushAllocation(); err != nil {
+			return 0, err
+		}
+	}
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	for store.count < end {
+		if err := store.allocateNext(); err != nil {
+			return 0, err
+		}
+		clear(buf)
+		if err := store.write(store.lastPageID+1, buf); err != nil {
+			return 0, err
+		}
+		store.lastPageID++
+		store.count++
+	}
+	store.counters.news.Add(uint64(runlength))
+	return id, nil
+}
+
+// Truncate drops the free pages at the end of the store and shrinks the file to match. Backups in
+// progress keep the pages dropped. The truncation is logged, and sent to followers, which drop the
+// pages too. A file without an allocation map has no free pages, so is left as it is.
+func (store *fileStore) Truncate() error {
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if store.alloc == nil {
+		return nil
+	}
+	count := store.alloc.trailing(store.count)
+	if count == store.count {
+		return nil
+	}
+	prev := store.lsn
+	lsn, err := store.nextLSN()
+	if err != nil {
+		return err
+	}
+	rec := logRecord{lsn: lsn, prev: prev, id: PageID(count), truncated: true}
+	if store.log != nil {
+		if err := store.log.append(rec); err != nil {
+			return err
+		}
+		if err := store.log.sync(); err != nil {
+			return err
+		}
+	}
+	if err := store.truncate(count); err != nil {
+		return err
+	}
+	store.publish(rec)
+	return store.flushAllocation()
+}
+
+// truncate drops the pages from count on, and shrinks the file to match, leaving the allocation
+// pages to be written. Caller must hold store.l.
+func (store *fileStore) truncate(count int64) error {
+	for id := PageID(count); int64(id) < store.count; id++ {
+		if err := store.preserve(id); err != nil {
+			return err
+		}
+	}
+
+	end := store.pageOffset(PageID(count))
+	if store.compressor != nil {
+		end = fileHeaderLen
+		for _, f := range slices.Concat(store.frames[0:count], store.allocFrames) {
+			end = max(end, f.offset+frameHeaderLen+int64(f.capacity))
+		}
+		if err := store.dropFrames(count, end); err != nil {
+			return err
+		}
+		store.frames = store.frames[0:count]
+	}
+	if err := store.file.Truncate(end); err != nil {
+		return err
+	}
+	store.alloc.drop(count, store.count)
+	store.end, store.allocated = end, end
+	store.count = count
+	store.lastPageID = PageID(count - 1)
+	return nil
+}
+
+// dropFrames flags the frames of pages count on, current or abandoned, before end frameDropped, so
+// they aren't taken for pages when the file is opened. Caller must hold store.l.
+func (store *fileStore) dropFrames(count int64, end int64) error {
+	header := make([]byte, frameHeaderLen)
+	for offset := fileHeaderLen; offset < end; {
+		if _, err := store.file.ReadAt(header, offset); err != nil {
+			return err
+		}
+		id := PageID(binary.LittleEndian.Uint64(header))
+		flags := binary.LittleEndian.Uint16(header[frameFlagsOffset:])
+		if int64(id) >= count && flags&frameDropped == 0 {
+			binary.LittleEndian.PutUint16(header[frameFlagsOffset:], flags|frameDropped)
+			if _, err := store.file.WriteAt(header[frameFlagsOffset:frameHeaderLen], offset+frameFlagsOffset); err != nil {
+				return err
+			}
+		}
+		offset += frameHeaderLen + int64(binary.LittleEndian.Uint32(header[frameCapacityOffset:]))
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestFreeAndTruncate(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	for _, options := range []FileStoreOptions{
+		{AllocationMap: true},
+		{AllocationMap: true, Compress: true},
+		{AllocationMap: true, EncryptionKey: key},
+		{AllocationMap: true, Compress: true, EncryptionKey: key},
+		{AllocationMap: true, ExtentSize: 1 << 20},
+		{AllocationMap: true, ExtentSize: 1 << 20, Compress: true},
+		{AllocationMap: true, DirectIO: true},
+	} {
+		name := fmt.Sprintf("compress %t, encrypt %t, extents %t, direct %t", options.Compress, options.EncryptionKey != nil, options.ExtentSize > 0, options.DirectIO)
+		t.Run(name, func(t *testing.T) {
+			testFreeAndTruncate(t, &options)
+		})
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		store, _ := NewMemoryStore()
+		testFree(t, store)
+	})
+
+	t.Run("no allocation map", func(t *testing.T) {
+		path := tempfile()
+		store, err := Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			store.Close()
+			os.Remove(path)
+		}()
+		if _, err := store.New(); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Free(0); err != ErrNoAllocationMap {
+			t.Errorf("Free, expected: %s, got: %v", ErrNoAllocationMap, err)
+		}
+		if err := store.Truncate(); err != nil || store.Count() != 1 {
+			t.Errorf("Truncate, expected: 1 page, got: %d pages, err: %v", store.Count(), err)
+		}
+	})
+}
+
+// appendPages appends n heap pages to store, each holding a record naming its page.
+func appendPages(t *testing.T, store PageStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		page := NewHeapPage()
+		if _, err := page.AddRecord([]byte(fmt.Sprintf("page %d", store.Count()))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Append(page); err != nil {
+			t.Fatalf("Append, err: %s", err)
+		}
+	}
+}
+
+// checkPages checks that the pages of store hold the records written by appendPages, except the
+// pages in free, which must be free.
+func checkPages(t *testing.T, store PageStore, free ...PageID) {
+	t.Helper()
+	page := NewHeapPage()
+	buf := make([]byte, PageSize)
+	for id := PageID(0); int64(id) < store.Count(); id++ {
+		err := store.Read(id, page)
+		if slices.Contains(free, id) {
+			if err != ErrPageFree {
+				t.Fatalf("Read free page %d, expected: %s, got: %v", id, ErrPageFree, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read page %d, err: %s", id, err)
+		}
+		n, err := page.GetRecord(1, buf)
+		if err != nil {
+			t.Fatalf("page %d GetRecord, err: %s", id, err)
+		}
+		if want := fmt.Sprintf("page %d", id); string(buf[0:n]) != want {
+			t.Fatalf("page %d, expected: %s, got: %s", id, want, buf[0:n])
+		}
+	}
+}
+
+// testFree frees, reuses and truncates pages of an empty store, leaving it with 17 pages, of
+// which page 5 is free.
+func testFree(t *testing.T, store PageStore) {
+	appendPages(t, store, 20)
+	for _, id := range []PageID{7, 3, 17, 18, 19} {
+		if err := store.Free(id); err != nil {
+			t.Fatalf("Free %d, err: %s", id, err)
+		}
+	}
+	checkPages(t, store, 3, 7, 17, 18, 19)
+	if err := store.Free(3); err != ErrPageFree {
+		t.Errorf("Free twice, expected: %s, got: %v", ErrPageFree, err)
+	}
+	if err := store.Write(3, NewHeapPage()); err != ErrPageFree {
+		t.Errorf("Write free page, expected: %s, got: %v", ErrPageFree, err)
+	}
+	if stats := store.Stats(); stats.Frees != 5 {
+		t.Errorf("stats frees, expected: 5, got: %d", stats.Frees)
+	}
+
+	// the lowest free pages are reused first, and come back empty
+	for _, want := range []PageID{3, 7} {
+		id, err := store.New()
+		if err != nil || id != want {
+			t.Fatalf("New, expected: page %d, got: page %d, err: %v", want, id, err)
+		}
+		page := newRawPage()
+		if err := store.Read(id, page); err != nil || page.GetType() != 0 {
+			t.Fatalf("reused page %d, expected: empty, got: %v, err: %v", id, page.GetType(), err)
+		}
+		record := NewHeapPage()
+		record.AddRecord([]byte(fmt.Sprintf("page %d", id)))
+		if err := store.Write(id, record); err != nil {
+			t.Fatalf("Write, err: %s", err)
+		}
+	}
+	if store.Count() != 20 {
+		t.Errorf("count after reuse, expected: 20, got: %d", store.Count())
+	}
+
+	size := store.Stats().Size
+	if err := store.Free(5); err != nil {
+		t.Fatalf("Free, err: %s", err)
+	}
+	if err := store.Truncate(); err != nil {
+		t.Fatalf("Truncate, err: %s", err)
+	}
+	if store.Count() != 17 || store.Stats().Size >= size {
+		t.Errorf("truncated, expected: 17 pages, smaller than %d bytes, got: %d pages, %d bytes", size, store.Count(), store.Stats().Size)
+	}
+	if err := store.Read(17, NewHeapPage()); err == nil {
+		t.Errorf("Read truncated page, expected error")
+	}
+	checkPages(t, store, 5)
+}
+
+func testFreeAndTruncate(t *testing.T, options *FileStoreOptions) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, options)
+	if err != nil && options.DirectIO {
+		t.Skip("direct I/O not available:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	testFree(t, store)
+	fs := store.(*fileStore)
+	if options.ExtentSize == 0 {
+		if fi, err := os.Stat(path); err != nil || fi.Size() != fs.end {
+			t.Errorf("truncated file size, expected: %d, got: %v, err: %v", fs.end, fi.Size(), err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func() {
+		t.Helper()
+		if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey, DirectIO: options.DirectIO}); err != nil {
+			t.Fatalf("Open, err: %s", err)
+		}
+		fs = store.(*fileStore)
+		if fs.header.version != 3 {
+			t.Errorf("format version, expected: 3, got: %d", fs.header.version)
+		}
+	}
+
+	// free pages, and the truncated count, are kept
+	reopen()
+	if store.Count() != 17 {
+		t.Fatalf("reopened, expected: 17 pages, got: %d", store.Count())
+	}
+	checkPages(t, store, 5)
+	if id, err := store.New(); err != nil || id != 5 {
+		t.Fatalf("New, expected: page 5, got: page %d, err: %v", id, err)
+	}
+	if err := store.Free(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages added after the allocation pages were last written, then lost in a crash, are allocated
+	appendPages(t, store, 10)
+	fs.file.Close()
+	reopen()
+	if store.Count() != 27 {
+		t.Fatalf("reopened after crash, expected: 27 pages, got: %d", store.Count())
+	}
+	checkPages(t, store, 5)
+
+	// pages freed, truncated and appended again are found again, and only they are
+	for id := PageID(10); id < 27; id++ {
+		if err := store.Free(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	appendPages(t, store, 2)
+	store.Close()
+	reopen()
+	defer store.Close()
+	if store.Count() != 12 {
+		t.Fatalf("reopened after truncate, expected: 12 pages, got: %d", store.Count())
+	}
+	checkPages(t, store, 5)
+
+	// a backup keeps the allocation map, with the free pages free
+	copyPath := tempfile()
+	defer os.Remove(copyPath)
+	if err := store.Snapshot(copyPath); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := Open(copyPath, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	checkPages(t, snapshot, 5)
+	if err := snapshot.Free(5); err != ErrPageFree {
+		t.Errorf("snapshot Free, expected: %s, got: %v", ErrPageFree, err)
+	}
+}
+
+func TestFreeScan(t *testing.T) {
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+	var rids []RID
+	for i := 0; i < 3000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	// the records on a freed page are gone, scans skip it
+	freed := rids[len(rids)/2].PageID
+	if err := store.Free(freed); err != nil {
+		t.Fatal(err)
+	}
+	var want []RID
+	for _, rid := range rids {
+		if rid.PageID != freed {
+			want = append(want, rid)
+		}
+	}
+	for _, readAhead := range []int{0, 4} {
+		scanner := NewHeapScannerWithOptions(heap, &HeapScannerOptions{ReadAhead: readAhead})
+		got, _ := scanAll(t, scanner)
+		scanner.Close()
+		if len(got) != len(want) {
+			t.Fatalf("read-ahead %d scan count, expected: %d, got: %d", readAhead, len(want), len(got))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("read-ahead %d record %d, expected: %v, got: %v", readAhead, i, want[i], got[i])
+			}
+		}
+	}
+	// Check finds the records missing from the heap's count, but takes the free page as empty
+	for _, problem := range Check(store).Problems {
+		if problem.PageID == freed {
+			t.Errorf("Check free page, expected no problems, got: %s", problem)
+		}
+	}
+}
+
+func TestFreeBeyondAllocationPage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	// compressed, so the empty pages take little space
+	path := tempfile()
+	store, err := Open(path, 0666, &FileStoreOptions{AllocationMap: true, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	for i := 0; i < allocationPageSpan+10; i++ {
+		if _, err := store.New(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := PageID(allocationPageSpan + 5)
+	for _, id := range []PageID{last, 2} {
+		if err := store.Free(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs := store.(*fileStore); len(fs.allocFrames) != 2 {
+		t.Errorf("allocation pages, expected: 2, got: %d", len(fs.allocFrames))
+	}
+	store.Close()
+
+	if store, err = Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Count() != allocationPageSpan+10 {
+		t.Fatalf("reopened, expected: %d pages, got: %d", allocationPageSpan+10, store.Count())
+	}
+	for _, want := range []PageID{2, last, allocationPageSpan + 10} {
+		if id, err := store.New(); err != nil || id != want {
+			t.Errorf("New, expected: page %d, got: page %d, err: %v", want, id, err)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	const interval = 100
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	for _, options := range []FileStoreOptions{
+		{AllocationMap: true, AllocationInterval: interval},
+		{AllocationMap: true, AllocationInterval: interval, Compress: true},
+		{AllocationMap: true, AllocationInterval: interval, EncryptionKey: key, ExtentSize: 1 << 20},
+	} {
+		name := fmt.Sprintf("compress %t, encrypt %t", options.Compress, options.EncryptionKey != nil)
+		t.Run(name, func(t *testing.T) {
+			path := tempfile()
+			store, err := Open(path, 0666, &options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(path)
+			testAllocate(t, store)
+			store.Close()
+
+			if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey}); err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			fs := store.(*fileStore)
+			if store.Count() != 270 || fs.alloc.span != interval || len(fs.alloc.pages) != 3 {
+				t.Fatalf("reopened, expected: 270 pages, 3 allocation pages of %d, got: %d pages, %d allocation pages of %d", interval, store.Count(), len(fs.alloc.pages), fs.alloc.span)
+			}
+			// an allocation page before every interval pages
+			if fs.compressor == nil {
+				for k := 0; k < 3; k++ {
+					if offset, want := fs.pageOffset(allocationPageID(k)), fs.dataOffset+int64(k*(interval+1))*fs.slotLen; offset != want {
+						t.Errorf("allocation page %d offset, expected: %d, got: %d", k, want, offset)
+					}
+				}
+				if end := fs.pageOffset(PageID(store.Count()-1)) + fs.slotLen; fs.end != end {
+					t.Errorf("data end, expected: %d, got: %d", end, fs.end)
+				}
+			}
+			if id, err := store.Allocate(1); err != nil || id != 150 {
+				t.Errorf("Allocate after reopen, expected: page 150, got: page %d, err: %v", id, err)
+			}
+		})
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		store, _ := NewMemoryStore()
+		// a memory store's allocation pages always track the full span; shorten it, as for the files
+		store.(*memoryStore).alloc = newAllocationMap(interval)
+		testAllocate(t, store)
+	})
+
+	t.Run("bad interval", func(t *testing.T) {
+		path := tempfile()
+		defer os.Remove(path)
+		if _, err := Open(path, 0666, &FileStoreOptions{AllocationMap: true, AllocationInterval: allocationPageSpan + 1}); err == nil {
+			t.Errorf("Open, expected error for AllocationInterval %d", allocationPageSpan+1)
+		}
+	})
+}
+
+// testAllocate allocates and frees runs across the allocation pages of an empty store, with an
+// allocation interval of 100, leaving it with 270 pages, of which page 150 is free.
+func testAllocate(t *testing.T, store ExtentManager) {
+	allocate := func(runlength int, want PageID) {
+		t.Helper()
+		if id, err := store.Allocate(runlength); err != nil || id != want {
+			t.Fatalf("Allocate %d, expected: page %d, got: page %d, err: %v", runlength, want, id, err)
+		}
+	}
+	allocate(250, 0)
+	if store.Count() != 250 {
+		t.Fatalf("count, expected: 250, got: %d", store.Count())
+	}
+	// a run across the first two allocation pages
+	if err := store.Deallocate(90, 30); err != nil {
+		t.Fatalf("Deallocate, err: %s", err)
+	}
+	if err := store.Free(150); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Deallocate(140, 20); err != ErrPageFree {
+		t.Errorf("Deallocate with a free page, expected: %s, got: %v", ErrPageFree, err)
+	}
+	if err := store.Deallocate(240, 20); err == nil {
+		t.Errorf("Deallocate past the end, expected error")
+	}
+	allocate(20, 90)
+	allocate(15, 250) // too long for the 10 pages free from 110
+	allocate(9, 110)
+	if id, err := store.New(); err != nil || id != 119 {
+		t.Fatalf("New, expected: page 119, got: page %d, err: %v", id, err)
+	}
+	// a run over the free pages at the end goes on past them
+	if err := store.Deallocate(240, 25); err != nil {
+		t.Fatal(err)
+	}
+	allocate(30, 240)
+	if store.Count() != 270 {
+		t.Errorf("count, expected: 270, got: %d", store.Count())
+	}
+	if _, err := store.Allocate(0); err == nil {
+		t.Errorf("Allocate 0, expected error")
+	}
+
+	page := newRawPage()
+	for id := PageID(0); int64(id) < store.Count(); id++ {
+		if err := store.Read(id, page); id == 150 && err != ErrPageFree {
+			t.Fatalf("Read page 150, expected: %s, got: %v", ErrPageFree, err)
+		} else if id != 150 && (err != nil || page.GetType() != 0) {
+			t.Fatalf("Read page %d, expected: empty, got: %v, err: %v", id, page.GetType(), err)
+		}
+	}
+}
+
+// BenchmarkAllocationMapFindRun finds a free page in a full allocation map for a 1 TB store, and
+// the run of pages past its end.
+func BenchmarkAllocationMapFindRun(b *testing.B) {
+	const count = 1 << 40 / int64(PageSize)
+	m := newAllocationMap(allocationPageSpan)
+	if err := m.allocate(0, count, 0); err != nil {
+		b.Fatal(err)
+	}
+	if err := m.deallocate(PageID(count-100), 1, count); err != nil {
+		b.Fatal(err)
+	}
+	m.count(count)
+	for _, bm := range []struct {
+		runlength int64
+		want      PageID
+	}{
+		{1, PageID(count - 100)},
+		{8, PageID(count)},
+	} {
+		b.Run(fmt.Sprintf("runlength=%d", bm.runlength), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if id := m.findRun(count, bm.runlength); id != bm.want {
+					b.Fatalf("findRun, expected: %d, got: %d", bm.want, id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package dbase
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// snapshot is a point-in-time view of a file store, kept while a backup runs. Pages that haven't
+// been copied yet have their current image saved before they're overwritten (copy-on-write).
+type snapshot struct {
+	count int64             // pages in the store when the snapshot was taken
+	lsn   LSN               // last LSN stamped when the snapshot was taken
+	next  PageID            // next page to be copied
+	saved map[PageID][]byte // images of pages overwritten since the snapshot was taken
+	alloc [][]byte          // images of the allocation pages tracking the count pages, if the file has an allocation map
+}
+
+// preserve saves the current image of page id for any snapshot that still needs it.
+// Caller must hold store.l.
+func (store *fileStore) preserve(id PageID) error {
+	for _, snap := range store.snapshots {
+		if int64(id) >= snap.count || id < snap.next {
+			continue
+		}
+		if _, ok := snap.saved[id]; ok {
+			continue
+		}
+		buf := make([]byte, PageSize)
+		if err := store.readPage(id, buf); err != nil {
+			return err
+		}
+		snap.saved[id] = buf
+	}
+	return nil
+}
+
+// Backup writes a consistent copy of the store, as of the start of the backup, to w. Writes to the
+// store carry on while the backup runs. The copy is in the same format as the store - compressed,
+// encrypted and with an allocation map if the store is - and can be opened as a FileStore.
+func (store *fileStore) Backup(w io.Writer) error {
+
+	snap, err := store.beginSnapshot()
+	if err != nil {
+		return err
+	}
+	defer store.endSnapshot(snap)
+
+	bw := bufio.NewWriterSize(w, 16*int(PageSize))
+	// the copy isn't preallocated, but is otherwise laid out as the store is
+	flags := store.header.flags & fileLayoutFlags
+	header := fileHeader{version: fileVersion(flags), flags: flags, keyCheck: store.header.keyCheck, lsn: snap.lsn}
+	if flags&fileAllocationMap != 0 {
+		// the allocation pages are copied as they were when the backup started
+		header.mapped, header.interval = snap.count, store.header.interval
+	}
+	if _, err := bw.Write(header.marshal()); err != nil {
+		return err
+	}
+
+	write := func(id PageID, buf []byte) error {
+		data, compressed, err := store.encodePage(id, buf)
+		if err != nil {
+			return err
+		}
+		if store.compressor != nil {
+			data = encodeFrame(id, data, compressed, frameCapacity(len(data)))
+		}
+		_, err = bw.Write(data)
+		return err
+	}
+	buf := make([]byte, PageSize)
+	for id := PageID(0); int64(id) < snap.count; id++ {
+		if store.alloc != nil && int64(id)%store.alloc.span == 0 {
+			// each allocation page comes before the pages it tracks
+			k := int(int64(id) / store.alloc.span)
+			if err := write(allocationPageID(k), snap.alloc[k]); err != nil {
+				return err
+			}
+		}
+		if err := store.snapshotPage(snap, id, buf); err != nil {
+			return err
+		}
+		if err := write(id, buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// beginSnapshot takes a snapshot of the store, which must be released with endSnapshot.
+func (store *fileStore) beginSnapshot() (*snapshot, error) {
+	store.l.Lock()
+	defer store.l.Unlock()
+	snap := &snapshot{count: store.count, lsn: store.lsn, saved: make(map[PageID][]byte)}
+	if store.alloc != nil {
+		var err error
+		if snap.alloc, err = store.allocationImages(snap.count, snap.lsn); err != nil {
+			return nil, err
+		}
+	}
+	store.snapshots = append(store.snapshots, snap)
+	return snap, nil
+}
+
+// endSnapshot releases snap, along with any page images it saved.
+func (store *fileStore) endSnapshot(snap *snapshot) {
+	store.l.Lock()
+	defer store.l.Unlock()
+	for i, s := range store.snapshots {
+		if s == snap {
+			store.snapshots = append(store.snapshots[:i], store.snapshots[i+1:]...)
+			break
+		}
+	}
+}
+
+// snapshotPage copies the snapshot image of page id into buf and marks it copied.
+func (store *fileStore) snapshotPage(snap *snapshot, id PageID, buf []byte) error {
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	snap.next = id + 1
+	if saved, ok := snap.saved[id]; ok {
+		copy(buf, saved)
+		delete(snap.saved, id)
+		return nil
+	}
+	return store.readPage(id, buf)
+}
+
+// Snapshot writes a consistent copy of the store to a new file at path, see Backup.
+func (store *fileStore) Snapshot(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if err := store.Backup(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,332 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hookWriter calls hook on the first write, before passing writes through to w.
+type hookWriter struct {
+	w    io.Writer
+	hook func()
+}
+
+func (hw *hookWriter) Write(p []byte) (int, error) {
+	if hw.hook != nil {
+		hw.hook()
+		hw.hook = nil
+	}
+	return hw.w.Write(p)
+}
+
+func TestBackupConsistent(t *testing.T) {
+
+	for _, options := range []*FileStoreOptions{
+		nil,
+		{Compress: true, EncryptionKey: bytes.Repeat([]byte{1}, 32)},
+	} {
+		path := tempfile()
+		store, err := Open(path, 0666, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			store.Close()
+			os.Remove(path)
+		}()
+
+		heap := NewHeap(store)
+		records := make(map[RID][]byte)
+		for i := 0; i < 8000; i++ {
+			record := []byte(fmt.Sprintf("original record %d", i))
+			rid, err := heap.Put(record)
+			if err != nil {
+				t.Fatalf("heap.Put, err: %s", err)
+			}
+			records[rid] = record
+		}
+		count := heap.Count()
+
+		// overwrite every record, and add some more, once the backup has started
+		mutate := func() {
+			for rid := range records {
+				if err := heap.Set(rid, []byte(fmt.Sprintf("updated  record %d", rid.Slot))); err != nil {
+					t.Fatalf("heap.Set, err: %s", err)
+				}
+			}
+			for i := 0; i < 1000; i++ {
+				if _, err := heap.Put([]byte("added during backup")); err != nil {
+					t.Fatalf("heap.Put, err: %s", err)
+				}
+			}
+		}
+
+		backupPath := tempfile()
+		file, err := os.Create(backupPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(backupPath)
+		if err := store.Backup(&hookWriter{w: file, hook: mutate}); err != nil {
+			t.Fatalf("store.Backup, err: %s", err)
+		}
+		file.Close()
+
+		var backupOptions *FileStoreOptions
+		if options != nil {
+			backupOptions = &FileStoreOptions{EncryptionKey: options.EncryptionKey}
+		}
+		backup, err := Open(backupPath, 0666, backupOptions)
+		if err != nil {
+			t.Fatalf("Open backup, err: %s", err)
+		}
+		defer backup.Close()
+
+		backupHeap := NewHeap(backup)
+		if backupHeap.Count() != count {
+			t.Errorf("backup record count, expected: %d, got: %d", count, backupHeap.Count())
+		}
+		buf := make([]byte, maxRecordLen)
+		for rid, record := range records {
+			n, err := backupHeap.Get(rid, buf)
+			if err != nil {
+				t.Fatalf("backupHeap.Get %v, err: %s", rid, err)
+			}
+			if !bytes.Equal(record, buf[0:n]) {
+				t.Fatalf("backupHeap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+			}
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	heap := NewHeap(store)
+	rid, _ := heap.Put([]byte("snapshot me"))
+
+	snapshotPath := tempfile()
+	if err := store.Snapshot(snapshotPath); err != nil {
+		t.Fatalf("store.Snapshot, err: %s", err)
+	}
+	defer os.Remove(snapshotPath)
+	if err := store.Snapshot(snapshotPath); err == nil {
+		t.Errorf("store.Snapshot over existing file, expected: error, got: nil")
+	}
+
+	snapshot, err := Open(snapshotPath, 0666, &FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open snapshot, err: %s", err)
+	}
+	defer snapshot.Close()
+	buf := make([]byte, 100)
+	n, err := NewHeap(snapshot).Get(rid, buf)
+	if err != nil {
+		t.Fatalf("heap.Get, err: %s", err)
+	}
+	if string(buf[0:n]) != "snapshot me" {
+		t.Errorf("heap.Get, expected: snapshot me, got: %s", buf[0:n])
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+
+	for _, options := range []*FileStoreOptions{
+		nil,
+		{Compress: true, EncryptionKey: bytes.Repeat([]byte{2}, 32)},
+	} {
+		path := tempfile()
+		store, err := Open(path, 0666, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			store.Close()
+			os.Remove(path)
+		}()
+
+		writer, err := NewHeapWriter(store)
+		if err != nil {
+			t.Fatalf("NewHeapWriter, err: %s", err)
+		}
+		records := make(map[RID][]byte)
+		for i := 0; i < 40000; i++ {
+			record := []byte(fmt.Sprintf("full record %d", i))
+			rid, err := writer.Write(record)
+			if err != nil {
+				t.Fatalf("writer.Write, err: %s", err)
+			}
+			records[rid] = record
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("writer.Close, err: %s", err)
+		}
+		heap := NewHeap(store)
+		put := func(n int, format string) {
+			for i := 0; i < n; i++ {
+				record := []byte(fmt.Sprintf(format, i))
+				rid, err := heap.Put(record)
+				if err != nil {
+					t.Fatalf("heap.Put, err: %s", err)
+				}
+				records[rid] = record
+			}
+		}
+
+		var full bytes.Buffer
+		lsn, err := store.BackupIncremental(&full, 0)
+		if err != nil {
+			t.Fatalf("store.BackupIncremental full, err: %s", err)
+		}
+
+		// change a handful of pages, and add some
+		var changes []*bytes.Buffer
+		for round := 0; round < 2; round++ {
+			n := 0
+			for rid := range records {
+				if n++; n > 10 {
+					break
+				}
+				record := []byte(fmt.Sprintf("changed in round %d", round))
+				if err := heap.Set(rid, record); err != nil {
+					t.Fatalf("heap.Set, err: %s", err)
+				}
+				records[rid] = record
+			}
+			put(500, fmt.Sprintf("round %d record %%d", round))
+
+			changed := &bytes.Buffer{}
+			if lsn, err = store.BackupIncremental(changed, lsn); err != nil {
+				t.Fatalf("store.BackupIncremental, err: %s", err)
+			}
+			if changed.Len() >= full.Len()/4 {
+				t.Errorf("incremental backup size, expected: < %d, got: %d", full.Len()/4, changed.Len())
+			}
+			changes = append(changes, changed)
+		}
+
+		var restoreOptions *FileStoreOptions
+		if options != nil {
+			restoreOptions = &FileStoreOptions{EncryptionKey: options.EncryptionKey}
+		}
+		restorePath := tempfile()
+		defer os.Remove(restorePath)
+
+		// a gap in the chain is refused
+		if err := Restore(restorePath, restoreOptions, bytes.NewReader(full.Bytes()), bytes.NewReader(changes[1].Bytes())); err != ErrIncrementalChain {
+			t.Errorf("Restore with a gap, expected: %v, got: %v", ErrIncrementalChain, err)
+		}
+
+		if err := Restore(restorePath, restoreOptions, &full, changes[0], changes[1]); err != nil {
+			t.Fatalf("Restore, err: %s", err)
+		}
+		restored, err := Open(restorePath, 0666, restoreOptions)
+		if err != nil {
+			t.Fatalf("Open restored, err: %s", err)
+		}
+		defer restored.Close()
+
+		restoredHeap := NewHeap(restored)
+		if restoredHeap.Count() != heap.Count() {
+			t.Errorf("restored record count, expected: %d, got: %d", heap.Count(), restoredHeap.Count())
+		}
+		buf := make([]byte, maxRecordLen)
+		for rid, record := range records {
+			n, err := restoredHeap.Get(rid, buf)
+			if err != nil {
+				t.Fatalf("restoredHeap.Get %v, err: %s", rid, err)
+			}
+			if !bytes.Equal(record, buf[0:n]) {
+				t.Fatalf("restoredHeap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+			}
+		}
+	}
+}
+
+func TestBackupAllocationMap(t *testing.T) {
+
+	key := bytes.Repeat([]byte{4}, 32)
+	for _, options := range []*FileStoreOptions{
+		{AllocationMap: true, AllocationInterval: 4},
+		{AllocationMap: true, AllocationInterval: 4, Compress: true, EncryptionKey: key},
+	} {
+		t.Run(fmt.Sprintf("compress %t", options.Compress), func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := Open(filepath.Join(dir, "store"), 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			appendPages(t, store, 10)
+			for _, id := range []PageID{3, 5} {
+				if err := store.Free(id); err != nil {
+					t.Fatalf("Free %d, err: %s", id, err)
+				}
+			}
+			readOptions := &FileStoreOptions{EncryptionKey: options.EncryptionKey}
+
+			// a snapshot keeps the allocation map
+			snapshotPath := filepath.Join(dir, "snapshot")
+			if err := store.Snapshot(snapshotPath); err != nil {
+				t.Fatalf("store.Snapshot, err: %s", err)
+			}
+			snapshot, err := Open(snapshotPath, 0666, readOptions)
+			if err != nil {
+				t.Fatalf("Open snapshot, err: %s", err)
+			}
+			checkPages(t, snapshot, 3, 5)
+			if id, err := snapshot.New(); err != nil || id != 3 {
+				t.Errorf("snapshot.New, expected: page 3, got: %d, err: %v", id, err)
+			}
+			if err := snapshot.Close(); err != nil {
+				t.Fatalf("snapshot.Close, err: %s", err)
+			}
+
+			// as does a chain of incremental backups, with pages truncated between them
+			var full, changed bytes.Buffer
+			lsn, err := store.BackupIncremental(&full, 0)
+			if err != nil {
+				t.Fatalf("store.BackupIncremental full, err: %s", err)
+			}
+			for _, id := range []PageID{8, 9} {
+				if err := store.Free(id); err != nil {
+					t.Fatalf("Free %d, err: %s", id, err)
+				}
+			}
+			if err := store.Truncate(); err != nil || store.Count() != 8 {
+				t.Fatalf("Truncate, expected: 8 pages, got: %d, err: %v", store.Count(), err)
+			}
+			if _, err := store.BackupIncremental(&changed, lsn); err != nil {
+				t.Fatalf("store.BackupIncremental, err: %s", err)
+			}
+			restorePath := filepath.Join(dir, "restored")
+			if err := Restore(restorePath, readOptions, &full, &changed); err != nil {
+				t.Fatalf("Restore, err: %s", err)
+			}
+			restored, err := Open(restorePath, 0666, readOptions)
+			if err != nil {
+				t.Fatalf("Open restored, err: %s", err)
+			}
+			defer restored.Close()
+			if restored.Count() != 8 {
+				t.Errorf("restored page count, expected: 8, got: %d", restored.Count())
+			}
+			checkPages(t, restored, 3, 5)
+			if id, err := restored.New(); err != nil || id != 3 {
+				t.Errorf("restored.New, expected: page 3, got: %d, err: %v", id, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"os"
+	"slices"
+)
+
+// frameIndexSpan returns the length of the frames holding a frame index length bytes long.
+func frameIndexSpan(length int64) int64 {
+	return length + (length+int64(PageSize)-1)/int64(PageSize)*frameHeaderLen
+}
+
+// writeFrameIndex writes the frame index of a compressed file after its last frame, and records
+// it in the header, see file store formats. The index is synced before the header is written, so
+// the header never points at an index that isn't there. Caller must hold store.l.
+func (store *fileStore) writeFrameIndex() error {
+	index := encodeFrameIndex(store.frames, store.allocFrames)
+	buf := make([]byte, 0, frameIndexSpan(int64(len(index))))
+	for chunk := range slices.Chunk(index, int(PageSize)) {
+		f := encodeFrame(frameIndexID, chunk, false, len(chunk))
+		binary.LittleEndian.PutUint16(f[frameFlagsOffset:], frameDropped)
+		buf = append(buf, f...)
+	}
+	if err := store.reserve(store.end + int64(len(buf))); err != nil {
+		return err
+	}
+	n, err := store.file.WriteAt(buf, store.end)
+	store.counters.bytesWritten.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	store.header.index, store.header.indexLen = store.end, int64(len(index))
+	return store.writeHeader()
+}
+
+// readFrameIndex reads the frame index recorded in header, of a compressed file size bytes long,
+// returning the frame of each page and allocation page, and the end of the frames. Returns false
+// if there is no index, or it can't be read, and the frames must be walked.
+func (store *fileStore) readFrameIndex(header *fileHeader, size int64) ([]frame, []frame, int64, bool) {
+	offset, length := header.index, header.indexLen
+	if offset < fileHeaderLen || length <= 0 || offset+frameIndexSpan(length) > size {
+		return nil, nil, 0, false
+	}
+	index := make([]byte, 0, length)
+	frameHeader := make([]byte, frameHeaderLen)
+	for pos := offset; int64(len(index)) < length; {
+		if _, err := store.file.ReadAt(frameHeader, pos); err != nil {
+			return nil, nil, 0, false
+		}
+		id := PageID(binary.LittleEndian.Uint64(frameHeader))
+		capacity := int(binary.LittleEndian.Uint32(frameHeader[frameCapacityOffset:]))
+		if id != frameIndexID || capacity > int(PageSize) || int64(len(index)+capacity) > length {
+			return nil, nil, 0, false
+		}
+		chunk := make([]byte, capacity)
+		if _, err := store.file.ReadAt(chunk, pos+frameHeaderLen); err != nil {
+			return nil, nil, 0, false
+		}
+		index = append(index, chunk...)
+		pos += frameHeaderLen + int64(capacity)
+	}
+	frames, allocFrames, err := decodeFrameIndex(index, offset)
+	if err != nil || (len(allocFrames) > 0 && header.flags&fileAllocationMap == 0) {
+		return nil, nil, 0, false
+	}
+	return frames, allocFrames, offset, true
+}
+
+// dropFrameIndex takes the frame index out of the header, then cuts it off the file, or zeros it
+// in a preallocated file, so frames written from the end of the frames don't leave parts of it
+// to be taken for frames. Called when the store is opened to be written to.
+func (store *fileStore) dropFrameIndex() error {
+	if store.header.index == 0 {
+		return nil
+	}
+	span := frameIndexSpan(store.header.indexLen)
+	store.header.index, store.header.indexLen = 0, 0
+	if err := store.writeHeader(); err != nil {
+		return err
+	}
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	if store.extentSize > 0 {
+		_, err := store.file.WriteAt(make([]byte, span), store.end)
+		return err
+	}
+	store.allocated = store.end
+	return store.file.Truncate(store.end)
+}
+
+// Compact rewrites a compressed store's file with its frames one after another, each no longer
+// than its page needs, dropping the frames abandoned as pages outgrew them. The new file is
+// written alongside the store's file, and renamed over it once synced. A store that isn't
+// compressed, whose pages never move, is left as it is.
+func (store *fileStore) Compact() error {
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if store.compressor == nil {
+		return nil
+	}
+	fi, err := store.file.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := store.path + ".compact"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	frames, allocFrames, end, err := store.copyFrames(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, store.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	store.file.Close()
+	store.file, store.frames, store.allocFrames = file, frames, allocFrames
+	store.end, store.allocated = end, end
+	return nil
+}
+
+// copyFrames copies the current frame of each page and allocation page to file, one after another
+// following the file header, returning their frames in file and the end of the last. Caller must
+// hold store.l.
+func (store *fileStore) copyFrames(file *os.File) ([]frame, []frame, int64, error) {
+	end := fileHeaderLen
+	copyFrame := func(id PageID, f frame) (frame, error) {
+		buf := make([]byte, frameHeaderLen+f.capacity)
+		n, err := store.file.ReadAt(buf, f.offset)
+		store.counters.bytesRead.Add(uint64(n))
+		if err != nil {
+			return frame{}, err
+		}
+		data, compressed, err := decodeFrame(id, buf)
+		if err != nil {
+			return frame{}, err
+		}
+		to := frame{offset: end, capacity: frameCapacity(len(data))}
+		n, err = file.WriteAt(encodeFrame(id, data, compressed, to.capacity), to.offset)
+		store.counters.bytesWritten.Add(uint64(n))
+		end += frameHeaderLen + int64(to.capacity)
+		return to, err
+	}
+	allocFrames := make([]frame, len(store.allocFrames))
+	for k, f := range store.allocFrames {
+		var err error
+		if allocFrames[k], err = copyFrame(allocationPageID(k), f); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	frames := make([]frame, len(store.frames))
+	for id, f := range store.frames {
+		var err error
+		if frames[id], err = copyFrame(PageID(id), f); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	header := store.header
+	header.dataEnd, header.index, header.indexLen = end, 0, 0
+	if _, err := file.WriteAt(header.marshal(), 0); err != nil {
+		return nil, nil, 0, err
+	}
+	return frames, allocFrames, end, nil
+}
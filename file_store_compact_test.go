@@ -0,0 +1,142 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	randstr "github.com/trpedersen/rand"
+)
+
+func TestCompact(t *testing.T) {
+
+	key := bytes.Repeat([]byte{6}, 32)
+	for _, options := range []*FileStoreOptions{
+		{Compress: true},
+		{Compress: true, EncryptionKey: key, AllocationMap: true, AllocationInterval: 4},
+		{Compress: true, ExtentSize: 1 << 16},
+	} {
+		name := fmt.Sprintf("encrypt %t, extents %t", options.EncryptionKey != nil, options.ExtentSize > 0)
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store")
+			store, err := Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendPages(t, store, 20)
+			// grow every other page past its frame, so it moves to a new one
+			noise := []byte(randstr.RandStr(3000, "alphanum"))
+			for id := PageID(0); id < 20; id += 2 {
+				page := NewHeapPage()
+				page.AddRecord([]byte(fmt.Sprintf("page %d", id)))
+				page.AddRecord(noise)
+				if err := store.Write(id, page); err != nil {
+					t.Fatalf("Write %d, err: %s", id, err)
+				}
+			}
+			before := store.Stats().Size
+			if err := store.Compact(); err != nil {
+				t.Fatalf("Compact, err: %s", err)
+			}
+			if after := store.Stats().Size; after >= before {
+				t.Errorf("compacted size, expected: < %d, got: %d", before, after)
+			}
+			checkPages(t, store)
+			appendPages(t, store, 2)
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+				t.Errorf("Compact, expected: no temporary file, got: %v", err)
+			}
+
+			readOptions := &FileStoreOptions{EncryptionKey: options.EncryptionKey}
+			if store, err = Open(path, 0666, readOptions); err != nil {
+				t.Fatalf("Open compacted, err: %s", err)
+			}
+			defer store.Close()
+			if store.Count() != 22 {
+				t.Errorf("compacted page count, expected: 22, got: %d", store.Count())
+			}
+			checkPages(t, store)
+		})
+	}
+
+	t.Run("not compressed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "store")
+		store, err := Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		appendPages(t, store, 3)
+		if err := store.Compact(); err != nil {
+			t.Errorf("Compact, err: %s", err)
+		}
+		checkPages(t, store)
+	})
+}
+
+func TestFrameIndex(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := Open(path, 0666, &FileStoreOptions{Compress: true, AllocationMap: true, AllocationInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPages(t, store, 10)
+	if err := store.Free(6); err != nil {
+		t.Fatal(err)
+	}
+	end := store.Stats().Size
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read only store takes its frames from the index, and leaves it in place
+	store, err = Open(path, 0666, &FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := store.(*fileStore)
+	if fs.header.index != end || store.Stats().Size != end {
+		t.Errorf("frame index, expected: at %d, got: at %d, size %d", end, fs.header.index, store.Stats().Size)
+	}
+	checkPages(t, store, 6)
+	store.Close()
+
+	// a damaged index is passed over for a walk of the frames
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{0xff}, end+frameHeaderLen+20); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	store, err = Open(path, 0666, nil)
+	if err != nil {
+		t.Fatalf("Open with a damaged index, err: %s", err)
+	}
+	checkPages(t, store, 6)
+
+	// a store opened to be written drops its index
+	if fi, err := os.Stat(path); err != nil || fi.Size() != end {
+		t.Errorf("file size, expected: %d, got: %v, err: %v", end, fi.Size(), err)
+	}
+	if store.(*fileStore).header.index != 0 {
+		t.Errorf("frame index, expected: dropped, got: at %d", store.(*fileStore).header.index)
+	}
+	appendPages(t, store, 1)
+	store.Close()
+	if store, err = Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Count() != 11 {
+		t.Errorf("page count, expected: 11, got: %d", store.Count())
+	}
+	checkPages(t, store, 6)
+}
@@ -0,0 +1,40 @@
+package dbase
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ErrDirectIO is returned when a file store can't be opened with DirectIO.
+var ErrDirectIO = errors.New("Direct I/O not possible")
+
+// alignedBuffer returns a buffer size long whose first byte is aligned to a multiple of align,
+// or an ordinary buffer if align is 0.
+func alignedBuffer(size int, align int) []byte {
+	if align == 0 {
+		return make([]byte, size)
+	}
+	buf := make([]byte, size+align)
+	skip := (align - int(uintptr(unsafe.Pointer(&buf[0]))%uintptr(align))) % align
+	return buf[skip : skip+size : skip+size]
+}
+
+// aligned reports whether buf can be read or written directly, without an aligned copy.
+func (store *fileStore) aligned(buf []byte) bool {
+	return store.align == 0 || len(buf) == 0 || uintptr(unsafe.Pointer(&buf[0]))%uintptr(store.align) == 0
+}
+
+// checkDirectIO checks that the store's file, opened for direct I/O, is plain and that pages are
+// aligned to the file's direct I/O alignment, which becomes the buffer alignment.
+func (store *fileStore) checkDirectIO() error {
+	align, err := directIOAlignment(store.file)
+	if err != nil {
+		return err
+	}
+	if align <= 0 || int(PageSize)%align != 0 {
+		return fmt.Errorf("%w: PageSize %d isn't a multiple of the direct I/O alignment %d", ErrDirectIO, PageSize, align)
+	}
+	store.align = align
+	return nil
+}
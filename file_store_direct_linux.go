@@ -0,0 +1,84 @@
+//go:build linux
+
+package dbase
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// directIOFlag is the open flag for direct I/O, bypassing the page cache.
+const directIOFlag = syscall.O_DIRECT
+
+const (
+	atEmptyPath    = 0x1000
+	statxDIOAlign  = 0x2000
+	ioctlBLKSSZGET = 0x1268
+
+	// defaultDIOAlign is the alignment assumed when the file system can't say, the traditional
+	// sector size
+	defaultDIOAlign = 512
+)
+
+// sysStatx is the statx syscall number, which unlike the io_uring syscalls differs between
+// architectures; 0 where it isn't known, and so isn't used.
+var sysStatx = map[string]uintptr{
+	"386": 383, "amd64": 332, "arm": 397, "arm64": 291, "loong64": 291, "mips": 4366, "mipsle": 4366,
+	"mips64": 5326, "mips64le": 5326, "ppc64": 383, "ppc64le": 383, "riscv64": 291, "s390x": 379,
+}[runtime.GOARCH]
+
+// statxT is struct statx, up to the direct I/O alignments, padded to its full length.
+type statxT struct {
+	mask           uint32
+	blksize        uint32
+	attributes     uint64
+	nlink          uint32
+	uid            uint32
+	gid            uint32
+	mode           uint16
+	_              uint16
+	ino            uint64
+	size           uint64
+	blocks         uint64
+	attributesMask uint64
+	times          [4][16]byte
+	rdevMajor      uint32
+	rdevMinor      uint32
+	devMajor       uint32
+	devMinor       uint32
+	mntID          uint64
+	dioMemAlign    uint32
+	dioOffsetAlign uint32
+	_              [96]byte
+}
+
+// directIOAlignment returns the alignment direct I/O on file needs for buffers, offsets and
+// lengths. It asks statx for the file's direct I/O alignment (STATX_DIOALIGN, Linux 6.1 on); failing
+// that, the logical block size if file is a block device (BLKSSZGET); failing that, 512 bytes.
+// st_blksize isn't used, it's the preferred I/O size, which on some file systems is far larger
+// than direct I/O needs.
+func directIOAlignment(file *os.File) (int, error) {
+	fd := file.Fd()
+	if sysStatx != 0 {
+		var stx statxT
+		empty := []byte{0}
+		_, _, errno := syscall.Syscall6(sysStatx, fd, uintptr(unsafe.Pointer(&empty[0])), atEmptyPath, statxDIOAlign, uintptr(unsafe.Pointer(&stx)), 0)
+		runtime.KeepAlive(file)
+		if errno == 0 && stx.mask&statxDIOAlign != 0 {
+			if stx.dioOffsetAlign == 0 {
+				return 0, fmt.Errorf("%w: the file system doesn't support direct I/O", ErrDirectIO)
+			}
+			return int(max(stx.dioMemAlign, stx.dioOffsetAlign)), nil
+		}
+	}
+	var size int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlBLKSSZGET, uintptr(unsafe.Pointer(&size)))
+	runtime.KeepAlive(file)
+	if errno == 0 && size > 0 {
+		return int(size), nil
+	}
+	return defaultDIOAlign, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package dbase
+
+import (
+	"fmt"
+	"os"
+)
+
+// directIOFlag is 0, direct I/O is only available on Linux.
+const directIOFlag = 0
+
+func directIOAlignment(file *os.File) (int, error) {
+	return 0, fmt.Errorf("%w: only available on Linux", ErrDirectIO)
+}
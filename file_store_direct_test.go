@@ -0,0 +1,89 @@
+package dbase
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestDirectIO(t *testing.T) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, &FileStoreOptions{DirectIO: true})
+	if err != nil {
+		t.Skip("direct I/O not available:", err)
+	}
+	defer os.Remove(path)
+
+	align := store.(*fileStore).align
+	if align == 0 || int(PageSize)%align != 0 {
+		t.Fatalf("alignment, expected: a factor of %d, got: %d", PageSize, align)
+	}
+	buf := store.(*fileStore).bufferPool.Get().([]byte)
+	if uintptr(unsafe.Pointer(&buf[0]))%uintptr(align) != 0 || len(buf) != int(PageSize) {
+		t.Errorf("buffer pool, expected: %d byte buffers aligned to %d, got: %d bytes at %p", PageSize, align, len(buf), &buf[0])
+	}
+
+	heap := NewHeap(store)
+	records := make(map[RID][]byte)
+	for i := 0; i < 2000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = jsonRecord(i)
+	}
+	page := NewHeapPage()
+	if err := store.WriteBatch([]PageID{1}, []Page{page}); err != nil {
+		t.Fatalf("WriteBatch, err: %s", err)
+	}
+	// page 1 is now empty
+	for rid := range records {
+		if rid.PageID == 1 {
+			delete(records, rid)
+		}
+	}
+	count := store.Count()
+	store.Close()
+
+	// the same file reads back through the page cache
+	if store, err = Open(path, 0666, nil); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	defer store.Close()
+	if store.Count() != count {
+		t.Fatalf("page count, expected: %d, got: %d", count, store.Count())
+	}
+	heap = NewHeap(store)
+	get := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := heap.Get(rid, get)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, get[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, record, get[0:n])
+		}
+	}
+
+	for _, options := range []*FileStoreOptions{
+		{DirectIO: true, Compress: true},
+		{DirectIO: true, EncryptionKey: bytes.Repeat([]byte{0x5a}, 32)},
+	} {
+		if _, err := Open(tempfile(), 0666, options); !errors.Is(err, ErrDirectIO) {
+			t.Errorf("Open %+v, expected: %s, got: %v", options, ErrDirectIO, err)
+		}
+	}
+	compressed := tempfile()
+	defer os.Remove(compressed)
+	if store, err := Open(compressed, 0666, &FileStoreOptions{Compress: true}); err != nil {
+		t.Fatal(err)
+	} else {
+		store.Close()
+	}
+	if _, err := Open(compressed, 0666, &FileStoreOptions{DirectIO: true}); !errors.Is(err, ErrDirectIO) {
+		t.Errorf("Open compressed file with DirectIO, expected: %s, got: %v", ErrDirectIO, err)
+	}
+}
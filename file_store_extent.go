@@ -0,0 +1,48 @@
+package dbase
+
+import (
+	"bytes"
+	"io"
+)
+
+// writeHeader writes the file header, with the current data end. Caller must hold store.l, or
+// be opening the store.
+func (store *fileStore) writeHeader() error {
+	store.header.dataEnd = store.end
+	buf := alignedBuffer(int(fileHeaderLen), store.align)
+	copy(buf, store.header.marshal())
+	_, err := store.file.WriteAt(buf, 0)
+	return err
+}
+
+// reserve makes sure a preallocated file has space up to end, growing it by whole extents. The
+// header's data end is brought up to date as the file grows. Caller must hold store.l.
+func (store *fileStore) reserve(end int64) error {
+	if store.extentSize == 0 || end <= store.allocated {
+		return nil
+	}
+	size := store.allocated + (end-store.allocated+store.extentSize-1)/store.extentSize*store.extentSize
+	if err := preallocate(store.file, store.allocated, size-store.allocated); err != nil {
+		return err
+	}
+	store.allocated = size
+	return store.writeHeader()
+}
+
+// findDataEnd returns the end of the pages in a preallocated, uncompressed, file of size bytes,
+// reading on from end, the data end recorded in the header, to the first slot that is all zeros.
+func (store *fileStore) findDataEnd(end int64, size int64) (int64, error) {
+	slot := alignedBuffer(int(store.slotLen), store.align)
+	zeros := make([]byte, store.slotLen)
+	for ; end+store.slotLen <= size; end += store.slotLen {
+		if _, err := store.file.ReadAt(slot, end); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(slot, zeros) {
+			break
+		}
+	}
+	return end, nil
+}
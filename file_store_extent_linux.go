@@ -0,0 +1,22 @@
+//go:build linux
+
+package dbase
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate allocates length bytes of file from offset, growing the file, with fallocate if the
+// file system supports it.
+func preallocate(file *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return file.Truncate(offset + length)
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
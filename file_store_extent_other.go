@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dbase
+
+import "os"
+
+// preallocate grows file by length bytes from offset. Without fallocate the space isn't reserved
+// up front.
+func preallocate(file *os.File, offset int64, length int64) error {
+	return file.Truncate(offset + length)
+}
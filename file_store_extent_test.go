@@ -0,0 +1,119 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPreallocatedStore(t *testing.T) {
+	for _, options := range []FileStoreOptions{
+		{ExtentSize: 1 << 20},
+		{ExtentSize: 1 << 20, Compress: true},
+		{ExtentSize: 1 << 20, EncryptionKey: bytes.Repeat([]byte{0x5a}, 32)},
+		{ExtentSize: 1 << 20, DirectIO: true},
+	} {
+		t.Run(fmt.Sprintf("compress %t, encrypt %t, direct %t", options.Compress, options.EncryptionKey != nil, options.DirectIO), func(t *testing.T) {
+			testPreallocatedStore(t, &options)
+		})
+	}
+}
+
+func testPreallocatedStore(t *testing.T, options *FileStoreOptions) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, options)
+	if err != nil && options.DirectIO {
+		t.Skip("direct I/O not available:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	heap := NewHeap(store)
+	var rids []RID
+	for i := 0; i < 5000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	checkRecords := func(store FileStore, n int) {
+		t.Helper()
+		heap := NewHeap(store)
+		buf := make([]byte, maxRecordLen)
+		for i, rid := range rids[0:n] {
+			m, err := heap.Get(rid, buf)
+			if err != nil {
+				t.Fatalf("heap.Get %v, err: %s", rid, err)
+			}
+			if !bytes.Equal(buf[0:m], jsonRecord(i)) {
+				t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, jsonRecord(i), buf[0:m])
+			}
+		}
+	}
+
+	fs := store.(*fileStore)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != fs.allocated || fs.allocated < fs.end || (fs.allocated-fileHeaderLen)%options.ExtentSize != 0 {
+		t.Errorf("file size, expected: whole extents past the data end %d, got: %d", fs.end, fi.Size())
+	}
+	if stats := store.Stats(); stats.Size != fs.end {
+		t.Errorf("stats size, expected: %d, got: %d", fs.end, stats.Size)
+	}
+	count, end := store.Count(), fs.end
+	store.Close()
+
+	// the header holds the data end, the file's size doesn't give the page count
+	if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey}); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	fs = store.(*fileStore)
+	if store.Count() != count || fs.end != end || fs.header.version != 2 || fs.header.dataEnd != end {
+		t.Fatalf("reopened, expected: %d pages ending at %d, got: %d pages ending at %d, header %+v", count, end, store.Count(), fs.end, fs.header)
+	}
+	checkRecords(store, len(rids))
+
+	// pages written after the header was last brought up to date are found on Open
+	heap = NewHeap(store)
+	for i := len(rids); i < 6000; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	count = store.Count()
+	if fs.header.dataEnd >= fs.end {
+		t.Fatalf("header data end, expected: before %d, got: %d", fs.end, fs.header.dataEnd)
+	}
+	fs.file.Close() // without Close, as if the process had died
+	if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey}); err != nil {
+		t.Fatalf("Open after crash, err: %s", err)
+	}
+	if store.Count() != count {
+		t.Fatalf("page count after crash, expected: %d, got: %d", count, store.Count())
+	}
+	checkRecords(store, len(rids))
+
+	// a backup isn't preallocated
+	backup := tempfile()
+	defer os.Remove(backup)
+	if err := store.Snapshot(backup); err != nil {
+		t.Fatalf("Snapshot, err: %s", err)
+	}
+	store.Close()
+	if store, err = Open(backup, 0666, &FileStoreOptions{EncryptionKey: options.EncryptionKey}); err != nil {
+		t.Fatalf("Open backup, err: %s", err)
+	}
+	defer store.Close()
+	if store.Count() != count || store.(*fileStore).extentSize != 0 {
+		t.Fatalf("backup, expected: %d pages without extents, got: %d pages, extent size %d", count, store.Count(), store.(*fileStore).extentSize)
+	}
+	checkRecords(store, len(rids))
+}
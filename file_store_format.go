@@ -0,0 +1,328 @@
+package dbase
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+)
+
+// File store formats.
+//
+// A plain file is a sequence of PageSize pages; page N is at offset N * PageSize. Files created
+// before file headers were introduced are always plain, as are files created without options before
+// format version 4.
+//
+// Other files start with a file header block, PageSize long, that records the format:
+//
+//	0:8   magic
+//	8:10  format version
+//	10:12 format flags, e.g. fileCompressed
+//	16:60 key check, encrypted files only
+//	64:72 data end, preallocated files only
+//	72:80 mapped count, files with an allocation map only
+//	80:84 allocation interval, files with an allocation map only; 64,000 if 0
+//	88:96 LSN, no page in the file is stamped with a greater LSN; 0 if not kept, as by files
+//	      written before it was, when it is found by reading every page on Open
+//
+// A file with a header but no format flags follows it with pages laid out as in a plain file, and
+// is format version 4.
+//	96:104  frame index offset, compressed files closed cleanly only; 0 if there is none
+//	104:112 frame index length
+//
+// An encrypted file that isn't compressed follows the header with a sequence of sealed pages, each
+// PageSize + sealedOverhead long. Sealed pages hold a nonce followed by the AES-GCM ciphertext.
+//
+// A compressed file follows the header with a sequence of frames, each holding one page:
+//
+//	0:8   page ID
+//	8:12  frame capacity, bytes available for data following the frame header
+//	12:14 data length
+//	14:16 frame flags, e.g. frameCompressed
+//	16:   data
+//
+// In an encrypted compressed file the frame data is sealed after compression.
+//
+// A preallocated file grows in extents, so the file is longer than the pages it holds, and the
+// space past the data end reads as zeros. The header's data end is brought up to date whenever the
+// file grows and on Close; on Open the pages or frames written past it since are found by reading
+// on to the first slot or frame header that is all zeros. Preallocated files are format version 2.
+//
+// A file with an allocation map holds an allocation page, see AllocationPage, before each run of
+// I pages, the allocation interval, tracking which of them are allocated: page N is at slot
+// N + N/I + 1, and allocation page K at slot K * (I + 1). In a
+// compressed file allocation page K is held in a frame for page ID -(K+1). Allocation pages are
+// written when pages are freed or reused, and on Close, not as pages are added; the header's mapped
+// count is the page count they were last brought up to date for, and pages from there on are
+// allocated. Files with an allocation map are format version 3.
+//
+// A frame is rewritten in place if the page still fits, otherwise a new frame is appended and the
+// old one abandoned; Compact rewrites the file without the abandoned frames. The frames of pages
+// dropped by Truncate are flagged frameDropped, unless they are cut off the end of the file, and
+// skipped.
+//
+// Close writes the page -> frame map after the last frame, as a frame index, and records where it
+// is in the header, so Open reads the map rather than walking every frame:
+//
+//	0:8   page count
+//	8:16  allocation page count
+//	16:   offset (8 bytes) and capacity (4 bytes) of the frame of each page, then of each
+//	      allocation page
+//	-4:   CRC-32C of the rest of the index
+//
+// The index is held in frames of at most PageSize bytes for page ID frameIndexID, flagged
+// frameDropped so a walk of the frames skips them. Open takes the index out of the header, and
+// cuts it off the file, before the file is written to. A file without an index, or with one that
+// can't be read, has its frames walked: the last frame in the file for a page is the current one.
+
+const (
+	fileHeaderLen     = int64(PageSize)
+	fileMagic         = "dbase\x00fs"
+	fileFormatVersion = uint16(4)
+
+	fileVersionOffset  = 8
+	fileFlagsOffset    = 10
+	fileKeyCheckOffset = 16
+	fileDataEndOffset  = 64
+	fileMappedOffset   = 72
+	fileIntervalOffset = 80
+	fileLSNOffset      = 88
+	fileIndexOffset    = 96
+	fileIndexLenOffset = 104
+
+	// file format flags
+	fileCompressed    = uint16(0x01)
+	fileEncrypted     = uint16(0x02)
+	filePreallocated  = uint16(0x04)
+	fileAllocationMap = uint16(0x08)
+
+	// fileLayoutFlags are the flags that decide how pages are laid out, which a backup keeps
+	fileLayoutFlags = fileCompressed | fileEncrypted | fileAllocationMap
+
+	frameHeaderLen       = 16
+	frameCapacityOffset  = 8
+	frameLengthOffset    = 12
+	frameFlagsOffset     = 14
+	frameAlign           = 256 // frame capacity is rounded up to a multiple of frameAlign
+	maxFrameLen          = frameHeaderLen + int(PageSize) + compressedLenLen + sealedOverhead + frameAlign
+	frameCompressed      = uint16(0x01)
+	frameDropped         = uint16(0x02)
+	pageCompressionLevel = flate.BestSpeed
+
+	// frameIndexID and keyCheckID are neither page IDs nor allocation page IDs, see allocationPageID
+	frameIndexID       = PageID(math.MinInt64) // page ID of the frames holding the frame index
+	keyCheckID         = frameIndexID + 1      // associated data sealing the header's key check
+	frameIndexEntryLen = 12
+)
+
+// ErrBadFileFormat is returned when a file store's header or frames can't be understood.
+var ErrBadFileFormat = errors.New("Bad file store format")
+
+// frame locates a page in a compressed file
+type frame struct {
+	offset   int64
+	capacity int
+}
+
+// fileHeader is the decoded file header block
+type fileHeader struct {
+	version  uint16
+	flags    uint16
+	keyCheck []byte
+	dataEnd  int64  // preallocated files only, see filePreallocated
+	mapped   int64  // files with an allocation map only, see fileAllocationMap
+	interval uint32 // likewise
+	lsn      LSN    // see advanceLSN
+	index    int64  // compressed files only, offset of the frame index, see writeFrameIndex
+	indexLen int64  // likewise, its length
+}
+
+// fileVersion returns the format version of a file with flags, the earliest that can read it.
+func fileVersion(flags uint16) uint16 {
+	if flags == 0 {
+		// earlier versions take a file without flags to be plain
+		return 4
+	}
+	if flags&fileAllocationMap != 0 {
+		return 3
+	}
+	if flags&filePreallocated != 0 {
+		return 2
+	}
+	return 1
+}
+
+func (header *fileHeader) marshal() []byte {
+	buf := make([]byte, fileHeaderLen)
+	copy(buf, fileMagic)
+	binary.LittleEndian.PutUint16(buf[fileVersionOffset:], header.version)
+	binary.LittleEndian.PutUint16(buf[fileFlagsOffset:], header.flags)
+	copy(buf[fileKeyCheckOffset:fileKeyCheckOffset+keyCheckLen], header.keyCheck)
+	binary.LittleEndian.PutUint64(buf[fileDataEndOffset:], uint64(header.dataEnd))
+	binary.LittleEndian.PutUint64(buf[fileMappedOffset:], uint64(header.mapped))
+	binary.LittleEndian.PutUint32(buf[fileIntervalOffset:], header.interval)
+	binary.LittleEndian.PutUint64(buf[fileLSNOffset:], uint64(header.lsn))
+	binary.LittleEndian.PutUint64(buf[fileIndexOffset:], uint64(header.index))
+	binary.LittleEndian.PutUint64(buf[fileIndexLenOffset:], uint64(header.indexLen))
+	return buf
+}
+
+func (header *fileHeader) unmarshal(buf []byte) error {
+	if !hasFileMagic(buf) {
+		return ErrBadFileFormat
+	}
+	header.version = binary.LittleEndian.Uint16(buf[fileVersionOffset:])
+	header.flags = binary.LittleEndian.Uint16(buf[fileFlagsOffset:])
+	header.keyCheck = append([]byte(nil), buf[fileKeyCheckOffset:fileKeyCheckOffset+keyCheckLen]...)
+	header.dataEnd = int64(binary.LittleEndian.Uint64(buf[fileDataEndOffset:]))
+	header.mapped = int64(binary.LittleEndian.Uint64(buf[fileMappedOffset:]))
+	header.interval = binary.LittleEndian.Uint32(buf[fileIntervalOffset:])
+	header.lsn = LSN(binary.LittleEndian.Uint64(buf[fileLSNOffset:]))
+	header.index = int64(binary.LittleEndian.Uint64(buf[fileIndexOffset:]))
+	header.indexLen = int64(binary.LittleEndian.Uint64(buf[fileIndexLenOffset:]))
+	if header.interval > allocationPageSpan {
+		return ErrBadFileFormat
+	}
+	if header.version > fileFormatVersion {
+		return ErrBadFileFormat
+	}
+	return nil
+}
+
+func hasFileMagic(buf []byte) bool {
+	return len(buf) >= len(fileMagic) && bytes.Equal(buf[0:len(fileMagic)], []byte(fileMagic))
+}
+
+// readFrames walks the frames in a compressed file with flags, from the end of the file header to
+// size, returning the current frame for each page, the frame for each allocation page if the file
+// has an allocation map, and the end of the last frame. In a preallocated file the walk stops early
+// at a frame header that is all zeros.
+func readFrames(r io.ReaderAt, size int64, flags uint16) ([]frame, []frame, int64, error) {
+	var frames, allocFrames []frame
+	header := make([]byte, frameHeaderLen)
+	offset := fileHeaderLen
+	for offset < size {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return nil, nil, 0, err
+		}
+		id := PageID(binary.LittleEndian.Uint64(header))
+		capacity := int(binary.LittleEndian.Uint32(header[frameCapacityOffset:]))
+		if flags&filePreallocated != 0 && id == 0 && capacity == 0 {
+			break
+		}
+		if capacity > maxFrameLen {
+			return nil, nil, 0, ErrBadFileFormat
+		}
+		f := frame{offset: offset, capacity: capacity}
+		offset += frameHeaderLen + int64(capacity)
+		switch {
+		case binary.LittleEndian.Uint16(header[frameFlagsOffset:])&frameDropped != 0:
+			continue
+		case id >= 0:
+			for PageID(len(frames)) <= id {
+				frames = append(frames, frame{offset: -1})
+			}
+			frames[id] = f
+		case flags&fileAllocationMap != 0 && int(-id-1) == len(allocFrames):
+			allocFrames = append(allocFrames, f)
+		case flags&fileAllocationMap != 0 && int(-id-1) < len(allocFrames):
+			allocFrames[-id-1] = f
+		default:
+			return nil, nil, 0, ErrBadFileFormat
+		}
+	}
+	for _, f := range frames {
+		if f.offset < 0 {
+			return nil, nil, 0, ErrBadFileFormat
+		}
+	}
+	return frames, allocFrames, offset, nil
+}
+
+// encodeFrameIndex returns the frame index of a compressed file with frames and allocFrames, see
+// file store formats.
+func encodeFrameIndex(frames []frame, allocFrames []frame) []byte {
+	buf := make([]byte, 16, 16+(len(frames)+len(allocFrames))*frameIndexEntryLen+4)
+	binary.LittleEndian.PutUint64(buf, uint64(len(frames)))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(allocFrames)))
+	for _, f := range slices.Concat(frames, allocFrames) {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(f.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(f.capacity))
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// decodeFrameIndex returns the frames and allocation page frames held in frame index buf, of a
+// file whose frames end at end.
+func decodeFrameIndex(buf []byte, end int64) ([]frame, []frame, error) {
+	if len(buf) < 20 || crc32.Checksum(buf[0:len(buf)-4], crcTable) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, nil, ErrBadFileFormat
+	}
+	n, m := binary.LittleEndian.Uint64(buf), binary.LittleEndian.Uint64(buf[8:])
+	if n > uint64(len(buf)) || m > uint64(len(buf)) || 16+(n+m)*frameIndexEntryLen+4 != uint64(len(buf)) {
+		return nil, nil, ErrBadFileFormat
+	}
+	all := make([]frame, n+m)
+	for i := range all {
+		entry := buf[16+i*frameIndexEntryLen:]
+		f := frame{offset: int64(binary.LittleEndian.Uint64(entry)), capacity: int(binary.LittleEndian.Uint32(entry[8:]))}
+		if f.offset < fileHeaderLen || f.capacity > maxFrameLen || f.offset+frameHeaderLen+int64(f.capacity) > end {
+			return nil, nil, ErrBadFileFormat
+		}
+		all[i] = f
+	}
+	return all[0:n:n], all[n:], nil
+}
+
+// encodeFrame returns a frame holding data for page id, with at least capacity bytes of space.
+func encodeFrame(id PageID, data []byte, compressed bool, capacity int) []byte {
+	buf := make([]byte, frameHeaderLen+capacity)
+	binary.LittleEndian.PutUint64(buf, uint64(id))
+	binary.LittleEndian.PutUint32(buf[frameCapacityOffset:], uint32(capacity))
+	binary.LittleEndian.PutUint16(buf[frameLengthOffset:], uint16(len(data)))
+	var flags uint16
+	if compressed {
+		flags |= frameCompressed
+	}
+	binary.LittleEndian.PutUint16(buf[frameFlagsOffset:], flags)
+	copy(buf[frameHeaderLen:], data)
+	return buf
+}
+
+// decodeFrame returns the data held in frame buf for page id, and whether it is compressed.
+func decodeFrame(id PageID, buf []byte) ([]byte, bool, error) {
+	if PageID(binary.LittleEndian.Uint64(buf)) != id {
+		return nil, false, ErrBadFileFormat
+	}
+	length := int(binary.LittleEndian.Uint16(buf[frameLengthOffset:]))
+	flags := binary.LittleEndian.Uint16(buf[frameFlagsOffset:])
+	if frameHeaderLen+length > len(buf) {
+		return nil, false, ErrBadFileFormat
+	}
+	return buf[frameHeaderLen : frameHeaderLen+length], flags&frameCompressed != 0, nil
+}
+
+// decodePage copies the page image held in data into page, decompressing it if necessary.
+func decodePage(data []byte, compressed bool, page []byte) error {
+	if !compressed {
+		if copy(page, data) != len(page) {
+			return ErrBadFileFormat
+		}
+		return nil
+	}
+	if n, err := decompress(data, page); err != nil {
+		return err
+	} else if n != len(page) {
+		return ErrBadFileFormat
+	}
+	return nil
+}
+
+// frameCapacity returns the capacity for a new frame holding length bytes.
+func frameCapacity(length int) int {
+	return (length + frameAlign - 1) / frameAlign * frameAlign
+}
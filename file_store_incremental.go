@@ -0,0 +1,309 @@
+package dbase
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// Incremental backup format.
+//
+// An incremental backup holds the pages changed since a given LSN. It starts with a header:
+//
+//	0:8   magic
+//	8:10  format version
+//	10:12 file format flags of the store backed up, e.g. fileCompressed
+//	12:16 allocation interval, stores with an allocation map only
+//	16:24 since, pages with an LSN greater than this are included
+//	24:32 upto, the last LSN stamped when the backup started
+//	32:40 page count when the backup started
+//
+// followed by one frame for each changed page (see file store formats), each exactly as long as its
+// data, and an end frame with page ID incrementalEnd. Page data is in the store's on-disk form, so the
+// pages of an encrypted store stay encrypted. A store with an allocation map has every allocation
+// page tracking the page count included, changed or not, as it was when the backup started, ahead
+// of the pages; restoring a backup with a lower page count than the store restored so far
+// truncates the store to it.
+//
+// Version 1 backups have no allocation pages, and end with a frame for page ID -1.
+
+const (
+	incrementalMagic     = "dbase\x00ib"
+	incrementalVersion   = uint16(2)
+	incrementalHeaderLen = 40
+	incrementalEnd       = PageID(math.MinInt64)
+	incrementalEndV1     = PageID(-1)
+
+	incrementalIntervalOffset = 12
+	incrementalSinceOffset    = 16
+	incrementalUptoOffset     = 24
+	incrementalCountOffset    = 32
+)
+
+// ErrIncrementalChain is returned by Restore when an incremental backup doesn't follow on from
+// what has been restored so far, or is for a store in a different format.
+var ErrIncrementalChain = errors.New("Incremental backup doesn't follow on from the restored store")
+
+// incrementalHeader is the decoded header of an incremental backup
+type incrementalHeader struct {
+	version  uint16
+	flags    uint16
+	interval uint32
+	since    LSN
+	upto     LSN
+	count    int64
+}
+
+func (header *incrementalHeader) marshal() []byte {
+	buf := make([]byte, incrementalHeaderLen)
+	copy(buf, incrementalMagic)
+	binary.LittleEndian.PutUint16(buf[fileVersionOffset:], incrementalVersion)
+	binary.LittleEndian.PutUint16(buf[fileFlagsOffset:], header.flags)
+	binary.LittleEndian.PutUint32(buf[incrementalIntervalOffset:], header.interval)
+	binary.LittleEndian.PutUint64(buf[incrementalSinceOffset:], uint64(header.since))
+	binary.LittleEndian.PutUint64(buf[incrementalUptoOffset:], uint64(header.upto))
+	binary.LittleEndian.PutUint64(buf[incrementalCountOffset:], uint64(header.count))
+	return buf
+}
+
+func (header *incrementalHeader) unmarshal(buf []byte) error {
+	if string(buf[0:len(incrementalMagic)]) != incrementalMagic ||
+		binary.LittleEndian.Uint16(buf[fileVersionOffset:]) > incrementalVersion {
+		return ErrBadFileFormat
+	}
+	header.version = binary.LittleEndian.Uint16(buf[fileVersionOffset:])
+	header.flags = binary.LittleEndian.Uint16(buf[fileFlagsOffset:])
+	header.interval = binary.LittleEndian.Uint32(buf[incrementalIntervalOffset:])
+	header.since = LSN(binary.LittleEndian.Uint64(buf[incrementalSinceOffset:]))
+	header.upto = LSN(binary.LittleEndian.Uint64(buf[incrementalUptoOffset:]))
+	header.count = int64(binary.LittleEndian.Uint64(buf[incrementalCountOffset:]))
+	if header.interval > allocationPageSpan {
+		return ErrBadFileFormat
+	}
+	return nil
+}
+
+// end returns the page ID of the backup's end frame.
+func (header *incrementalHeader) end() PageID {
+	if header.version < 2 {
+		return incrementalEndV1
+	}
+	return incrementalEnd
+}
+
+// BackupIncremental writes the pages changed since LSN since to w, as of the start of the backup.
+// Since 0 includes every page. Writes to the store carry on while the backup runs. Returns the LSN
+// to pass as since for the next incremental backup in the chain.
+func (store *fileStore) BackupIncremental(w io.Writer, since LSN) (LSN, error) {
+
+	snap, err := store.beginSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer store.endSnapshot(snap)
+
+	bw := bufio.NewWriterSize(w, 16*int(PageSize))
+	header := incrementalHeader{flags: store.header.flags & fileLayoutFlags, since: since, upto: snap.lsn, count: snap.count}
+	if store.alloc != nil {
+		header.interval = store.header.interval
+	}
+	if _, err := bw.Write(header.marshal()); err != nil {
+		return 0, err
+	}
+
+	write := func(id PageID, buf []byte) error {
+		data, compressed, err := store.encodePage(id, buf)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(encodeFrame(id, data, compressed, len(data)))
+		return err
+	}
+	for k, image := range snap.alloc {
+		if err := write(allocationPageID(k), image); err != nil {
+			return 0, err
+		}
+	}
+	buf := make([]byte, PageSize)
+	for id := PageID(0); int64(id) < snap.count; id++ {
+		if err := store.snapshotPage(snap, id, buf); err != nil {
+			return 0, err
+		}
+		if since != 0 && pageLSN(buf) <= since {
+			continue
+		}
+		if err := write(id, buf); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := bw.Write(encodeFrame(incrementalEnd, nil, false, 0)); err != nil {
+		return 0, err
+	}
+	return snap.lsn, bw.Flush()
+}
+
+// Restore creates a new file store at path from a chain of backups written by BackupIncremental,
+// applied in order. The first must be a full backup, taken with since 0, and each one after must
+// start at or before the point the one before it ends. Options give the encryption key, if the
+// store backed up was encrypted.
+func Restore(path string, options *FileStoreOptions, backups ...io.Reader) error {
+	store, _, err := restoreStore(path, options, backups)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
+
+// restoreStore creates a new file store at path from a chain of backups, see Restore, returning the
+// open store and the LSN it is restored to. The file is removed if the chain can't be restored.
+func restoreStore(path string, options *FileStoreOptions, backups []io.Reader) (*fileStore, LSN, error) {
+
+	if len(backups) == 0 {
+		return nil, 0, ErrIncrementalChain
+	}
+	r := bufio.NewReader(backups[0])
+	headerBuf, err := r.Peek(incrementalHeaderLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	var header incrementalHeader
+	if err := header.unmarshal(headerBuf); err != nil {
+		return nil, 0, err
+	}
+	if header.since != 0 {
+		return nil, 0, ErrIncrementalChain
+	}
+	if header.flags&fileEncrypted != 0 && (options == nil || options.EncryptionKey == nil) {
+		return nil, 0, ErrEncryptionKey
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil, 0, os.ErrExist
+	}
+	restoreOptions := &FileStoreOptions{
+		Compress:           header.flags&fileCompressed != 0,
+		AllocationMap:      header.flags&fileAllocationMap != 0,
+		AllocationInterval: int(header.interval),
+	}
+	if options != nil {
+		restoreOptions.EncryptionKey = options.EncryptionKey
+	}
+	fs, err := Open(path, 0666, restoreOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	store := fs.(*fileStore)
+	restored, err := store.restore(r, backups[1:])
+	if err != nil {
+		store.Close()
+		os.Remove(path)
+		return nil, 0, err
+	}
+	return store, restored, nil
+}
+
+// restore applies the chain of backups starting with full to the store, returning the LSN it is restored to.
+func (store *fileStore) restore(full io.Reader, incrementals []io.Reader) (LSN, error) {
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	buf := make([]byte, PageSize)
+	restored, err := store.applyIncremental(full, 0, buf)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range incrementals {
+		if restored, err = store.applyIncremental(bufio.NewReader(r), restored, buf); err != nil {
+			return 0, err
+		}
+	}
+	if store.alloc != nil {
+		// the allocation pages restored are up to date for every page
+		store.header.mapped = store.count
+		if err := store.writeHeader(); err != nil {
+			return 0, err
+		}
+	}
+	return restored, store.file.Sync()
+}
+
+// applyIncremental writes the pages in incremental backup r to the store, which holds every change
+// up to LSN restored, and returns the LSN the store is restored to. Caller must hold store.l.
+func (store *fileStore) applyIncremental(r io.Reader, restored LSN, buf []byte) (LSN, error) {
+
+	headerBuf := make([]byte, incrementalHeaderLen)
+	if _, err := io.ReadFull(r, headerBuf); err != nil {
+		return 0, err
+	}
+	var header incrementalHeader
+	if err := header.unmarshal(headerBuf); err != nil {
+		return 0, err
+	}
+	if header.flags != store.header.flags&fileLayoutFlags || header.since > restored || header.upto < restored {
+		return 0, ErrIncrementalChain
+	}
+	if store.alloc != nil && header.interval != store.header.interval {
+		return 0, ErrIncrementalChain
+	}
+
+	frameHeader := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, frameHeader); err != nil {
+			return 0, err
+		}
+		id := PageID(binary.LittleEndian.Uint64(frameHeader))
+		if id == header.end() {
+			break
+		}
+		capacity := int(binary.LittleEndian.Uint32(frameHeader[frameCapacityOffset:]))
+		if id > store.lastPageID+1 || capacity > maxFrameLen {
+			return 0, ErrBadFileFormat
+		}
+		if id < 0 && (store.alloc == nil || int64(-id-1)*store.alloc.span >= header.count) {
+			return 0, ErrBadFileFormat
+		}
+		frameBuf := make([]byte, frameHeaderLen+capacity)
+		copy(frameBuf, frameHeader)
+		if _, err := io.ReadFull(r, frameBuf[frameHeaderLen:]); err != nil {
+			return 0, err
+		}
+		data, compressed, err := decodeFrame(id, frameBuf)
+		if err != nil {
+			return 0, err
+		}
+		if err := store.decodePage(id, data, compressed, buf); err != nil {
+			return 0, err
+		}
+		if err := store.writePage(id, buf); err != nil {
+			return 0, err
+		}
+		if id < 0 {
+			page := NewAllocationPage()
+			if err := page.UnmarshalBinary(buf); err != nil {
+				return 0, err
+			}
+			store.alloc.set(int(-id-1), page)
+		} else if id > store.lastPageID {
+			store.lastPageID++
+			store.count++
+		}
+	}
+	if store.alloc != nil {
+		store.alloc.cover(int((store.count + store.alloc.span - 1) / store.alloc.span))
+		store.alloc.count(store.count)
+		if store.count > header.count {
+			// pages dropped by Truncate since the backups restored so far
+			if err := store.truncate(header.count); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if store.count != header.count {
+		return 0, ErrBadFileFormat
+	}
+	return header.upto, store.advanceLSN(header.upto)
+}
@@ -0,0 +1,229 @@
+package dbase
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ioRequest is one read or write of buf at offset, made as part of a batch. n and err are set
+// once it completes.
+type ioRequest struct {
+	buf    []byte
+	offset int64
+	n      int
+	err    error
+	done   bool
+}
+
+// ioEngine reads and writes batches of requests against a file. A file store has one engine,
+// shared by everything reading or writing through it. Request buffers must be heap allocated.
+type ioEngine interface {
+	// readAt and writeAt make each request, as ReadAt and WriteAt would, returning the first error.
+	readAt(file *os.File, reqs []ioRequest) error
+	writeAt(file *os.File, reqs []ioRequest) error
+	close() error
+}
+
+// newIOEngine returns an io_uring engine if uring is set and the kernel allows one, otherwise a
+// syncEngine.
+func newIOEngine(uring bool) ioEngine {
+	if uring {
+		if r, err := newURing(); err == nil {
+			return r
+		}
+	}
+	return syncEngine{}
+}
+
+// syncEngine makes each request in turn with ReadAt and WriteAt.
+type syncEngine struct{}
+
+func (syncEngine) readAt(file *os.File, reqs []ioRequest) error {
+	for i := range reqs {
+		reqs[i].n, reqs[i].err = file.ReadAt(reqs[i].buf, reqs[i].offset)
+		reqs[i].done = true
+	}
+	return firstRequestErr(reqs)
+}
+
+func (syncEngine) writeAt(file *os.File, reqs []ioRequest) error {
+	for i := range reqs {
+		reqs[i].n, reqs[i].err = file.WriteAt(reqs[i].buf, reqs[i].offset)
+		reqs[i].done = true
+	}
+	return firstRequestErr(reqs)
+}
+
+func (syncEngine) close() error {
+	return nil
+}
+
+func firstRequestErr(reqs []ioRequest) error {
+	for i := range reqs {
+		if reqs[i].err != nil {
+			return reqs[i].err
+		}
+	}
+	return nil
+}
+
+// checkBatch checks that ids are existing, distinct, pages, none of them free, and match pages in
+// number. Caller must hold store.l.
+func (store *fileStore) checkBatch(ids []PageID, pages []Page) error {
+	if len(ids) != len(pages) {
+		return errors.New("ids and pages differ in length")
+	}
+	seen := make(map[PageID]bool, len(ids))
+	for _, id := range ids {
+		if id < 0 || id > store.lastPageID {
+			return errors.New("Invalid page ID")
+		}
+		if seen[id] {
+			return errors.New("Page ID repeated in batch")
+		}
+		if store.isFree(id) {
+			return ErrPageFree
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// ReadBatch reads page ids[i] into pages[i], submitting the reads together. Every page is
+// attempted; the first error is returned.
+func (store *fileStore) ReadBatch(ids []PageID, pages []Page) error {
+	defer store.counters.readLatency.since(time.Now())
+
+	store.l.RLock()
+	defer store.l.RUnlock()
+
+	if err := store.checkBatch(ids, pages); err != nil {
+		return err
+	}
+
+	plain := store.compressor == nil && store.sealer == nil
+	reqs := make([]ioRequest, len(ids))
+	for i, id := range ids {
+		offset, length := store.pageExtent(id)
+		reqs[i].offset = offset
+		if plain {
+			reqs[i].buf = store.bufferPool.Get().([]byte)
+			defer store.bufferPool.Put(reqs[i].buf)
+		} else {
+			reqs[i].buf = make([]byte, length)
+		}
+	}
+	store.io.readAt(store.file, reqs)
+
+	buf := store.bufferPool.Get().([]byte)
+	defer store.bufferPool.Put(buf)
+	var firstErr error
+	for i, id := range ids {
+		store.counters.bytesRead.Add(uint64(reqs[i].n))
+		err := reqs[i].err
+		if err == nil {
+			err = store.decodeExtent(id, reqs[i].buf, buf)
+		}
+		if err == nil && !checkPageChecksum(buf) {
+			err = PageChecksumFailed{id}
+		}
+		if err == nil {
+			err = pages[i].UnmarshalBinary(buf)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	store.counters.reads.Add(uint64(len(ids)))
+	return firstErr
+}
+
+// WriteBatch writes pages[i] as existing page ids[i], submitting the writes together. Pages are
+// stamped, and logged, in order, and the log synced once for the batch. The first error is
+// returned; pages before it in the batch may have been written.
+func (store *fileStore) WriteBatch(ids []PageID, pages []Page) error {
+	defer store.counters.writeLatency.since(time.Now())
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if err := store.checkBatch(ids, pages); err != nil {
+		return err
+	}
+
+	records := make([]logRecord, len(ids))
+	for i, id := range ids {
+		buf, err := pages[i].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		prev := store.lsn
+		if err := store.stamp(buf); err != nil {
+			return err
+		}
+		if err := store.preserve(id); err != nil {
+			return err
+		}
+		data, compressed, err := store.encodePage(id, buf)
+		if err != nil {
+			return err
+		}
+		records[i] = logRecord{lsn: store.lsn, prev: prev, id: id, data: data, compressed: compressed}
+		if store.log != nil {
+			if err := store.log.append(records[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if store.log != nil {
+		// the whole batch is logged before any of it is written
+		if err := store.log.sync(); err != nil {
+			return err
+		}
+	}
+
+	// compressed pages that no longer fit their frame are given new frames at the end, in turn
+	reqs := make([]ioRequest, len(ids))
+	frames := make([]frame, len(ids))
+	end := store.end
+	for i, rec := range records {
+		if store.compressor == nil {
+			data := rec.data
+			if !store.aligned(data) {
+				buf := store.bufferPool.Get().([]byte)
+				defer store.bufferPool.Put(buf)
+				data = buf[0:copy(buf, data)]
+			}
+			reqs[i] = ioRequest{buf: data, offset: store.pageOffset(rec.id)}
+			continue
+		}
+		frames[i] = store.frames[rec.id]
+		if len(rec.data) > frames[i].capacity {
+			frames[i] = frame{offset: end, capacity: frameCapacity(len(rec.data))}
+			end += frameHeaderLen + int64(frames[i].capacity)
+		}
+		reqs[i] = ioRequest{buf: encodeFrame(rec.id, rec.data, rec.compressed, frames[i].capacity), offset: frames[i].offset}
+	}
+	if err := store.reserve(end); err != nil {
+		return err
+	}
+	store.io.writeAt(store.file, reqs)
+
+	for i, rec := range records {
+		store.counters.bytesWritten.Add(uint64(reqs[i].n))
+		if reqs[i].err != nil {
+			continue
+		}
+		if store.compressor != nil {
+			store.frames[rec.id] = frames[i]
+			store.end = max(store.end, frames[i].offset+frameHeaderLen+int64(frames[i].capacity))
+		}
+		store.publish(rec)
+		store.counters.writes.Add(1)
+	}
+	return firstRequestErr(reqs)
+}
@@ -0,0 +1,144 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	randstr "github.com/trpedersen/rand"
+)
+
+func TestBatch(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	formats := []struct {
+		name    string
+		options FileStoreOptions
+	}{
+		{"plain", FileStoreOptions{}},
+		{"compressed", FileStoreOptions{Compress: true}},
+		{"encrypted", FileStoreOptions{EncryptionKey: key}},
+		{"compressed encrypted", FileStoreOptions{Compress: true, EncryptionKey: key}},
+	}
+	for _, uring := range []bool{false, true} {
+		for _, format := range formats {
+			options := format.options
+			options.IOUring = uring
+			t.Run(fmt.Sprintf("%s, io_uring %t", format.name, uring), func(t *testing.T) {
+				testBatch(t, &options)
+			})
+		}
+	}
+}
+
+func testBatch(t *testing.T, options *FileStoreOptions) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if _, ok := store.(*fileStore).io.(*uring); options.IOUring && !ok {
+		store.Close()
+		t.Skip("io_uring not available")
+	}
+
+	// more pages than the ring has entries, so batches are submitted in turn
+	const pages = 150
+	ids := make([]PageID, pages)
+	batch := make([]Page, pages)
+	for i := range ids {
+		page := NewHeapPage()
+		if _, err := page.AddRecord([]byte(fmt.Sprintf("page %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if ids[pages-1-i], err = store.Append(page); err != nil {
+			t.Fatal(err)
+		}
+		batch[i] = NewHeapPage()
+	}
+
+	check := func(ids []PageID, batch []Page, record func(id PageID) []byte) {
+		t.Helper()
+		buf := make([]byte, PageSize)
+		for i, id := range ids {
+			n, err := batch[i].(HeapPage).GetRecord(1, buf)
+			if err != nil {
+				t.Fatalf("page %d GetRecord, err: %s", id, err)
+			}
+			if !bytes.Equal(buf[0:n], record(id)) {
+				t.Fatalf("page %d, expecting: %.20s, got: %.20s", id, record(id), buf[0:n])
+			}
+		}
+	}
+
+	if err := store.ReadBatch(ids, batch); err != nil {
+		t.Fatalf("ReadBatch, err: %s", err)
+	}
+	check(ids, batch, func(id PageID) []byte { return []byte(fmt.Sprintf("page %d", id)) })
+
+	// incompressible records, so compressed pages outgrow their frames
+	records := make(map[PageID][]byte)
+	for i, id := range ids {
+		records[id] = []byte(randstr.RandStr(3000, "alphanum"))
+		if err := batch[i].(HeapPage).SetRecord(1, records[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lsn := store.LSN()
+	if err := store.WriteBatch(ids, batch); err != nil {
+		t.Fatalf("WriteBatch, err: %s", err)
+	}
+	if store.LSN() < lsn+pages {
+		t.Errorf("LSN after WriteBatch, expected: >= %d, got: %d", lsn+pages, store.LSN())
+	}
+	if stats := store.Stats(); stats.Writes != pages || stats.Appends != pages {
+		t.Errorf("stats, expected: %d writes and appends, got: %s", pages, stats)
+	}
+
+	for _, bad := range []struct {
+		name string
+		ids  []PageID
+	}{
+		{"repeated", []PageID{1, 2, 1}},
+		{"invalid", []PageID{1, 2, pages}},
+		{"short", []PageID{1, 2}},
+	} {
+		if err := store.WriteBatch(bad.ids, batch[0:3]); err == nil {
+			t.Errorf("WriteBatch %s ids, expected error", bad.name)
+		}
+		if err := store.ReadBatch(bad.ids, batch[0:3]); err == nil {
+			t.Errorf("ReadBatch %s ids, expected error", bad.name)
+		}
+	}
+	store.Close()
+
+	if store, err = Open(path, 0666, options); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	defer store.Close()
+	for i := range batch {
+		batch[i] = NewHeapPage()
+	}
+	if err := store.ReadBatch(ids[0:pages/2], batch[0:pages/2]); err != nil {
+		t.Fatalf("ReadBatch after reopen, err: %s", err)
+	}
+	check(ids[0:pages/2], batch[0:pages/2], func(id PageID) []byte { return records[id] })
+	for i, id := range ids[pages/2:] {
+		if err := store.Read(id, batch[pages/2+i]); err != nil {
+			t.Fatalf("Read page %d after reopen, err: %s", id, err)
+		}
+	}
+	check(ids[pages/2:], batch[pages/2:], func(id PageID) []byte { return records[id] })
+
+	// read only stores refuse batch writes
+	ro, err := Open(path, 0666, &FileStoreOptions{ReadOnly: true, EncryptionKey: options.EncryptionKey, IOUring: options.IOUring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.WriteBatch(ids[0:1], batch[0:1]); err != ErrReadOnly {
+		t.Errorf("WriteBatch read only, expected: %s, got: %v", ErrReadOnly, err)
+	}
+}
@@ -0,0 +1,449 @@
+package dbase
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Log format.
+//
+// A file store's log is a directory of segment files, named after the LSN of their first record
+// so they sort in log order. A segment is a sequence of records, one for each page written:
+//
+//	0:8   LSN
+//	8:16  LSN of the record before, so gaps in the log can be found
+//	16:24 page ID
+//	24:28 data length
+//	28:30 flags, e.g. frameCompressed
+//	32:36 CRC-32C of the record header, bytes 0:32, and data
+//	36:   data, the page in the store's on-disk form
+//
+// Allocation pages are logged under their negative IDs, see allocationPageID. A Truncate is logged
+// as a record flagged logTruncated, with the page count the store is truncated to in place of the
+// page ID, and no data.
+//
+// A record is appended to the log, and synced, before its page is written to the store, or the
+// store is truncated. Once the log is archived, the LSN of the last record archived is kept in the
+// directory, in logArchivedFile, so the log carries on from it.
+
+const (
+	logSegmentExt      = ".wal"
+	logArchivedFile    = "archived"
+	logRecordHeaderLen = 36
+	logPrevOffset      = 8
+	logPageIDOffset    = 16
+	logLengthOffset    = 24
+	logFlagsOffset     = 28
+	logCRCOffset       = 32
+	logTruncated       = uint16(0x04) // log record flag, the store was truncated
+
+	// DefaultLogSegmentSize is the default size at which the log moves on to a new segment file
+	DefaultLogSegmentSize = int64(64 << 20)
+)
+
+var (
+	// ErrNoLog is returned by ArchiveLog when the store wasn't opened with a LogDir.
+	ErrNoLog = errors.New("File store has no log")
+	// ErrLogGap is returned by RestoreToPoint when the log doesn't follow on from the restored backups.
+	ErrLogGap = errors.New("Log doesn't follow on from the restored backups")
+	// ErrLogCorrupt is returned when a log record fails its checksum or is cut short.
+	ErrLogCorrupt = errors.New("Log record corrupt")
+	// ErrRestorePoint is returned by RestoreToPoint when the target is before the end of the backups.
+	ErrRestorePoint = errors.New("Restore point is before the end of the backups")
+)
+
+// logRecord is a decoded log record
+type logRecord struct {
+	lsn        LSN
+	prev       LSN
+	id         PageID
+	data       []byte
+	compressed bool
+	truncated  bool // a Truncate, to page count id
+}
+
+func (rec *logRecord) marshal() []byte {
+	buf := make([]byte, logRecordHeaderLen+len(rec.data))
+	binary.LittleEndian.PutUint64(buf, uint64(rec.lsn))
+	binary.LittleEndian.PutUint64(buf[logPrevOffset:], uint64(rec.prev))
+	binary.LittleEndian.PutUint64(buf[logPageIDOffset:], uint64(rec.id))
+	binary.LittleEndian.PutUint32(buf[logLengthOffset:], uint32(len(rec.data)))
+	var flags uint16
+	if rec.compressed {
+		flags |= frameCompressed
+	}
+	if rec.truncated {
+		flags |= logTruncated
+	}
+	binary.LittleEndian.PutUint16(buf[logFlagsOffset:], flags)
+	copy(buf[logRecordHeaderLen:], rec.data)
+	crc := crc32.Update(crc32.Checksum(buf[0:logCRCOffset], crcTable), crcTable, rec.data)
+	binary.LittleEndian.PutUint32(buf[logCRCOffset:], crc)
+	return buf
+}
+
+// readLogRecord reads the next record from r. Returns io.EOF at the end of the log, and
+// ErrLogCorrupt if the record is cut short or fails its checksum.
+func readLogRecord(r io.Reader) (logRecord, error) {
+	var rec logRecord
+	header := make([]byte, logRecordHeaderLen)
+	if _, err := io.ReadFull(r, header); err == io.ErrUnexpectedEOF {
+		return rec, ErrLogCorrupt
+	} else if err != nil {
+		return rec, err
+	}
+	length := binary.LittleEndian.Uint32(header[logLengthOffset:])
+	if length > uint32(maxFrameLen) {
+		return rec, ErrLogCorrupt
+	}
+	rec.data = make([]byte, length)
+	if _, err := io.ReadFull(r, rec.data); err != nil {
+		return rec, ErrLogCorrupt
+	}
+	crc := crc32.Update(crc32.Checksum(header[0:logCRCOffset], crcTable), crcTable, rec.data)
+	if crc != binary.LittleEndian.Uint32(header[logCRCOffset:]) {
+		return rec, ErrLogCorrupt
+	}
+	rec.lsn = LSN(binary.LittleEndian.Uint64(header))
+	rec.prev = LSN(binary.LittleEndian.Uint64(header[logPrevOffset:]))
+	rec.id = PageID(binary.LittleEndian.Uint64(header[logPageIDOffset:]))
+	flags := binary.LittleEndian.Uint16(header[logFlagsOffset:])
+	rec.compressed = flags&frameCompressed != 0
+	rec.truncated = flags&logTruncated != 0
+	return rec, nil
+}
+
+// pageLog is a file store's write-ahead log of page images
+type pageLog struct {
+	dir         string
+	segmentSize int64
+	file        *os.File // current segment, nil until the next record is appended
+	size        int64    // length of the current segment
+	last        LSN      // LSN of the last record logged
+	unsynced    bool     // records have been appended to the current segment since it was synced
+	archiving   sync.Mutex
+}
+
+// openLog opens the log in dir, creating dir if necessary. A record cut short at the end of the
+// last segment, by a crash, is dropped.
+func openLog(dir string, segmentSize int64) (*pageLog, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultLogSegmentSize
+	}
+	log := &pageLog{dir: dir, segmentSize: segmentSize}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	if buf, err := os.ReadFile(filepath.Join(dir, logArchivedFile)); err == nil && len(buf) == 8 {
+		log.last = LSN(binary.LittleEndian.Uint64(buf))
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	segments, err := logSegments(dir)
+	if err != nil || len(segments) == 0 {
+		return log, err
+	}
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rec, err := readLogRecord(io.NewSectionReader(file, log.size, 1<<62))
+		if err == io.EOF || err == ErrLogCorrupt {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+		log.size += logRecordHeaderLen + int64(len(rec.data))
+		log.last = rec.lsn
+	}
+	if err := file.Truncate(log.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.file = file
+	return log, nil
+}
+
+// append logs rec, following on from the last record logged. It isn't durable until sync.
+func (log *pageLog) append(rec logRecord) error {
+	if log.file == nil {
+		name := filepath.Join(log.dir, logSegmentName(rec.lsn))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		log.file, log.size = file, 0
+	}
+	rec.prev = log.last
+	buf := rec.marshal()
+	if _, err := log.file.WriteAt(buf, log.size); err != nil {
+		return err
+	}
+	log.size += int64(len(buf))
+	log.last = rec.lsn
+	log.unsynced = true
+	if log.size >= log.segmentSize {
+		return log.close()
+	}
+	return nil
+}
+
+// sync makes the records appended so far durable, before the pages they log are written.
+func (log *pageLog) sync() error {
+	if log.file == nil || !log.unsynced {
+		return nil
+	}
+	if err := log.file.Sync(); err != nil {
+		return err
+	}
+	log.unsynced = false
+	return nil
+}
+
+// close syncs and closes the current segment; the next record appended starts a new one.
+func (log *pageLog) close() error {
+	if log.file == nil {
+		return nil
+	}
+	err := log.file.Sync()
+	if cerr := log.file.Close(); err == nil {
+		err = cerr
+	}
+	log.file, log.unsynced = nil, false
+	return err
+}
+
+// logSegmentName returns the name of the segment starting with LSN lsn.
+func logSegmentName(lsn LSN) string {
+	return fmt.Sprintf("%020d%s", lsn, logSegmentExt)
+}
+
+// logSegments returns the paths of the log segments in dir, in log order.
+func logSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), logSegmentExt) {
+			segments = append(segments, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// ArchiveLog moves the log segments written so far to directory dir, creating it if necessary.
+// Archived segments, with a backup taken by BackupIncremental, are used by RestoreToPoint.
+func (store *fileStore) ArchiveLog(dir string) error {
+
+	if store.log == nil {
+		return ErrNoLog
+	}
+	store.log.archiving.Lock()
+	defer store.log.archiving.Unlock()
+
+	// the segments are listed with the log closed, so a write can't start a segment to be listed
+	// part written; only segments up to the last record logged are archived
+	store.l.Lock()
+	err := store.log.close()
+	last := store.log.last
+	var segments []string
+	if err == nil {
+		segments, err = logSegments(store.log.dir)
+	}
+	store.l.Unlock()
+	if err != nil {
+		return err
+	}
+	segments = slices.DeleteFunc(segments, func(segment string) bool {
+		return filepath.Base(segment) > logSegmentName(last)
+	})
+	if len(segments) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := copyFile(segment, filepath.Join(dir, filepath.Base(segment))); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(last))
+	if err := os.WriteFile(filepath.Join(store.log.dir, logArchivedFile), buf, 0666); err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := os.Remove(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies file src to dst, via a temporary file so dst is never left part written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// RestoreToPoint creates a new file store at path from a chain of backups, see Restore, then
+// replays the log archived in directory archive, stopping at the last record at or before target.
+// LSNAt gives the target for a point in time. Returns the LSN the store is restored to, which is
+// before target if the archive ends before it.
+func RestoreToPoint(path string, options *FileStoreOptions, archive string, target LSN, backups ...io.Reader) (LSN, error) {
+
+	store, restored, err := restoreStore(path, options, backups)
+	if err != nil {
+		return 0, err
+	}
+	if target < restored {
+		err = ErrRestorePoint
+	} else {
+		restored, err = store.replay(archive, restored, target)
+	}
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return restored, nil
+}
+
+// replay writes the pages logged in archive after LSN restored, up to LSN target, returning the
+// LSN of the last record replayed.
+func (store *fileStore) replay(archive string, restored, target LSN) (LSN, error) {
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	segments, err := logSegments(archive)
+	if err != nil {
+		return 0, err
+	}
+	readers := make([]io.Reader, len(segments))
+	for i, segment := range segments {
+		file, err := os.Open(segment)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		readers[i] = file
+	}
+	r := bufio.NewReaderSize(io.MultiReader(readers...), 16*int(PageSize))
+
+	buf := make([]byte, PageSize)
+	replayed := false
+	for {
+		rec, err := readLogRecord(r)
+		if err == io.EOF {
+			return restored, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if rec.lsn <= restored {
+			continue
+		}
+		if rec.lsn > target {
+			return restored, nil
+		}
+		// the first record replayed must follow on from the backups, the rest from the record before
+		if (!replayed && rec.prev > restored) || (replayed && rec.prev != restored) {
+			return 0, ErrLogGap
+		}
+		if err := store.applyLogRecord(&rec, buf); err != nil {
+			return 0, err
+		}
+		restored, replayed = rec.lsn, true
+	}
+}
+
+// applyLogRecord writes the page held in rec, using buf for the page image, or truncates the
+// store as rec says. An allocation page replaces the one in the store's allocation map; a page
+// added is allocated, if its allocation page, written lazily, doesn't say so yet. Caller must
+// hold store.l.
+func (store *fileStore) applyLogRecord(rec *logRecord, buf []byte) error {
+	if err := store.advanceLSN(rec.lsn); err != nil {
+		return err
+	}
+	if rec.truncated {
+		if store.alloc == nil || rec.id < 0 || int64(rec.id) > store.count {
+			return ErrBadFileFormat
+		}
+		return store.truncate(int64(rec.id))
+	}
+	if rec.id > store.lastPageID+1 {
+		return ErrBadFileFormat
+	}
+	if rec.id < 0 && (store.alloc == nil || int64(-rec.id-1)*store.alloc.span > store.count) {
+		return ErrBadFileFormat
+	}
+	if err := store.decodePage(rec.id, rec.data, rec.compressed, buf); err != nil {
+		return err
+	}
+	if err := store.writePage(rec.id, buf); err != nil {
+		return err
+	}
+	switch {
+	case rec.id < 0:
+		page := NewAllocationPage()
+		if err := page.UnmarshalBinary(buf); err != nil {
+			return err
+		}
+		store.alloc.set(int(-rec.id-1), page)
+		store.alloc.count(store.count)
+	case rec.id > store.lastPageID:
+		if store.alloc != nil && !store.alloc.isAllocated(rec.id) {
+			if err := store.alloc.allocate(rec.id, 1, store.count); err != nil {
+				return err
+			}
+		}
+		store.lastPageID++
+		store.count++
+	}
+	return nil
+}
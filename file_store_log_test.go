@@ -0,0 +1,253 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRestoreToPoint(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+	logDir := filepath.Join(dir, "log")
+	archive := filepath.Join(dir, "archive")
+	options := &FileStoreOptions{LogDir: logDir, LogSegmentSize: 1 << 20}
+
+	store, err := Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heap := NewHeap(store)
+	records := make(map[RID][]byte)
+	put := func(n int, format string) {
+		for i := 0; i < n; i++ {
+			record := []byte(fmt.Sprintf(format, i))
+			rid, err := heap.Put(record)
+			if err != nil {
+				t.Fatalf("heap.Put, err: %s", err)
+			}
+			records[rid] = record
+		}
+	}
+
+	put(2000, "before backup %d")
+	var full bytes.Buffer
+	if _, err := store.BackupIncremental(&full, 0); err != nil {
+		t.Fatalf("store.BackupIncremental, err: %s", err)
+	}
+	put(500, "after backup %d")
+	if err := store.ArchiveLog(archive); err != nil {
+		t.Fatalf("store.ArchiveLog, err: %s", err)
+	}
+
+	// the log carries on from the archive when the store is reopened
+	store.Close()
+	if store, err = Open(path, 0666, options); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	heap = NewHeap(store)
+	put(500, "after reopen %d")
+	count := heap.Count()
+	good := store.LSN()
+
+	// a bad deploy deletes some records
+	var deleted []RID
+	for rid := range records {
+		if len(deleted) == 100 {
+			break
+		}
+		if err := heap.Delete(rid); err != nil {
+			t.Fatalf("heap.Delete, err: %s", err)
+		}
+		deleted = append(deleted, rid)
+	}
+	if err := store.ArchiveLog(archive); err != nil {
+		t.Fatalf("store.ArchiveLog, err: %s", err)
+	}
+
+	restorePath := filepath.Join(dir, "restored")
+	restored, err := RestoreToPoint(restorePath, nil, archive, good, bytes.NewReader(full.Bytes()))
+	if err != nil {
+		t.Fatalf("RestoreToPoint, err: %s", err)
+	}
+	if restored > good {
+		t.Errorf("RestoreToPoint LSN, expected: <= %d, got: %d", good, restored)
+	}
+	restoredStore, err := Open(restorePath, 0666, &FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open restored, err: %s", err)
+	}
+	defer restoredStore.Close()
+	restoredHeap := NewHeap(restoredStore)
+	if restoredHeap.Count() != count {
+		t.Errorf("restored record count, expected: %d, got: %d", count, restoredHeap.Count())
+	}
+	buf := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := restoredHeap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("restoredHeap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("restoredHeap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+
+	// replaying the whole archive includes the deletes
+	latestPath := filepath.Join(dir, "latest")
+	if _, err := RestoreToPoint(latestPath, nil, archive, LSN(1<<63), bytes.NewReader(full.Bytes())); err != nil {
+		t.Fatalf("RestoreToPoint latest, err: %s", err)
+	}
+	latest, err := Open(latestPath, 0666, &FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open latest, err: %s", err)
+	}
+	defer latest.Close()
+	if n := NewHeap(latest).Count(); n != count-int64(len(deleted)) {
+		t.Errorf("latest record count, expected: %d, got: %d", count-int64(len(deleted)), n)
+	}
+
+	// a missing segment is a gap in the log
+	segments, err := logSegments(archive)
+	if err != nil || len(segments) < 3 {
+		t.Fatalf("logSegments, expected: >= 3 segments, got: %d, err: %v", len(segments), err)
+	}
+	os.Remove(segments[len(segments)-2])
+	if _, err := RestoreToPoint(filepath.Join(dir, "gap"), nil, archive, LSN(1<<63), bytes.NewReader(full.Bytes())); err != ErrLogGap {
+		t.Errorf("RestoreToPoint with a gap, expected: %v, got: %v", ErrLogGap, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gap")); !os.IsNotExist(err) {
+		t.Errorf("RestoreToPoint with a gap, expected: no file, got: %v", err)
+	}
+}
+
+func TestRestoreToPointAllocationMap(t *testing.T) {
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	store, err := Open(filepath.Join(dir, "store"), 0666, &FileStoreOptions{LogDir: filepath.Join(dir, "log"), AllocationMap: true, AllocationInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	appendPages(t, store, 3)
+	var full bytes.Buffer
+	if _, err := store.BackupIncremental(&full, 0); err != nil {
+		t.Fatalf("store.BackupIncremental, err: %s", err)
+	}
+
+	// allocation pages and the truncate are logged along with the pages
+	appendPages(t, store, 7)
+	for _, id := range []PageID{4, 8, 9} {
+		if err := store.Free(id); err != nil {
+			t.Fatalf("Free %d, err: %s", id, err)
+		}
+	}
+	if err := store.Truncate(); err != nil {
+		t.Fatalf("Truncate, err: %s", err)
+	}
+	if err := store.ArchiveLog(archive); err != nil {
+		t.Fatalf("store.ArchiveLog, err: %s", err)
+	}
+
+	restorePath := filepath.Join(dir, "restored")
+	if _, err := RestoreToPoint(restorePath, nil, archive, store.LSN(), &full); err != nil {
+		t.Fatalf("RestoreToPoint, err: %s", err)
+	}
+	restored, err := Open(restorePath, 0666, nil)
+	if err != nil {
+		t.Fatalf("Open restored, err: %s", err)
+	}
+	defer restored.Close()
+	if restored.Count() != 8 {
+		t.Errorf("restored page count, expected: 8, got: %d", restored.Count())
+	}
+	checkPages(t, restored, 4)
+}
+
+func TestArchiveLogWhileWriting(t *testing.T) {
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	store, err := Open(filepath.Join(dir, "store"), 0666, &FileStoreOptions{LogDir: filepath.Join(dir, "log"), LogSegmentSize: 1 << 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	const writers, writes = 4, 500
+	for i := 0; i < writers; i++ {
+		if _, err := store.Append(NewHeapPage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var full bytes.Buffer
+	if _, err := store.BackupIncremental(&full, 0); err != nil {
+		t.Fatalf("store.BackupIncremental, err: %s", err)
+	}
+
+	// segments are started and filled while the log is archived
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(id PageID) {
+			defer wg.Done()
+			page := NewHeapPage()
+			for i := 0; i < writes; i++ {
+				page.Clear()
+				page.AddRecord([]byte(fmt.Sprintf("page %d write %d", id, i)))
+				if err := store.Write(id, page); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(PageID(w))
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for writing := true; writing; {
+		select {
+		case <-done:
+			writing = false
+		default:
+			if err := store.ArchiveLog(archive); err != nil {
+				t.Fatalf("store.ArchiveLog, err: %s", err)
+			}
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatalf("store.Write, err: %s", err)
+	}
+	if err := store.ArchiveLog(archive); err != nil {
+		t.Fatalf("store.ArchiveLog, err: %s", err)
+	}
+
+	restorePath := filepath.Join(dir, "restored")
+	if _, err := RestoreToPoint(restorePath, nil, archive, store.LSN(), &full); err != nil {
+		t.Fatalf("RestoreToPoint, err: %s", err)
+	}
+	restored, err := Open(restorePath, 0666, &FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	page, buf := NewHeapPage(), make([]byte, PageSize)
+	for id := PageID(0); id < writers; id++ {
+		if err := restored.Read(id, page); err != nil {
+			t.Fatalf("restored.Read %d, err: %s", id, err)
+		}
+		n, err := page.GetRecord(1, buf)
+		if expected := fmt.Sprintf("page %d write %d", id, writes-1); err != nil || string(buf[0:n]) != expected {
+			t.Errorf("restored page %d, expected: %q, got: %q, err: %v", id, expected, buf[0:n], err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package dbase
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replication.
+//
+// A primary sends a follower a full backup, in the incremental backup format, followed by a
+// record for each page written after the backup started, in the log format. The follower applies
+// them to its own copy of the store, which callers can read but not write.
+
+// followerBufferLen is the number of changes a primary holds for a follower before dropping it,
+// bounding how far a follower can lag behind.
+const followerBufferLen = 1024
+
+var (
+	// ErrFollowerLagging is returned by Replicate when a follower falls too far behind.
+	ErrFollowerLagging = errors.New("Follower is too far behind the primary")
+	// ErrWaitTimeout is returned by WaitFor when the follower doesn't catch up in time.
+	ErrWaitTimeout = errors.New("Timed out waiting for follower")
+)
+
+// subscriber receives the changes made to a store, for a follower
+type subscriber struct {
+	ch chan logRecord
+}
+
+// subscribe starts sending changes to a new subscriber, which must be released with unsubscribe.
+func (store *fileStore) subscribe() *subscriber {
+	store.l.Lock()
+	defer store.l.Unlock()
+	sub := &subscriber{ch: make(chan logRecord, followerBufferLen)}
+	store.subscribers = append(store.subscribers, sub)
+	return sub
+}
+
+// unsubscribe stops sending changes to sub.
+func (store *fileStore) unsubscribe(sub *subscriber) {
+	store.l.Lock()
+	defer store.l.Unlock()
+	store.dropSubscriber(sub)
+}
+
+// dropSubscriber stops sending changes to sub and closes its channel. Caller must hold store.l.
+func (store *fileStore) dropSubscriber(sub *subscriber) {
+	for i, s := range store.subscribers {
+		if s == sub {
+			store.subscribers = append(store.subscribers[:i], store.subscribers[i+1:]...)
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// publish sends rec to the subscribers, dropping any that have fallen behind. Caller must hold store.l.
+func (store *fileStore) publish(rec logRecord) {
+	if len(store.subscribers) == 0 {
+		return
+	}
+	rec.data = append([]byte(nil), rec.data...)
+	for _, sub := range append([]*subscriber(nil), store.subscribers...) {
+		select {
+		case sub.ch <- rec:
+		default:
+			store.dropSubscriber(sub)
+		}
+	}
+}
+
+// Replicate sends a follower, see OpenFollower, a copy of the store over conn, then the changes
+// made to it until conn fails, the follower goes away, or it falls too far behind. Replicate
+// closes conn when it returns.
+func (store *fileStore) Replicate(conn net.Conn) error {
+
+	defer conn.Close()
+	sub := store.subscribe()
+	defer store.unsubscribe(sub)
+
+	// notice the follower going away while there's nothing to send it
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	upto, err := store.BackupIncremental(conn, 0)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(conn, 16*int(PageSize))
+	for {
+		var rec logRecord
+		var ok bool
+		select {
+		case rec, ok = <-sub.ch:
+		case <-gone:
+			return io.EOF
+		}
+		if !ok {
+			return ErrFollowerLagging
+		}
+		if rec.lsn <= upto {
+			continue // already in the backup
+		}
+		if _, err := bw.Write(rec.marshal()); err != nil {
+			return err
+		}
+		if len(sub.ch) == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Follower is a read only copy of a file store, kept up to date by the primary store. Heaps on a
+// follower see the primary's changes through Get, scans and Count, whether opened before or after
+// the changes are applied.
+type Follower interface {
+	FileStore
+	// WaitFor blocks until the follower has the primary's changes up to lsn, replication stops, or timeout passes.
+	WaitFor(lsn LSN, timeout time.Duration) error
+	// Err returns the error that stopped replication, or nil while it is running.
+	Err() error
+}
+
+// follower is the concrete implementation for Follower - internal use only
+type follower struct {
+	*fileStore
+	conn     net.Conn
+	replayed bool          // a change has been applied since the backup
+	mu       sync.Mutex    // guards err and applied
+	err      error         // why replication stopped
+	applied  chan struct{} // closed, and replaced, each time a change is applied
+	done     chan struct{} // closed when replication stops
+}
+
+// OpenFollower creates a follower at path, a new file, from the primary store at the other end
+// of conn, see FileStore.Replicate. It returns once the follower has a copy of the primary, then
+// keeps it up to date until Close. Options give the encryption key, if the primary is encrypted.
+func OpenFollower(path string, options *FileStoreOptions, conn net.Conn) (Follower, error) {
+
+	r := bufio.NewReaderSize(conn, 16*int(PageSize))
+	store, restored, err := restoreStore(path, options, []io.Reader{r})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	store.l.Lock()
+	store.readOnly = true
+	store.lsn = restored
+	store.l.Unlock()
+
+	f := &follower{
+		fileStore: store,
+		conn:      conn,
+		applied:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go f.follow(r)
+	return f, nil
+}
+
+// follow applies the changes sent by the primary until replication stops.
+func (f *follower) follow(r io.Reader) {
+	defer close(f.done)
+	buf := make([]byte, PageSize)
+	for {
+		rec, err := readLogRecord(r)
+		if err == nil {
+			err = f.apply(&rec, buf)
+		}
+		f.mu.Lock()
+		if err != nil {
+			f.err = err
+		}
+		close(f.applied)
+		f.applied = make(chan struct{})
+		f.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// apply writes the page held in rec.
+func (f *follower) apply(rec *logRecord, buf []byte) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	// the first change must follow on from the backup, the rest from the change before
+	if (!f.replayed && rec.prev > f.lsn) || (f.replayed && rec.prev != f.lsn) {
+		return ErrLogGap
+	}
+	if err := f.applyLogRecord(rec, buf); err != nil {
+		return err
+	}
+	f.lsn, f.replayed = rec.lsn, true
+	return nil
+}
+
+// WaitFor blocks until the follower has the primary's changes up to lsn.
+func (f *follower) WaitFor(lsn LSN, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.mu.Lock()
+		applied, err := f.applied, f.err
+		f.mu.Unlock()
+		if f.LSN() >= lsn {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-applied:
+		case <-timer.C:
+			return ErrWaitTimeout
+		}
+	}
+}
+
+// Err returns the error that stopped replication.
+func (f *follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close stops replication and closes the follower's store.
+func (f *follower) Close() error {
+	f.conn.Close()
+	<-f.done
+	return f.fileStore.Close()
+}
@@ -0,0 +1,247 @@
+package dbase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFollower opens a follower of primary at path, over a local connection, returning it and a
+// channel that receives the error Replicate returns.
+func startFollower(t *testing.T, primary FileStore, path string, options *FileStoreOptions) (Follower, chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	replicated := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			replicated <- err
+			return
+		}
+		replicated <- primary.Replicate(conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := OpenFollower(path, options, conn)
+	if err != nil {
+		t.Fatalf("OpenFollower, err: %s", err)
+	}
+	return follower, replicated
+}
+
+func TestReplication(t *testing.T) {
+
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{3}, 32)
+	primary, err := Open(filepath.Join(dir, "primary"), 0666, &FileStoreOptions{Compress: true, EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	heap := NewHeap(primary)
+	records := make(map[RID][]byte)
+	put := func(n int, format string) {
+		for i := 0; i < n; i++ {
+			record := []byte(fmt.Sprintf(format, i))
+			rid, err := heap.Put(record)
+			if err != nil {
+				t.Fatalf("heap.Put, err: %s", err)
+			}
+			records[rid] = record
+		}
+	}
+	put(2000, "before follower %d")
+
+	follower, replicated := startFollower(t, primary, filepath.Join(dir, "follower"), &FileStoreOptions{EncryptionKey: key})
+
+	put(2000, "after follower %d")
+	for rid := range records {
+		if len(records) <= 3900 {
+			break
+		}
+		if err := heap.Delete(rid); err != nil {
+			t.Fatalf("heap.Delete, err: %s", err)
+		}
+		delete(records, rid)
+	}
+	if err := follower.WaitFor(primary.LSN(), 5*time.Second); err != nil {
+		t.Fatalf("follower.WaitFor, err: %s", err)
+	}
+
+	followerHeap := NewHeap(follower)
+	buf := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := followerHeap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("followerHeap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("followerHeap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+	scanned := 0
+	scanner := NewHeapScanner(followerHeap)
+	for {
+		if _, _, err := scanner.Next(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		scanned++
+	}
+	if scanned != len(records) {
+		t.Errorf("follower scan, expected: %d records, got: %d", len(records), scanned)
+	}
+
+	if _, err := follower.New(); err != ErrReadOnly {
+		t.Errorf("follower.New, expected: %v, got: %v", ErrReadOnly, err)
+	}
+
+	if err := follower.Close(); err != nil {
+		t.Errorf("follower.Close, err: %s", err)
+	}
+	select {
+	case <-replicated:
+	case <-time.After(5 * time.Second):
+		t.Errorf("primary.Replicate didn't return after the follower closed")
+	}
+}
+
+func TestReplicationHeapOpenedEarly(t *testing.T) {
+
+	dir := t.TempDir()
+	primary, err := Open(filepath.Join(dir, "primary"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	heap := NewHeap(primary)
+	if _, err := heap.Put([]byte("before follower")); err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+
+	follower, _ := startFollower(t, primary, filepath.Join(dir, "follower"), nil)
+	defer follower.Close()
+	followerHeap := NewHeap(follower)
+	if followerHeap.Count() != 1 {
+		t.Fatalf("followerHeap.Count, expected: 1, got: %d", followerHeap.Count())
+	}
+
+	// the heap is opened on the follower before it catches up with these, and read after
+	var rids []RID
+	for i := 0; i < 300; i++ {
+		rid, err := heap.Put([]byte(fmt.Sprintf("after follower %d", i)))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	if err := follower.WaitFor(primary.LSN(), 5*time.Second); err != nil {
+		t.Fatalf("follower.WaitFor, err: %s", err)
+	}
+
+	if followerHeap.Count() != 301 {
+		t.Errorf("followerHeap.Count, expected: 301, got: %d", followerHeap.Count())
+	}
+	buf := make([]byte, maxRecordLen)
+	for i, rid := range rids {
+		n, err := followerHeap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("followerHeap.Get %v, err: %s", rid, err)
+		}
+		if want := fmt.Sprintf("after follower %d", i); string(buf[0:n]) != want {
+			t.Fatalf("followerHeap.Get %v, expected: %s, got: %s", rid, want, buf[0:n])
+		}
+	}
+	scanned := 0
+	scanner := NewHeapScanner(followerHeap)
+	for {
+		if _, _, err := scanner.Next(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		scanned++
+	}
+	if scanned != 301 {
+		t.Errorf("follower scan, expected: 301 records, got: %d", scanned)
+	}
+}
+
+func TestReplicationAllocationMap(t *testing.T) {
+
+	key := bytes.Repeat([]byte{5}, 32)
+	for _, options := range []*FileStoreOptions{
+		{AllocationMap: true, AllocationInterval: 4},
+		{AllocationMap: true, AllocationInterval: 4, Compress: true, EncryptionKey: key},
+	} {
+		t.Run(fmt.Sprintf("compress %t", options.Compress), func(t *testing.T) {
+			dir := t.TempDir()
+			primary, err := Open(filepath.Join(dir, "primary"), 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer primary.Close()
+			appendPages(t, primary, 6)
+			if err := primary.Free(2); err != nil {
+				t.Fatalf("Free, err: %s", err)
+			}
+
+			follower, _ := startFollower(t, primary, filepath.Join(dir, "follower"), &FileStoreOptions{EncryptionKey: options.EncryptionKey})
+			defer follower.Close()
+
+			// the pages added go past two more allocation pages, each written as it is started
+			appendPages(t, primary, 10)
+			for _, id := range []PageID{7, 11} {
+				if err := primary.Free(id); err != nil {
+					t.Fatalf("Free %d, err: %s", id, err)
+				}
+			}
+			if id, err := primary.New(); err != nil || id != 2 {
+				t.Fatalf("New, expected: page 2, got: %d, err: %v", id, err)
+			}
+			page := NewHeapPage()
+			page.AddRecord([]byte("page 2"))
+			if err := primary.Write(2, page); err != nil {
+				t.Fatalf("Write, err: %s", err)
+			}
+
+			if err := follower.WaitFor(primary.LSN(), 5*time.Second); err != nil {
+				t.Fatalf("follower.WaitFor, err: %s", err)
+			}
+			if follower.Count() != primary.Count() {
+				t.Errorf("follower page count, expected: %d, got: %d", primary.Count(), follower.Count())
+			}
+			checkPages(t, follower, 7, 11)
+
+			// the follower drops the pages the primary truncates
+			for _, id := range []PageID{14, 15} {
+				if err := primary.Free(id); err != nil {
+					t.Fatalf("Free %d, err: %s", id, err)
+				}
+			}
+			if err := primary.Truncate(); err != nil {
+				t.Fatalf("Truncate, err: %s", err)
+			}
+			if err := follower.WaitFor(primary.LSN(), 5*time.Second); err != nil {
+				t.Fatalf("follower.WaitFor, err: %s", err)
+			}
+			if follower.Count() != 14 {
+				t.Errorf("follower page count after truncate, expected: 14, got: %d", follower.Count())
+			}
+			checkPages(t, follower, 7, 11)
+		})
+	}
+}
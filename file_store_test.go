@@ -2,9 +2,13 @@ package dbase
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	randstr "github.com/trpedersen/rand"
 )
 
 // Ensure that a file store can be opened without error.
@@ -177,3 +181,316 @@ func tempfile() string {
 	}
 	return f.Name()
 }
+
+func TestCompressedStore(t *testing.T) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, &FileStoreOptions{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	heap := NewHeap(store)
+	records := make(map[RID][]byte)
+	for i := 0; i < 2000; i++ {
+		record := []byte(fmt.Sprintf("record %d, mostly whitespace%s", i, bytes.Repeat([]byte(" "), 60)))
+		rid, err := heap.Put(record)
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = record
+	}
+	// grow a page past its frame with incompressible records, so it moves to a new frame
+	var grown RID
+	for rid := range records {
+		grown = rid
+		break
+	}
+	noise := []byte(randstr.RandStr(3000, "alphanum"))
+	if err := heap.Set(grown, noise); err != nil {
+		t.Fatalf("heap.Set, err: %s", err)
+	}
+	records[grown] = noise
+
+	count := store.Count()
+	store.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= count*int64(PageSize) {
+		t.Errorf("compressed file size, expected: < %d, got: %d", count*int64(PageSize), fi.Size())
+	}
+
+	// reopen without options, the file header records the format
+	if store, err = Open(path, 0666, nil); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	defer store.Close()
+	if store.Count() != count {
+		t.Fatalf("page count, expected: %d, got: %d", count, store.Count())
+	}
+	heap = NewHeap(store)
+	buf := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0x5a}, 32)
+
+	for _, compress := range []bool{false, true} {
+		path := tempfile()
+		store, err := Open(path, 0666, &FileStoreOptions{EncryptionKey: key, Compress: compress})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		secret := []byte("customer credit card number 4111 1111 1111 1111")
+		heap := NewHeap(store)
+		var rids []RID
+		for i := 0; i < 500; i++ {
+			rid, err := heap.Put(secret)
+			if err != nil {
+				t.Fatalf("heap.Put, err: %s", err)
+			}
+			rids = append(rids, rid)
+		}
+		store.Close()
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, secret) {
+			t.Fatalf("compress: %v, plaintext record found in encrypted file", compress)
+		}
+
+		if _, err := Open(path, 0666, nil); err != ErrEncryptionKey {
+			t.Errorf("Open without key, expected: ErrEncryptionKey, got: %v", err)
+		}
+		if _, err := Open(path, 0666, &FileStoreOptions{EncryptionKey: bytes.Repeat([]byte{0xa5}, 32)}); err != ErrEncryptionKey {
+			t.Errorf("Open with wrong key, expected: ErrEncryptionKey, got: %v", err)
+		}
+
+		if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: key}); err != nil {
+			t.Fatalf("Open with key, err: %s", err)
+		}
+		heap = NewHeap(store)
+		buf := make([]byte, maxRecordLen)
+		for _, rid := range rids {
+			n, err := heap.Get(rid, buf)
+			if err != nil {
+				t.Fatalf("heap.Get %v, err: %s", rid, err)
+			}
+			if !bytes.Equal(secret, buf[0:n]) {
+				t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, secret, buf[0:n])
+			}
+		}
+		store.Close()
+	}
+}
+
+func TestCompressedEncryptedReopen(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0x3c}, 32)
+	path := filepath.Join(t.TempDir(), "store")
+	options := &FileStoreOptions{Compress: true, EncryptionKey: key}
+	store, err := Open(path, 0666, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPages(t, store, 10)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed cleanly, the file has a frame index, whose frames' ID doesn't open the key check
+	if store, err = Open(path, 0666, &FileStoreOptions{Compress: true, EncryptionKey: key, ReadOnly: true}); err != nil {
+		t.Fatalf("Open read only, err: %s", err)
+	}
+	fs := store.(*fileStore)
+	if fs.header.index == 0 {
+		t.Errorf("frame index, expected: one, got: none")
+	}
+	if _, err := fs.sealer.open(frameIndexID, fs.header.keyCheck); err == nil {
+		t.Errorf("key check opened with frameIndexID, expected: PageAuthenticationFailed, got: nil")
+	}
+	store.Close()
+
+	if store, err = Open(path, 0666, options); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	defer store.Close()
+	if store.Count() != 10 {
+		t.Fatalf("store.Count, expected: 10, got: %d", store.Count())
+	}
+	checkPages(t, store)
+	if _, err := Open(path, 0666, &FileStoreOptions{Compress: true, EncryptionKey: bytes.Repeat([]byte{0xc3}, 32)}); err != ErrEncryptionKey {
+		t.Errorf("Open with wrong key, expected: ErrEncryptionKey, got: %v", err)
+	}
+}
+
+func TestEncryptedStoreSwappedPages(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0x5a}, 16)
+	path := tempfile()
+	store, err := Open(path, 0666, &FileStoreOptions{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	for i := 0; i < 3; i++ {
+		if _, err := store.Append(NewHeapPage()); err != nil {
+			t.Fatalf("store.Append, err: %s", err)
+		}
+	}
+	store.Close()
+
+	// copy page 2 over page 1
+	raw, _ := os.ReadFile(path)
+	slotLen := int64(PageSize) + sealedOverhead
+	copy(raw[fileHeaderLen+slotLen:], raw[fileHeaderLen+2*slotLen:fileHeaderLen+3*slotLen])
+	if err := os.WriteFile(path, raw, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err = Open(path, 0666, &FileStoreOptions{EncryptionKey: key}); err != nil {
+		t.Fatalf("Open, err: %s", err)
+	}
+	defer store.Close()
+	if err := store.Read(2, NewHeapPage()); err != nil {
+		t.Fatalf("store.Read untouched page, err: %s", err)
+	}
+	err = store.Read(1, NewHeapPage())
+	if _, ok := err.(PageAuthenticationFailed); !ok {
+		t.Fatalf("store.Read swapped page, expected: PageAuthenticationFailed, got: %v", err)
+	}
+}
+
+func TestEncryptionKeyCheckID(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	s, err := newSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := s.keyCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key check is sealed apart from every page and allocation page
+	for _, id := range []PageID{0, allocationPageID(0), allocationPageID(allocationPageSpan)} {
+		if _, err := s.open(id, check); err == nil {
+			t.Errorf("key check opened as page %d", id)
+		}
+	}
+	if err := s.checkKey(check, false); err != nil {
+		t.Errorf("checkKey, err: %s", err)
+	}
+
+	// files created before allocation pages sealed the key check as page -1
+	legacy, err := s.seal(legacyKeyCheckID, make([]byte, keyCheckLen-sealedOverhead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkKey(legacy, true); err != nil {
+		t.Errorf("checkKey legacy, err: %s", err)
+	}
+	if err := s.checkKey(legacy, false); err != ErrEncryptionKey {
+		t.Errorf("checkKey legacy in a file with an allocation map, expected: ErrEncryptionKey, got: %v", err)
+	}
+}
+
+func TestLSNReopen(t *testing.T) {
+
+	for _, options := range []*FileStoreOptions{nil, {Compress: true}} {
+		t.Run(fmt.Sprintf("compress %t", options != nil), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store")
+			store, err := Open(path, 0666, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendPages(t, store, 3)
+			// pages stamped ahead of the clock, as when the clock is set back after they are written
+			ahead := LSN(time.Now().Add(time.Hour).UnixNano())
+			store.(*fileStore).lsn = ahead
+			appendPages(t, store, 1)
+			last := store.LSN()
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if store, err = Open(path, 0666, options); err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if store.LSN() < last {
+				t.Errorf("reopened LSN, expected: >= %d, got: %d", last, store.LSN())
+			}
+			appendPages(t, store, 1)
+			page := newRawPage()
+			if err := store.Read(4, page); err != nil {
+				t.Fatal(err)
+			}
+			if lsn := pageLSN(page.bytes); lsn <= last {
+				t.Errorf("page LSN after reopen, expected: > %d, got: %d", last, lsn)
+			}
+		})
+	}
+}
+
+func TestLSNHeader(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+	store, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPages(t, store, 3)
+	last := store.LSN()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file without options keeps its LSN in a header
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header fileHeader
+	if err := header.unmarshal(raw); err != nil {
+		t.Fatalf("header.unmarshal, err: %s", err)
+	}
+	if header.version != 4 || header.flags != 0 || header.lsn < last {
+		t.Errorf("header, expected: version 4, no flags, LSN >= %d, got: version %d, flags %#x, LSN %d", last, header.version, header.flags, header.lsn)
+	}
+
+	// a plain file, without a header, from before one was given to every file, is read for its LSN
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, raw[fileHeaderLen:], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = Open(plain, 0666, &FileStoreOptions{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Count() != 3 {
+		t.Errorf("plain file count, expected: 3, got: %d", store.Count())
+	}
+	if store.LSN() < last {
+		t.Errorf("plain file LSN, expected: >= %d, got: %d", last, store.LSN())
+	}
+}
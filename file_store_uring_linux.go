@@ -0,0 +1,258 @@
+//go:build linux
+
+package dbase
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// io_uring, see io_uring(7). The ring is set up with raw syscalls, so there are no cgo or module
+// dependencies; the numbers are the same on every Linux architecture.
+
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringEnterGetEvents = 1
+
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+
+	sqeLen = 64
+	cqeLen = 16
+
+	uringEntries = 64 // submission queue entries; larger batches are submitted in turn
+)
+
+// ioURingParams is struct io_uring_params.
+type ioURingParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+// uring is an io_uring instance, shared by every batch read and write of a file store. Batches
+// are submitted one at a time.
+type uring struct {
+	l       sync.Mutex
+	err     error // set if the ring failed; every later batch fails with it
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqes    []byte
+	entries uint32
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []byte
+}
+
+// newURing sets up an io_uring, or returns an error if the kernel doesn't allow it.
+func newURing() (*uring, error) {
+	var params ioURingParams
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd), entries: params.sqEntries}
+
+	var err error
+	sqRingLen := int(params.sqOff.array + params.sqEntries*4)
+	cqRingLen := int(params.cqOff.cqes + params.cqEntries*cqeLen)
+	prot, flags := syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSQRing, sqRingLen, prot, flags); err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCQRing, cqRingLen, prot, flags); err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, ioringOffSQEs, int(params.sqEntries)*sqeLen, prot, flags); err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array])), params.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = r.cqRing[params.cqOff.cqes:]
+	return r, nil
+}
+
+// close releases the ring; later batches fail with os.ErrClosed.
+func (r *uring) close() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.err == os.ErrClosed {
+		return nil
+	}
+	for _, m := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+	r.sqes, r.cqRing, r.sqRing = nil, nil, nil
+	r.err = os.ErrClosed
+	return syscall.Close(r.fd)
+}
+
+func (r *uring) readAt(file *os.File, reqs []ioRequest) error {
+	return r.do(ioringOpRead, file, reqs)
+}
+
+func (r *uring) writeAt(file *os.File, reqs []ioRequest) error {
+	return r.do(ioringOpWrite, file, reqs)
+}
+
+// do submits reqs as op, a read or write, in batches of up to the ring size, waits for each batch
+// to complete, and returns the first error. Transfers the kernel leaves short are finished with
+// ReadAt or WriteAt, which report why.
+func (r *uring) do(op byte, file *os.File, reqs []ioRequest) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	fd := int32(file.Fd())
+	for rest := reqs; len(rest) > 0; {
+		n := min(uint32(len(rest)), r.entries)
+		batch := rest[:n]
+		rest = rest[n:]
+
+		tail := atomic.LoadUint32(r.sqTail)
+		for i := range batch {
+			idx := (tail + uint32(i)) & r.sqMask
+			sqe := r.sqes[idx*sqeLen : (idx+1)*sqeLen]
+			clear(sqe)
+			sqe[0] = op
+			*(*int32)(unsafe.Pointer(&sqe[4])) = fd
+			*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(batch[i].offset)
+			*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(unsafe.SliceData(batch[i].buf))))
+			*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(batch[i].buf))
+			*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(i)
+			r.sqArray[idx] = idx
+		}
+		atomic.StoreUint32(r.sqTail, tail+n)
+
+		for toSubmit, done := n, uint32(0); done < n; {
+			submitted, err := r.enter(toSubmit, 1)
+			if err != nil {
+				// the ring can't be trusted with another batch, so it fails from now on, but the
+				// entries already submitted still hold their buffers until they complete
+				r.err = err
+				r.drain(batch, n-toSubmit-done)
+				for i := range reqs {
+					if !reqs[i].done {
+						reqs[i].err = err
+					}
+				}
+				return err
+			}
+			toSubmit -= submitted
+			done += r.reap(batch)
+		}
+		runtime.KeepAlive(batch)
+	}
+	runtime.KeepAlive(file)
+
+	for i := range reqs {
+		req := &reqs[i]
+		if errno, ok := req.err.(syscall.Errno); ok {
+			opName := "read"
+			if op == ioringOpWrite {
+				opName = "write"
+			}
+			req.err = &os.PathError{Op: opName, Path: file.Name(), Err: errno}
+		}
+		if req.err != nil || req.n == len(req.buf) {
+			continue
+		}
+		var n int
+		if op == ioringOpRead {
+			n, req.err = file.ReadAt(req.buf[req.n:], req.offset+int64(req.n))
+		} else {
+			n, req.err = file.WriteAt(req.buf[req.n:], req.offset+int64(req.n))
+		}
+		req.n += n
+	}
+	return firstRequestErr(reqs)
+}
+
+// enter submits toSubmit entries and waits for at least minComplete completions, retrying if
+// interrupted, and returns the number of entries submitted.
+func (r *uring) enter(toSubmit, minComplete uint32) (uint32, error) {
+	for {
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), ioringEnterGetEvents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, os.NewSyscallError("io_uring_enter", errno)
+		}
+		return uint32(n), nil
+	}
+}
+
+// drain waits for the completion of the inFlight entries of batch that have been submitted but
+// not reaped, so the kernel has finished with their buffers. If the ring can't be waited on, the
+// completions are polled for.
+func (r *uring) drain(batch []ioRequest, inFlight uint32) {
+	for inFlight > 0 {
+		if _, err := r.enter(0, 1); err != nil {
+			time.Sleep(time.Millisecond)
+		}
+		inFlight -= r.reap(batch)
+	}
+}
+
+// reap consumes the completions available, recording each result in batch, and returns the
+// number consumed.
+func (r *uring) reap(batch []ioRequest) uint32 {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for i := head; i != tail; i++ {
+		cqe := r.cqes[(i&r.cqMask)*cqeLen:]
+		req := &batch[*(*uint64)(unsafe.Pointer(&cqe[0]))]
+		if res := *(*int32)(unsafe.Pointer(&cqe[8])); res < 0 {
+			req.err = syscall.Errno(-res)
+		} else {
+			req.n = int(res)
+		}
+		req.done = true
+	}
+	atomic.StoreUint32(r.cqHead, tail)
+	return tail - head
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package dbase
+
+import (
+	"errors"
+	"os"
+)
+
+// uring is only available on Linux.
+type uring struct{}
+
+func newURing() (*uring, error) {
+	return nil, errors.New("io_uring is only available on Linux")
+}
+
+func (r *uring) readAt(file *os.File, reqs []ioRequest) error  { return errors.ErrUnsupported }
+func (r *uring) writeAt(file *os.File, reqs []ioRequest) error { return errors.ErrUnsupported }
+func (r *uring) close() error                                  { return nil }
@@ -1,9 +1,11 @@
 package dbase
 
 import (
+	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"time"
 )
 
 // Heap is a record-oriented data structure, storing records in HeapPages that are read & written to a PageStore
@@ -13,225 +15,575 @@ type Heap interface {
 	Get(rid RID, buf []byte) (int, error)
 	Set(rid RID, buf []byte) error
 	Delete(rid RID) error
+	PutBatch(bufs [][]byte) ([]RID, error)
+	GetBatch(rids []RID, bufs [][]byte) ([]int, error)
+	DeleteBatch(rids []RID) error
+	// The Context variants return ctx.Err() if ctx is done while waiting for the heap or between
+	// page reads and writes. Once a single record operation starts changing pages it runs to
+	// completion, so the heap stays consistent; batches stop between pages.
+	PutContext(ctx context.Context, buf []byte) (RID, error)
+	GetContext(ctx context.Context, rid RID, buf []byte) (int, error)
+	SetContext(ctx context.Context, rid RID, buf []byte) error
+	DeleteContext(ctx context.Context, rid RID) error
+	PutBatchContext(ctx context.Context, bufs [][]byte) ([]RID, error)
+	GetBatchContext(ctx context.Context, rids []RID, bufs [][]byte) ([]int, error)
+	DeleteBatchContext(ctx context.Context, rids []RID) error
 	Clear() error
 	Statistics() string
+	Stats() HeapStats
+	// FreeSpace reads every page of the store, so isn't part of Stats
+	FreeSpace() (pages int64, free int64)
 	//Scanner() HeapScanner
 	Store() PageStore
 }
 
+// HeapOptions is used to control a heap
+type HeapOptions struct {
+	// Compress records on Put & Set. Records that don't get smaller are stored as is,
+	// and compressed records are read back regardless of this setting.
+	Compress bool
+	// CompressionLevel is a compress/flate level, e.g. flate.BestSpeed
+	CompressionLevel int
+	// SlotVersions is the number of records a slot holds in turn, a deleted record's slot being
+	// reused for a later Put, before the slot is retired. Each record's RID carries the slot's
+	// version, so a RID to a deleted record isn't taken for the record that reused its slot.
+	// 0 is the most a slot's version allows, 256; 1 never reuses slots.
+	SlotVersions int
+}
+
+// DefaultHeapOptions - no compression
+var DefaultHeapOptions = &HeapOptions{
+	Compress:         false,
+	CompressionLevel: flate.DefaultCompression,
+}
+
 type heap struct {
-	l          *sync.Mutex
+	l          *ctxMutex
 	store      PageStore
 	headerPage HeapHeaderPage
 	lastPage   HeapPage
-	pagePool   *sync.Pool
-	writes     int
-	gets       int
-	sets       int
-	deletes    int
+	lastDirty  bool // lastPage has changes not yet written to the store
+	pagePool   *countingPool
+	compressor *compressor // nil if records aren't compressed
+	maxVersion byte        // slots deleted at this version are retired, see HeapOptions.SlotVersions
+	counters   heapCounters
 }
 
-// NewHeap returns a new Heap
+// slotVersionLimit returns the version at which a slot deleted is retired, for
+// HeapOptions.SlotVersions n.
+func slotVersionLimit(n int) (byte, error) {
+	if n < 0 || n > maxSlotVersion+1 {
+		return 0, fmt.Errorf("SlotVersions %d out of range 0-%d", n, maxSlotVersion+1)
+	}
+	if n == 0 {
+		return maxSlotVersion, nil
+	}
+	return byte(n - 1), nil
+}
+
+// NewHeap returns the heap in store, see OpenHeap.
+//
+// Deprecated: NewHeap panics if the heap can't be opened; use OpenHeap.
 func NewHeap(store PageStore) Heap {
+	return NewHeapWithOptions(store, nil)
+}
+
+// NewHeapWithOptions returns the heap in store, see OpenHeapWithOptions.
+//
+// Deprecated: NewHeapWithOptions panics if the heap can't be opened; use OpenHeapWithOptions.
+func NewHeapWithOptions(store PageStore, options *HeapOptions) Heap {
+	heap, err := OpenHeapWithOptions(store, options)
+	if err != nil {
+		panic(fmt.Sprintf("NewHeap, err: %s", err))
+	}
+	return heap
+}
+
+// OpenHeap returns the heap in store, initialising a new heap if the store is empty.
+func OpenHeap(store PageStore) (Heap, error) {
+	return OpenHeapWithOptions(store, nil)
+}
+
+// OpenHeapWithOptions returns the heap in store, initialising a new heap if the store is empty,
+// using options to control compression and slot reuse. Returns ErrWrongPageType if the store
+// doesn't hold a heap.
+func OpenHeapWithOptions(store PageStore, options *HeapOptions) (Heap, error) {
+	if options == nil {
+		options = DefaultHeapOptions
+	}
+	maxVersion, err := slotVersionLimit(options.SlotVersions)
+	if err != nil {
+		return nil, err
+	}
 	heap := &heap{
-		l:     &sync.Mutex{},
+		l:     newCtxMutex(),
 		store: store,
 		//dir:        dir,
 		headerPage: NewHeapHeaderPage(),
-		lastPage:   NewHeapPage(),
-		pagePool: &sync.Pool{
-			New: func() any {
-				return NewHeapPage()
-			},
-		},
+		lastPage:   newHeapPage(maxVersion),
+		maxVersion: maxVersion,
+		pagePool: newCountingPool(func() any {
+			return newHeapPage(maxVersion)
+		}),
 	}
-	var err error
 
-	if store.Count() == 0 {
-		// new store, initialise with header
-		_, err = store.Append(heap.headerPage)
-		if err != nil {
-			panic(fmt.Sprintf("NewHeap init, err: %s", err))
+	if options.Compress {
+		if heap.compressor, err = newCompressor(options.CompressionLevel); err != nil {
+			return nil, err
 		}
-		var id PageID
-		id, err = store.Append(heap.lastPage)
-		if err != nil {
-			panic(fmt.Sprintf("NewHeap init, err: %s", err))
-		}
-		heap.headerPage.SetLastPageID(id)
-		if err := store.Write(0, heap.headerPage); err != nil {
-			panic(fmt.Sprintf("NewHeap, err: %s", err))
+	}
+
+	if store.Count() == 0 {
+		if err := heap.initialise(); err != nil {
+			return nil, err
 		}
 	}
 	// get the header page
 	if err := store.Read(0, heap.headerPage); err != nil {
-		panic(fmt.Sprintf("NewHeap, err: %s", err))
+		return nil, err
 	}
 	// get the last page
 	if err := heap.store.Read(heap.headerPage.GetLastPageID(), heap.lastPage); err != nil {
-		panic(fmt.Sprintf("NewHeap, err: %s", err))
+		return nil, err
 	}
 
-	return heap
+	return heap, nil
 }
 
+// initialise writes a new heap header page and empty last page to an empty store.
+func (heap *heap) initialise() error {
+	if _, err := heap.store.Append(heap.headerPage); err != nil {
+		return err
+	}
+	id, err := heap.store.Append(heap.lastPage)
+	if err != nil {
+		return err
+	}
+	heap.headerPage.SetLastPageID(id)
+	return heap.store.Write(0, heap.headerPage)
+}
+
+// Clear empties the heap, starting again from its first page.
 func (heap *heap) Clear() error {
 
 	heap.l.Lock()
 	defer heap.l.Unlock()
 
 	heap.headerPage = NewHeapHeaderPage()
-	heap.lastPage = NewHeapPage()
-
-	var err error
+	heap.lastPage = newHeapPage(heap.maxVersion)
+	heap.lastDirty = false
 
 	if heap.store.Count() == 0 {
-		// new store, initialise with header
-		_, err = heap.store.Append(heap.headerPage)
-		if err != nil {
-			panic(fmt.Sprintf("NewHeap init, err: %s", err))
-		}
-		var id PageID
-		id, err = heap.store.Append(heap.lastPage)
-		if err != nil {
-			panic(fmt.Sprintf("NewHeap init, err: %s", err))
-		}
-		heap.headerPage.SetLastPageID(id)
-		if err := heap.store.Write(0, heap.headerPage); err != nil {
-			panic(fmt.Sprintf("NewHeap, err: %s", err))
+		if err := heap.initialise(); err != nil {
+			return err
 		}
 	}
 	// set the header page
 	if err := heap.store.Write(0, heap.headerPage); err != nil {
-		panic(fmt.Sprintf("NewHeap, err: %s", err))
+		return err
 	}
 	// set the last page
-	if err := heap.store.Write(heap.headerPage.GetLastPageID(), heap.lastPage); err != nil {
-		panic(fmt.Sprintf("NewHeap, err: %s", err))
-	}
-
-	return nil
+	return heap.store.Write(heap.headerPage.GetLastPageID(), heap.lastPage)
 }
 
 func (heap *heap) Store() PageStore {
 	return heap.store
 }
 
-// Count returns the number of records in the Heap.
+// Count returns the number of records in the Heap. On a Follower the header page is read each
+// time, as the primary's changes to it are applied.
 func (heap *heap) Count() int64 {
+	if follower, ok := heap.store.(Follower); ok {
+		header := NewHeapHeaderPage()
+		if err := follower.Read(0, header); err == nil {
+			return header.GetRecordCount()
+		}
+	}
 	return heap.headerPage.GetRecordCount()
 }
 
 func (heap *heap) Put(buf []byte) (RID, error) {
+	return heap.PutContext(context.Background(), buf)
+}
 
-	heap.l.Lock()
+// PutContext is Put, giving up if ctx is done before the record is added.
+func (heap *heap) PutContext(ctx context.Context, buf []byte) (RID, error) {
+	defer heap.counters.putLatency.since(time.Now())
+
+	if err := heap.l.LockContext(ctx); err != nil {
+		return RID{}, err
+	}
 	defer heap.l.Unlock()
 
+	if len(buf) == 0 {
+		return RID{}, errors.New("Zero length record")
+	}
+
+	stored, compressed, err := heap.encode(buf)
+	if err != nil {
+		return RID{}, err
+	}
+	rid, err := heap.add(stored, compressed, false)
+	if err != nil {
+		return rid, err
+	}
+	heap.headerPage.SetRecordCount(heap.headerPage.GetRecordCount() + 1)
+
+	if err := heap.flush(); err != nil {
+		return rid, err
+	}
+
+	heap.counters.puts.Add(1)
+
+	return rid, nil
+}
+
+// encode compresses buf if the heap compresses records, returning the bytes to store. Records are
+// limited to maxRecordLen before compression, so Get always has room to decompress them.
+func (heap *heap) encode(buf []byte) ([]byte, bool, error) {
+	if len(buf) > int(maxRecordLen) {
+		return nil, false, RecordExceedsMaxSize{Len: len(buf)}
+	}
+	stored, compressed := buf, false
+	if heap.compressor != nil {
+		var err error
+		if stored, compressed, err = heap.compressor.compress(buf); err != nil {
+			return nil, false, err
+		}
+	}
+	heap.counters.bytesIn.Add(uint64(len(buf)))
+	heap.counters.bytesStored.Add(uint64(len(stored)))
+	return stored, compressed, nil
+}
+
+// add stores buf on the last page, making a new last page if there is insufficient space.
+// Records added with moved set are the targets of forwarding stubs.
+// The last page and header page aren't written; caller must flush. Caller must hold heap.l.
+func (heap *heap) add(buf []byte, compressed bool, moved bool) (RID, error) {
+
 	var err error
 	var rid RID
 	var slot int16
 
-	if len(buf) == 0 {
-		return rid, errors.New("Zero length record")
-	}
-
 	bufLen := len(buf)
 
 	free := heap.lastPage.GetFreeSpace()
 	if bufLen > int(free) {
-		// insufficient space, so make a new page
+		// insufficient space, so write out the last page and make a new one
+		if heap.lastDirty {
+			if err = heap.store.Write(heap.headerPage.GetLastPageID(), heap.lastPage); err != nil {
+				return rid, err
+			}
+			heap.lastDirty = false
+		}
 		heap.lastPage.Clear()
 		var id PageID
 		if id, err = heap.store.Append(heap.lastPage); err != nil {
 			return rid, err
 		}
 		heap.headerPage.SetLastPageID(id)
-		// update header page
-		if err = heap.store.Write(0, heap.headerPage); err != nil {
-			return rid, err
-		}
 	}
 	if slot, err = heap.lastPage.AddRecord(buf); err != nil {
 		return rid, err
 	}
-	if err := heap.store.Write(heap.headerPage.GetLastPageID(), heap.lastPage); err != nil {
-		return rid, err
+	heap.lastDirty = true
+	if compressed {
+		if err = heap.lastPage.SetCompressed(slot, true); err != nil {
+			return rid, err
+		}
 	}
-	heap.headerPage.SetRecordCount(heap.headerPage.GetRecordCount() + 1)
-
-	if err := heap.store.Write(0, heap.headerPage); err != nil {
-		return rid, err
+	if moved {
+		if err = heap.lastPage.MarkMoved(slot); err != nil {
+			return rid, err
+		}
 	}
 	rid.PageID = heap.headerPage.GetLastPageID()
 	rid.Slot = slot
-
-	heap.writes++
+	rid.Version, _ = heap.lastPage.GetSlotVersion(slot)
 
 	return rid, nil
 }
 
+// flush writes the last page, if it has changed, and the header page, together if the store
+// supports batches. Caller must hold heap.l.
+func (heap *heap) flush() error {
+	if !heap.lastDirty {
+		return heap.store.Write(0, heap.headerPage)
+	}
+	ids := []PageID{heap.headerPage.GetLastPageID(), 0}
+	if err := writePages(heap.store, ids, []Page{heap.lastPage, heap.headerPage}); err != nil {
+		return err
+	}
+	heap.lastDirty = false
+	return nil
+}
+
+// readPage returns the page with id. The cached last page is returned for the last page id,
+// so that updates made through it aren't overwritten by the next Put. Caller must call release
+// when done with the page.
+func (heap *heap) readPage(id PageID) (page HeapPage, release func(), err error) {
+	if id == heap.headerPage.GetLastPageID() {
+		return heap.lastPage, func() {}, nil
+	}
+	page = heap.pagePool.Get().(HeapPage)
+	release = func() { heap.pagePool.Put(page) }
+	page.Clear()
+	if err = heap.store.Read(id, page); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return page, release, nil
+}
+
+// checkVersion returns StaleRID if the slot rid refers to on page has been reused since rid was
+// returned. Slots out of range are left for the page to report.
+func checkVersion(page HeapPage, rid RID) error {
+	version, err := page.GetSlotVersion(rid.Slot)
+	if err == nil && version != rid.Version {
+		return StaleRID{rid, version}
+	}
+	return nil
+}
+
+// Get copies the record identified by rid into buf, following a forwarding stub if the record has
+// moved. Returns StaleRID if rid's slot has since been reused for another record.
 func (heap *heap) Get(rid RID, buf []byte) (int, error) {
+	return heap.GetContext(context.Background(), rid, buf)
+}
+
+// GetContext is Get, giving up if ctx is done before each page read.
+func (heap *heap) GetContext(ctx context.Context, rid RID, buf []byte) (int, error) {
+	defer heap.counters.getLatency.since(time.Now())
 
 	page := heap.pagePool.Get().(HeapPage)
 	defer heap.pagePool.Put(page)
 
 	page.Clear()
-	if err := heap.store.Read(rid.PageID, page); err != nil {
+	if err := heap.store.ReadContext(ctx, rid.PageID, page); err != nil {
 		return 0, err
 	}
-	n, err := page.GetRecord(rid.Slot, buf)
-	heap.gets++
+	if err := checkVersion(page, rid); err != nil {
+		return 0, err
+	}
+	n, err := getRecord(page, rid.Slot, buf)
+	if fwd, ok := err.(RecordForwarded); ok {
+		page.Clear()
+		if err := heap.store.ReadContext(ctx, fwd.To.PageID, page); err != nil {
+			return 0, err
+		}
+		n, err = getRecord(page, fwd.To.Slot, buf)
+	}
+	heap.counters.gets.Add(1)
 	return n, err
 }
 
+// Set updates the record identified by rid. If the record no longer fits on its page it is moved
+// to another page and a forwarding stub is left in its slot, so rid remains valid. Returns
+// StaleRID if rid's slot has since been reused for another record.
 func (heap *heap) Set(rid RID, buf []byte) error {
+	return heap.SetContext(context.Background(), rid, buf)
+}
 
-	heap.l.Lock()
-	page := heap.pagePool.Get().(HeapPage)
+// SetContext is Set, giving up if ctx is done before the record is updated.
+func (heap *heap) SetContext(ctx context.Context, rid RID, buf []byte) error {
+	defer heap.counters.setLatency.since(time.Now())
 
-	defer func() {
-		heap.pagePool.Put(page)
-		heap.l.Unlock()
-	}()
+	if err := heap.l.LockContext(ctx); err != nil {
+		return err
+	}
+	defer heap.l.Unlock()
 
-	page.Clear()
-	if err := heap.store.Read(rid.PageID, page); err != nil {
+	stored, compressed, err := heap.encode(buf)
+	if err != nil {
 		return err
 	}
-	err := page.SetRecord(rid.Slot, buf)
+	page, release, err := heap.readPage(rid.PageID)
 	if err != nil {
 		return err
 	}
-	err = heap.store.Write(rid.PageID, page)
+	defer release()
+	if err := checkVersion(page, rid); err != nil {
+		return err
+	}
 
-	heap.sets++
+	switch e := setRecord(page, rid.Slot, stored, compressed).(type) {
+	case nil:
+		err = heap.store.Write(rid.PageID, page)
+	case RecordForwarded:
+		err = heap.setMoved(rid, e.To, stored, compressed)
+	case InsufficientPageSpace:
+		err = heap.move(rid, stored, compressed)
+	default:
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	heap.counters.sets.Add(1)
 
-	return err
+	return nil
 }
 
+// setRecord updates the record in slot, flagging whether it is stored compressed.
+func setRecord(page HeapPage, slot int16, buf []byte, compressed bool) error {
+	if err := page.SetRecord(slot, buf); err != nil {
+		return err
+	}
+	return page.SetCompressed(slot, compressed)
+}
+
+// move relocates the record at home to another page, leaving a forwarding stub behind.
+func (heap *heap) move(home RID, buf []byte, compressed bool) error {
+	to, err := heap.add(buf, compressed, true)
+	if err != nil {
+		return err
+	}
+	if err := heap.flush(); err != nil {
+		return err
+	}
+	if err := heap.forward(home, to); err != nil {
+		// the stub couldn't be written, so drop the moved copy again
+		heap.deleteRecord(to)
+		return err
+	}
+	return nil
+}
+
+// setMoved updates a record that has already been moved from home to at. If it no longer fits at,
+// it is moved again and the stub at home updated, so forwarding chains never grow beyond one hop.
+func (heap *heap) setMoved(home RID, at RID, buf []byte, compressed bool) error {
+	page, release, err := heap.readPage(at.PageID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	switch err := setRecord(page, at.Slot, buf, compressed); err.(type) {
+	case nil:
+		return heap.store.Write(at.PageID, page)
+	case InsufficientPageSpace:
+		to, err := heap.add(buf, compressed, true)
+		if err != nil {
+			return err
+		}
+		if err := heap.flush(); err != nil {
+			return err
+		}
+		if err := heap.deleteRecord(at); err != nil {
+			return err
+		}
+		return heap.forward(home, to)
+	default:
+		return err
+	}
+}
+
+// forward points the stub at home to to.
+func (heap *heap) forward(home RID, to RID) error {
+	page, release, err := heap.readPage(home.PageID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := page.ForwardRecord(home.Slot, to); err != nil {
+		return err
+	}
+	return heap.store.Write(home.PageID, page)
+}
+
+// Delete deletes the record identified by rid, along with its moved copy if it has been forwarded,
+// and takes it off the heap's record count. Deleting a record already deleted does nothing, unless
+// its slot has since been reused for another record, when StaleRID is returned.
 func (heap *heap) Delete(rid RID) error {
+	return heap.DeleteContext(context.Background(), rid)
+}
 
-	heap.l.Lock()
-	page := heap.pagePool.Get().(HeapPage)
+// DeleteContext is Delete, giving up if ctx is done before the record is deleted.
+func (heap *heap) DeleteContext(ctx context.Context, rid RID) error {
+	defer heap.counters.deleteLatency.since(time.Now())
 
-	defer func() {
-		heap.pagePool.Put(page)
-		heap.l.Unlock()
-	}()
+	if err := heap.l.LockContext(ctx); err != nil {
+		return err
+	}
+	defer heap.l.Unlock()
 
-	page.Clear()
-	if err := heap.store.Read(rid.PageID, page); err != nil {
+	page, release, err := heap.readPage(rid.PageID)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(page, rid); err != nil {
+		release()
 		return err
 	}
-	err := page.DeleteRecord(rid.Slot)
+	_, err = page.GetRecordLength(rid.Slot)
+	release()
+	switch e := err.(type) {
+	case nil:
+	case RecordDeleted:
+		return nil // delete is idempotent
+	case RecordForwarded:
+		if err := heap.deleteRecord(e.To); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if err := heap.deleteRecord(rid); err != nil {
+		return err
+	}
+	heap.headerPage.SetRecordCount(heap.headerPage.GetRecordCount() - 1)
+	if err := heap.store.Write(0, heap.headerPage); err != nil {
+		return err
+	}
+	heap.counters.deletes.Add(1)
+	return nil
+}
+
+// deleteRecord deletes the slot identified by rid, without following forwarding stubs.
+func (heap *heap) deleteRecord(rid RID) error {
+	page, release, err := heap.readPage(rid.PageID)
 	if err != nil {
 		return err
 	}
-	err = heap.store.Write(rid.PageID, page)
-	heap.deletes++
-	return err
+	defer release()
+	if err := page.DeleteRecord(rid.Slot); err != nil {
+		return err
+	}
+	return heap.store.Write(rid.PageID, page)
+}
+
+// Stats returns the heap's activity counts and record count. It doesn't read the store, so is
+// cheap enough to call from a metrics scrape; see FreeSpace for the space free on the heap pages.
+func (heap *heap) Stats() HeapStats {
+	stats := heap.counters.stats()
+	stats.Records = heap.Count()
+	stats.BufferPool = heap.pagePool.stats()
+	return stats
+}
+
+// FreeSpace returns the number of heap pages in the store and the space free for records on them,
+// found by reading every page of the store. Pages that can't be read are skipped.
+func (heap *heap) FreeSpace() (pages int64, free int64) {
+	raw := newRawPage()
+	page := heap.pagePool.Get().(HeapPage)
+	defer heap.pagePool.Put(page)
+	for id := PageID(1); int64(id) < heap.store.Count(); id++ {
+		if err := heap.store.Read(id, raw); err != nil || raw.GetType() != pageTypeHeap {
+			continue
+		}
+		if err := page.UnmarshalBinary(raw.bytes); err != nil {
+			continue
+		}
+		pages++
+		free += int64(page.GetFreeSpace())
+	}
+	return pages, free
 }
 
+// Statistics returns a string with the heap's activity counts.
+//
+// Deprecated: use Stats.
 func (heap *heap) Statistics() string {
-	return fmt.Sprintf("heap: writes: %d, gets: %d, sets: %d, deletes: %d", heap.writes, heap.gets, heap.sets, heap.deletes)
+	return fmt.Sprintf("heap: %s", heap.Stats())
 }
@@ -0,0 +1,247 @@
+package dbase
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// PutBatch adds bufs to the heap, returning the RID of each record. Records fill the last page in
+// memory; each page is written once, as is the header page.
+// If an error occurs, the RIDs of the records added before the error are returned with it.
+func (heap *heap) PutBatch(bufs [][]byte) ([]RID, error) {
+	return heap.PutBatchContext(context.Background(), bufs)
+}
+
+// PutBatchContext is PutBatch, stopping with ctx.Err() if ctx is done. The records added before
+// then are written, and their RIDs returned with the error.
+func (heap *heap) PutBatchContext(ctx context.Context, bufs [][]byte) ([]RID, error) {
+
+	if err := heap.l.LockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer heap.l.Unlock()
+
+	rids := make([]RID, 0, len(bufs))
+	var err error
+	for _, buf := range bufs {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if len(buf) == 0 {
+			err = errors.New("Zero length record")
+			break
+		}
+		var stored []byte
+		var compressed bool
+		if stored, compressed, err = heap.encode(buf); err != nil {
+			break
+		}
+		var rid RID
+		if rid, err = heap.add(stored, compressed, false); err != nil {
+			break
+		}
+		rids = append(rids, rid)
+	}
+	heap.headerPage.SetRecordCount(heap.headerPage.GetRecordCount() + int64(len(rids)))
+	if ferr := heap.flush(); err == nil {
+		err = ferr
+	}
+	heap.counters.puts.Add(uint64(len(rids)))
+
+	return rids, err
+}
+
+// GetBatch copies the record identified by rids[i] into bufs[i], returning the length of each record.
+// Pages are read in page order, once each. Every record is attempted; the first error encountered is returned.
+func (heap *heap) GetBatch(rids []RID, bufs [][]byte) ([]int, error) {
+	return heap.GetBatchContext(context.Background(), rids, bufs)
+}
+
+// GetBatchContext is GetBatch, giving up with ctx.Err() if ctx is done before a page is read.
+func (heap *heap) GetBatchContext(ctx context.Context, rids []RID, bufs [][]byte) ([]int, error) {
+
+	if len(rids) != len(bufs) {
+		return nil, errors.New("GetBatch: rids and bufs differ in length")
+	}
+
+	page := heap.pagePool.Get().(HeapPage)
+	defer heap.pagePool.Put(page)
+
+	ns := make([]int, len(rids))
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// records that have moved are collected and read in a second pass, again in page order
+	var forwarded []int
+	movedTo := make([]RID, len(rids))
+	var cancelled error
+
+	read := func(at []RID, follow bool) func(id PageID, idx []int) {
+		return func(id PageID, idx []int) {
+			if err := ctx.Err(); err != nil {
+				cancelled = err
+				return
+			}
+			page.Clear()
+			if err := heap.store.Read(id, page); err != nil {
+				setErr(err)
+				return
+			}
+			for _, i := range idx {
+				if follow {
+					if err := checkVersion(page, at[i]); err != nil {
+						setErr(err)
+						continue
+					}
+				}
+				n, err := getRecord(page, at[i].Slot, bufs[i])
+				if fwd, ok := err.(RecordForwarded); ok && follow {
+					movedTo[i] = fwd.To
+					forwarded = append(forwarded, i)
+					continue
+				}
+				if err != nil {
+					setErr(err)
+				}
+				ns[i] = n
+			}
+		}
+	}
+	byPage(rids, indexes(len(rids)), read(rids, true))
+	byPage(movedTo, forwarded, read(movedTo, false))
+
+	heap.counters.gets.Add(uint64(len(rids)))
+
+	if cancelled != nil {
+		return ns, cancelled
+	}
+	return ns, firstErr
+}
+
+// DeleteBatch deletes the records identified by rids. Pages are visited in page order and each
+// touched page is written once, as is the header page. Every record is attempted; the first error
+// encountered is returned.
+func (heap *heap) DeleteBatch(rids []RID) error {
+	return heap.DeleteBatchContext(context.Background(), rids)
+}
+
+// DeleteBatchContext is DeleteBatch, stopping with ctx.Err() if ctx is done before a page is
+// changed. The moved copies of records already deleted are deleted regardless, as is the record
+// count updated.
+func (heap *heap) DeleteBatchContext(ctx context.Context, rids []RID) error {
+
+	if err := heap.l.LockContext(ctx); err != nil {
+		return err
+	}
+	defer heap.l.Unlock()
+
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var forwarded []int
+	movedTo := make([]RID, len(rids))
+	var deletes int
+
+	remove := func(at []RID, home bool) func(id PageID, idx []int) {
+		return func(id PageID, idx []int) {
+			if home {
+				if err := ctx.Err(); err != nil {
+					setErr(err)
+					return
+				}
+			}
+			page, release, err := heap.readPage(id)
+			if err != nil {
+				setErr(err)
+				return
+			}
+			defer release()
+			var changed bool
+			for _, i := range idx {
+				slot := at[i].Slot
+				if home {
+					if err := checkVersion(page, at[i]); err != nil {
+						setErr(err)
+						continue
+					}
+					_, err := page.GetRecordLength(slot)
+					switch e := err.(type) {
+					case nil:
+					case RecordDeleted:
+						continue // delete is idempotent
+					case RecordForwarded:
+						movedTo[i] = e.To
+						forwarded = append(forwarded, i)
+					default:
+						setErr(err)
+						continue
+					}
+				}
+				if err := page.DeleteRecord(slot); err != nil {
+					setErr(err)
+					continue
+				}
+				changed = true
+				if home {
+					deletes++
+				}
+			}
+			if changed {
+				if err := heap.store.Write(id, page); err != nil {
+					setErr(err)
+				}
+			}
+		}
+	}
+	byPage(rids, indexes(len(rids)), remove(rids, true))
+	byPage(movedTo, forwarded, remove(movedTo, false))
+
+	if deletes > 0 {
+		heap.headerPage.SetRecordCount(heap.headerPage.GetRecordCount() - int64(deletes))
+		if err := heap.store.Write(0, heap.headerPage); err != nil {
+			setErr(err)
+		}
+	}
+	heap.counters.deletes.Add(uint64(deletes))
+
+	return firstErr
+}
+
+// byPage sorts the indexes idx of rids into RID order and calls fn once for each page, with the
+// indexes of the rids on that page.
+func byPage(rids []RID, idx []int, fn func(id PageID, idx []int)) {
+	sort.Slice(idx, func(a, b int) bool {
+		ra, rb := rids[idx[a]], rids[idx[b]]
+		if ra.PageID != rb.PageID {
+			return ra.PageID < rb.PageID
+		}
+		return ra.Slot < rb.Slot
+	})
+	for start := 0; start < len(idx); {
+		id := rids[idx[start]].PageID
+		end := start + 1
+		for end < len(idx) && rids[idx[end]].PageID == id {
+			end++
+		}
+		fn(id, idx[start:end])
+		start = end
+	}
+}
+
+// indexes returns the indexes 0..n-1.
+func indexes(n int) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
@@ -0,0 +1,91 @@
+package dbase
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	randstr "github.com/trpedersen/rand"
+)
+
+func Test_HeapBatch(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+
+	records := make([][]byte, 2000)
+	for i := range records {
+		records[i] = []byte(randstr.RandStr(1+rand.Intn(200), "alphanum"))
+	}
+	rids, err := heap.PutBatch(records)
+	if err != nil {
+		t.Fatalf("heap.PutBatch, err: %s", err)
+	}
+	if len(rids) != len(records) {
+		t.Fatalf("heap.PutBatch rids, expected: %d, got: %d", len(records), len(rids))
+	}
+	if heap.Count() != int64(len(records)) {
+		t.Fatalf("Record count, expected: %d, got: %d", len(records), heap.Count())
+	}
+
+	// move a record so the batch has to follow a forwarding stub
+	records[0] = []byte(randstr.RandStr(5000, "alphanum"))
+	if err := heap.Set(rids[0], records[0]); err != nil {
+		t.Fatalf("heap.Set, err: %s", err)
+	}
+
+	// read back in shuffled order
+	order := rand.Perm(len(rids))
+	shuffled := make([]RID, len(rids))
+	bufs := make([][]byte, len(rids))
+	for i, j := range order {
+		shuffled[i] = rids[j]
+		bufs[i] = make([]byte, maxRecordLen)
+	}
+	ns, err := heap.GetBatch(shuffled, bufs)
+	if err != nil {
+		t.Fatalf("heap.GetBatch, err: %s", err)
+	}
+	for i, j := range order {
+		if !bytes.Equal(records[j], bufs[i][0:ns[i]]) {
+			t.Fatalf("heap.GetBatch %v, expecting: %s, got: %s", shuffled[i], records[j], bufs[i][0:ns[i]])
+		}
+	}
+
+	// delete every other record, including the moved one
+	var deletes []RID
+	for i := 0; i < len(rids); i += 2 {
+		deletes = append(deletes, rids[i])
+	}
+	if err := heap.DeleteBatch(deletes); err != nil {
+		t.Fatalf("heap.DeleteBatch, err: %s", err)
+	}
+	expected := int64(len(rids) - len(deletes))
+	if heap.Count() != expected {
+		t.Fatalf("Record count after delete, expected: %d, got: %d", expected, heap.Count())
+	}
+	// deletes are idempotent
+	if err := heap.DeleteBatch(deletes); err != nil {
+		t.Fatalf("heap.DeleteBatch again, err: %s", err)
+	}
+	if heap.Count() != expected {
+		t.Fatalf("Record count after second delete, expected: %d, got: %d", expected, heap.Count())
+	}
+
+	buf := make([]byte, maxRecordLen)
+	var scans int64
+	scanner := NewHeapScanner(heap)
+	for {
+		rid, _, err := scanner.Next(buf)
+		if err != nil {
+			break
+		}
+		if rid == rids[0] {
+			t.Fatalf("scanner.Next returned deleted record %v", rid)
+		}
+		scans++
+	}
+	if scans != expected {
+		t.Errorf("scan count, expected: %d, got: %d", expected, scans)
+	}
+}
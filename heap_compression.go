@@ -0,0 +1,117 @@
+package dbase
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// minCompressLen is the shortest record worth compressing.
+	minCompressLen = 64
+
+	// compressed records are prefixed with their uncompressed length
+	compressedLenLen = 4
+)
+
+var flateReaderPool = &sync.Pool{
+	New: func() any {
+		return flate.NewReader(nil)
+	},
+}
+
+// RecordCorrupt is an error type - a compressed record could not be decompressed
+type RecordCorrupt struct {
+	PageID PageID
+	Slot   int16
+	Err    error
+}
+
+func (e RecordCorrupt) Error() string {
+	return fmt.Sprintf("Record corrupt, PageID: %d, Slot: %d, err: %s", e.PageID, e.Slot, e.Err)
+}
+
+// compressor compresses records for a heap.
+type compressor struct {
+	writers *sync.Pool
+}
+
+func newCompressor(level int) (*compressor, error) {
+	// check the level up front so the pool can't fail
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &compressor{
+		writers: &sync.Pool{
+			New: func() any {
+				w, _ := flate.NewWriter(io.Discard, level)
+				return w
+			},
+		},
+	}, nil
+}
+
+// compress returns the compressed form of buf, or buf itself if compression doesn't make it smaller.
+func (c *compressor) compress(buf []byte) ([]byte, bool, error) {
+	if len(buf) < minCompressLen {
+		return buf, false, nil
+	}
+	out := bytes.NewBuffer(make([]byte, compressedLenLen, len(buf)))
+	binary.LittleEndian.PutUint32(out.Bytes(), uint32(len(buf)))
+
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+	w.Reset(out)
+	if _, err := w.Write(buf); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+	if out.Len() >= len(buf) {
+		return buf, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// decompress copies the uncompressed record in src into buf, returning the full uncompressed length.
+// Like HeapPage.GetRecord, the record is truncated if buf is too short.
+func decompress(src []byte, buf []byte) (int, error) {
+	if len(src) < compressedLenLen {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := int(binary.LittleEndian.Uint32(src))
+	if len(buf) > n {
+		buf = buf[0:n]
+	}
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src[compressedLenLen:]), nil); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// getRecord copies the record in slot into buf, decompressing it if necessary.
+func getRecord(page HeapPage, slot int16, buf []byte) (int, error) {
+	if !page.IsCompressed(slot) {
+		return page.GetRecord(slot, buf)
+	}
+	tmp := bufferPool.Get().([]byte)
+	defer bufferPool.Put(tmp)
+
+	n, err := page.GetRecord(slot, tmp)
+	if err != nil {
+		return 0, err
+	}
+	if n, err = decompress(tmp[0:n], buf); err != nil {
+		return 0, RecordCorrupt{page.GetID(), slot, err}
+	}
+	return n, nil
+}
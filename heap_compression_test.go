@@ -0,0 +1,115 @@
+package dbase
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"testing"
+)
+
+func jsonRecord(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id": %d, "name": "customer %d", "status": "active", "tags": ["alpha", "beta", "gamma"], "notes": "%s"}`,
+		i, i, bytes.Repeat([]byte("lorem ipsum "), i%20)))
+}
+
+func Test_HeapCompression(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeapWithOptions(store, &HeapOptions{Compress: true, CompressionLevel: flate.BestSpeed})
+
+	records := make(map[RID][]byte)
+	for i := 0; i < 1000; i++ {
+		record := jsonRecord(i)
+		rid, err := heap.Put(record)
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = record
+	}
+
+	// a record as long as any page can hold is compressed like any other
+	large := bytes.Repeat(jsonRecord(1), 200)[0:maxRecordLen]
+	rid, err := heap.Put(large)
+	if err != nil {
+		t.Fatalf("heap.Put large record, err: %s", err)
+	}
+	records[rid] = large
+	// a longer one is rejected, even though it would fit once compressed, as Get couldn't return it
+	tooLarge := bytes.Repeat(jsonRecord(1), 200)
+	if _, err := heap.Put(tooLarge); err == nil {
+		t.Errorf("heap.Put %d byte record, expected: RecordExceedsMaxSize, got: nil", len(tooLarge))
+	} else if _, ok := err.(RecordExceedsMaxSize); !ok {
+		t.Errorf("heap.Put %d byte record, expected: RecordExceedsMaxSize, got: %v", len(tooLarge), err)
+	}
+	if err := heap.Set(rid, tooLarge); err == nil {
+		t.Errorf("heap.Set %d byte record, expected: RecordExceedsMaxSize, got: nil", len(tooLarge))
+	}
+
+	// mixed heap: records written without compression read back alongside compressed ones
+	heap = NewHeap(store)
+	for i := 0; i < 10; i++ {
+		record := jsonRecord(i)
+		rid, err := heap.Put(record)
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = record
+	}
+
+	buf := make([]byte, len(large))
+	for rid, record := range records {
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+
+	var scans int
+	scanner := NewHeapScanner(heap)
+	for {
+		rid, n, err := scanner.Next(buf)
+		if err != nil {
+			break
+		}
+		scans++
+		if !bytes.Equal(records[rid], buf[0:n]) {
+			t.Fatalf("scanner.Next %v, expecting: %s, got: %s", rid, records[rid], buf[0:n])
+		}
+	}
+	if scans != len(records) {
+		t.Errorf("scan count, expected: %d, got: %d", len(records), scans)
+	}
+}
+
+func Test_HeapCompressionRatio(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	h := NewHeapWithOptions(store, &HeapOptions{Compress: true, CompressionLevel: flate.DefaultCompression})
+	heap := h.(*heap)
+
+	rid, err := heap.Put(jsonRecord(19))
+	if err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+	// update to a record that doesn't compress, then back again
+	for _, record := range [][]byte{[]byte("short"), jsonRecord(18)} {
+		if err := heap.Set(rid, record); err != nil {
+			t.Fatalf("heap.Set, err: %s", err)
+		}
+		buf := make([]byte, maxRecordLen)
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get, err: %s", err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("heap.Get, expecting: %s, got: %s", record, buf[0:n])
+		}
+	}
+
+	if ratio := heap.Stats().CompressionRatio; ratio < 2 {
+		t.Errorf("compression ratio, expected: > 2, got: %.2f", ratio)
+	}
+}
@@ -71,13 +71,8 @@ func (page *heapHeaderPage) MarshalBinary() ([]byte, error) {
 // PAGE_SIZE bytes are used to rehydrate the page.
 func (page *heapHeaderPage) UnmarshalBinary(buf []byte) error {
 
-	if len(buf) != int(PageSize) {
-		panic("Invalid buffer")
-	}
-	// check page type, panic if wrong
-	pageType := PageType(buf[pageTypeOffset])
-	if pageType != pageTypeHeapHeader {
-		panic("Invalid page type")
+	if err := checkUnmarshal(buf, pageTypeHeapHeader); err != nil {
+		return err
 	}
 	copy(page.bytes, buf)
 	page.header = page.bytes[0:pageHeaderLength]
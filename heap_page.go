@@ -8,16 +8,34 @@ import (
 )
 
 const (
-	slotTableEntryLen = int16(5) // bytes
-	slotCountOffset   = int16(9)
-	slotTableOffset   = pageHeaderLength
-	slotTableLen      = PageSize - slotTableOffset
+	slotTableEntryLen   = int16(6) // bytes: flags, version, offset (2), length (2)
+	slotTableEntryLenV1 = int16(5) // bytes: flags, offset (2), length (2)
+	slotCountOffset     = int16(9)
+	deletedCountOffset  = int16(11)
+	pageVersionOffset   = int16(13)
+	slotTableOffset     = pageHeaderLength
+	slotTableLen        = PageSize - slotTableOffset
+
+	// heapPageVersion is the format of the heap pages written by NewHeapPage, with a version in
+	// each slot table entry. Pages written before slot versions have 0 in the version byte and
+	// 5 byte entries; they are read and written as they are, and never reuse slots.
+	heapPageVersion = 2
 
 	slotUnallocated  = 0x00
 	recordOnPage     = 0x01
 	recordOnOverflow = 0x02
 	recordDeleted    = 0x04
+	recordForwarded  = 0x08 // slot holds a forwarding stub pointing to the record's new RID
+	recordMoved      = 0x10 // record was moved here from its home slot, reached via a forwarding stub
+	recordCompressed = 0x20 // record is stored compressed, see heap_compression.go
 	maxRecordLen     = PageSize - slotTableOffset - (2 * slotTableEntryLen)
+
+	forwardStubLen = int16(10) // PageID (8) + slot (2)
+
+	// maxSlotVersion is the last version a slot can reach. A slot at this version
+	// is retired once deleted rather than wrapping, so stale RIDs are never aliased.
+	// A heap can retire slots sooner, see HeapOptions.SlotVersions.
+	maxSlotVersion = 0xFF
 )
 
 // HeapPage is a page that contains records stored in slots.
@@ -26,11 +44,17 @@ type HeapPage interface {
 	//PreviousPageID() PageID
 	//NextPageID() PageID
 	GetSlotCount() int16
+	GetSlotVersion(slot int16) (byte, error)
 	AddRecord(buf []byte) (int16, error)
 	GetRecord(slot int16, buf []byte) (int, error)
 	GetRecordLength(slot int16) (int, error)
 	SetRecord(slot int16, buf []byte) error
 	DeleteRecord(slot int16) error
+	ForwardRecord(slot int16, to RID) error
+	MarkMoved(slot int16) error
+	IsMoved(slot int16) bool
+	SetCompressed(slot int16, compressed bool) error
+	IsCompressed(slot int16) bool
 	GetFreeSpace() int
 	Clear() error
 }
@@ -38,8 +62,12 @@ type HeapPage interface {
 type heapPage struct {
 	l *sync.Mutex
 	page
-	slotCount int16 // 32:36
-	slotTable []byte
+	slotCount    int16 // 9:11
+	deletedCount int16 // 11:13, deleted slots available for reuse
+	version      byte  // 13, page format, 0 for pages written before heapPageVersion
+	entryLen     int16 // slot table entry length of the page's format
+	maxVersion   byte  // slots at this version are retired when deleted, not reused
+	slotTable    []byte
 }
 
 var bufferPool = &sync.Pool{
@@ -89,14 +117,42 @@ func (e InsufficientPageSpace) Error() string {
 	return fmt.Sprintf("Insufficient free space on heap page, PageID: %d, Slot: %d", e.PageID, e.Slot)
 }
 
-// RID is a record ID = PageID + Slot #
-type RID struct {
+// RecordForwarded is an error type - the record has moved to another page, see To
+type RecordForwarded struct {
 	PageID PageID
 	Slot   int16
+	To     RID
+}
+
+func (e RecordForwarded) Error() string {
+	return fmt.Sprintf("Record forwarded, PageID: %d, Slot: %d, To: %d:%d", e.PageID, e.Slot, e.To.PageID, e.To.Slot)
+}
+
+// StaleRID is an error type - the slot a RID refers to has since been reused for another record,
+// so the RID's record has been deleted.
+type StaleRID struct {
+	RID     RID
+	Version byte // the slot's current version
+}
+
+func (e StaleRID) Error() string {
+	return fmt.Sprintf("Stale RID, PageID: %d, Slot: %d, Version: %d, slot is at version %d", e.RID.PageID, e.RID.Slot, e.RID.Version, e.Version)
+}
+
+// RID is a record ID = PageID + Slot # + the version of the slot the record was added at
+type RID struct {
+	PageID  PageID
+	Slot    int16
+	Version byte
 }
 
 // NewHeapPage returns a new Heap Page.
 func NewHeapPage() HeapPage {
+	return newHeapPage(maxSlotVersion)
+}
+
+// newHeapPage returns a new heap page that retires slots deleted at maxVersion.
+func newHeapPage(maxVersion byte) *heapPage {
 
 	page := &heapPage{
 		page: page{
@@ -104,24 +160,32 @@ func NewHeapPage() HeapPage {
 			pagetype: pageTypeHeap,
 			bytes:    make([]byte, PageSize, PageSize),
 		},
-		l: &sync.Mutex{},
+		l:          &sync.Mutex{},
+		version:    heapPageVersion,
+		entryLen:   slotTableEntryLen,
+		maxVersion: maxVersion,
 	}
 
 	page.header = page.bytes[0:pageHeaderLength]
 	page.slotTable = page.bytes[slotTableOffset : slotTableOffset+slotTableLen]
 	page.setSlotFlags(0, recordOnPage)
 	page.setSlotOffset(0, 0)
-	page.setSlotLength(0, slotTableLen-(2*slotTableEntryLen))
+	page.setSlotLength(0, slotTableLen-(2*page.entryLen))
 	page.slotCount = 1
 
 	return page
 }
 
+// entryOffset returns the offset of slot's entry in the slot table.
+func (page *heapPage) entryOffset(slot int16) int16 {
+	return slotTableLen - ((slot + 1) * page.entryLen)
+}
+
 func (page *heapPage) getSlotFlags(slot int16) byte {
 	if slot > page.slotCount-1 {
 		panic("Invalid slot")
 	}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
+	offset := page.entryOffset(slot)
 	return page.slotTable[offset]
 }
 
@@ -129,25 +193,45 @@ func (page *heapPage) setSlotFlags(slot int16, flags byte) error {
 	//if slot > page.slotCount - 1 {
 	//	panic("Invalid slot")
 	//}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
+	offset := page.entryOffset(slot)
 	page.slotTable[offset] = flags
 	return nil
 }
 
+func (page *heapPage) getSlotVersion(slot int16) byte {
+	if slot > page.slotCount-1 {
+		panic("Invalid slot")
+	}
+	if page.version < heapPageVersion {
+		return 0
+	}
+	offset := page.entryOffset(slot)
+	return page.slotTable[offset+1]
+}
+
+func (page *heapPage) setSlotVersion(slot int16, version byte) error {
+	if page.version < heapPageVersion {
+		return nil
+	}
+	offset := page.entryOffset(slot)
+	page.slotTable[offset+1] = version
+	return nil
+}
+
 func (page *heapPage) getSlotOffset(slot int16) int16 {
 	if slot > page.slotCount-1 {
 		panic("Invalid slot")
 	}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
-	return int16(binary.LittleEndian.Uint16(page.slotTable[offset+1 : offset+3]))
+	offset := page.entryOffset(slot)
+	return int16(binary.LittleEndian.Uint16(page.slotTable[offset+page.entryLen-4:]))
 }
 
 func (page *heapPage) setSlotOffset(slot int16, slotOffset int16) error {
 	//if slot > page.slotCount - 1 {
 	//	panic("Invalid slot")
 	//}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
-	binary.LittleEndian.PutUint16(page.slotTable[offset+1:offset+3], uint16(slotOffset))
+	offset := page.entryOffset(slot)
+	binary.LittleEndian.PutUint16(page.slotTable[offset+page.entryLen-4:], uint16(slotOffset))
 	return nil
 }
 
@@ -155,8 +239,8 @@ func (page *heapPage) getSlotLength(slot int16) int16 {
 	if slot > page.slotCount-1 {
 		panic("Invalid slot")
 	}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
-	result := int16(binary.LittleEndian.Uint16(page.slotTable[offset+3 : offset+5]))
+	offset := page.entryOffset(slot)
+	result := int16(binary.LittleEndian.Uint16(page.slotTable[offset+page.entryLen-2:]))
 	return result
 }
 
@@ -164,8 +248,8 @@ func (page *heapPage) setSlotLength(slot int16, length int16) error {
 	//if slot > page.slotCount - 1 {
 	//	panic("Invalid slot")
 	//}
-	offset := slotTableLen - ((slot + 1) * slotTableEntryLen)
-	binary.LittleEndian.PutUint16(page.slotTable[offset+3:offset+5], uint16(length))
+	offset := page.entryOffset(slot)
+	binary.LittleEndian.PutUint16(page.slotTable[offset+page.entryLen-2:], uint16(length))
 	return nil
 }
 
@@ -180,6 +264,8 @@ func (page *heapPage) MarshalBinary() ([]byte, error) {
 	page.header[pageTypeOffset] = byte(pageTypeHeap)
 
 	binary.LittleEndian.PutUint16(page.header[slotCountOffset:], uint16(page.slotCount))
+	binary.LittleEndian.PutUint16(page.header[deletedCountOffset:], uint16(page.deletedCount))
+	page.header[pageVersionOffset] = page.version
 
 	return page.bytes, nil
 }
@@ -191,13 +277,11 @@ func (page *heapPage) UnmarshalBinary(buf []byte) error {
 	page.l.Lock()
 	defer page.l.Unlock()
 
-	if len(buf) != int(PageSize) {
-		panic("Invalid buffer")
+	if err := checkUnmarshal(buf, pageTypeHeap); err != nil {
+		return err
 	}
-	// check page type, panic if wrong
-	pageType := PageType(buf[pageTypeOffset])
-	if pageType != pageTypeHeap {
-		panic("Invalid page type")
+	if err := validateHeapPage(buf); err != nil {
+		return err
 	}
 
 	copy(page.bytes, buf)
@@ -209,21 +293,94 @@ func (page *heapPage) UnmarshalBinary(buf []byte) error {
 	page.pagetype = pageTypeHeap
 
 	page.slotCount = int16(binary.LittleEndian.Uint16(page.header[slotCountOffset:]))
+	page.deletedCount = int16(binary.LittleEndian.Uint16(page.header[deletedCountOffset:]))
+	page.version = page.header[pageVersionOffset]
+	page.entryLen, _ = heapEntryLen(buf)
 
 	return nil
 }
 
+// heapEntryLen returns the slot table entry length of heap page image buf, from its format
+// version. Returns false if the version is unknown.
+func heapEntryLen(buf []byte) (int16, bool) {
+	switch buf[pageVersionOffset] {
+	case 0:
+		return slotTableEntryLenV1, true
+	case heapPageVersion:
+		return slotTableEntryLen, true
+	}
+	return 0, false
+}
+
+// slotEntry decodes entry slot of a raw heap page slot table with entries entryLen long. The
+// version is 0 for pages without slot versions.
+func slotEntry(slotTable []byte, entryLen int16, slot int16) (flags byte, version byte, offset int16, length int16) {
+	e := slotTable[slotTableLen-(slot+1)*entryLen:]
+	if entryLen == slotTableEntryLen {
+		version = e[1]
+	}
+	return e[0], version, int16(binary.LittleEndian.Uint16(e[entryLen-4:])), int16(binary.LittleEndian.Uint16(e[entryLen-2:]))
+}
+
+// validateHeapPage returns ErrPageCorrupt unless the slot table of heap page image buf is
+// consistent enough to be used: the slot and deleted counts in range, and every live slot within
+// the record area. It doesn't look for overlapping records; see Check.
+func validateHeapPage(buf []byte) error {
+	id := PageID(binary.LittleEndian.Uint64(buf[pageIDOffset:]))
+	slotTable := buf[slotTableOffset:]
+	slotCount := int16(binary.LittleEndian.Uint16(buf[slotCountOffset:]))
+	deletedCount := int16(binary.LittleEndian.Uint16(buf[deletedCountOffset:]))
+	entryLen, ok := heapEntryLen(buf)
+	if !ok {
+		return ErrPageCorrupt{id, 0, fmt.Sprintf("unknown heap page version %d", buf[pageVersionOffset])}
+	}
+	if slotCount < 1 || int(slotCount)*int(entryLen) > int(slotTableLen) {
+		return ErrPageCorrupt{id, 0, fmt.Sprintf("slot count %d out of range", slotCount)}
+	}
+	if deletedCount < 0 || deletedCount >= slotCount {
+		return ErrPageCorrupt{id, 0, fmt.Sprintf("deleted count %d out of range", deletedCount)}
+	}
+	tableStart := slotTableLen - slotCount*entryLen
+	_, _, freeOffset, freeLength := slotEntry(slotTable, entryLen, 0)
+	if freeOffset < 0 || freeLength < 0 || freeOffset > tableStart || freeOffset+freeLength > tableStart {
+		return ErrPageCorrupt{id, 0, fmt.Sprintf("free space offset %d length %d overlaps slot table at %d", freeOffset, freeLength, tableStart)}
+	}
+	for slot := int16(1); slot < slotCount; slot++ {
+		flags, _, offset, length := slotEntry(slotTable, entryLen, slot)
+		if flags == recordDeleted {
+			continue
+		}
+		if flags == recordForwarded && length != forwardStubLen {
+			return ErrPageCorrupt{id, slot, fmt.Sprintf("forwarding stub length %d", length)}
+		}
+		if offset < 0 || length < 0 || offset+length > freeOffset {
+			return ErrPageCorrupt{id, slot, fmt.Sprintf("record offset %d length %d outside record area 0:%d", offset, length, freeOffset)}
+		}
+	}
+	return nil
+}
+
 // GetSlotCount returns the number of record slots held in page.
 func (page *heapPage) GetSlotCount() int16 {
 	return page.slotCount // int16(len(page.slots))
 }
 
+// GetSlotVersion returns the version of slot. The version is bumped each time a deleted
+// slot is reused, so a caller holding a RID can detect that it now refers to a different record.
+func (page *heapPage) GetSlotVersion(slotNumber int16) (byte, error) {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return 0, InvalidRID{page.id, slotNumber}
+	}
+	return page.getSlotVersion(slotNumber), nil
+}
+
 // GetFreeSpace return the amount of free space available to store a record (inclusive of any header fields.)
 func (page *heapPage) GetFreeSpace() int {
 	return int(page.getSlotLength(0))
 }
 
 // AddRecord adds record to page, using copy semantics. Returns record number for added record.
+// Deleted slots are reused before a new slot table entry is made.
 // Returns an error if insufficient page free space.
 func (page *heapPage) AddRecord(record []byte) (int16, error) {
 
@@ -236,18 +393,41 @@ func (page *heapPage) AddRecord(record []byte) (int16, error) {
 
 	recordLength := int16(len(record))
 	recordOffset := page.getSlotOffset(0)
-	// make a new slot table entry
-	page.setSlotFlags(page.slotCount, recordOnPage)
-	page.setSlotOffset(page.slotCount, recordOffset)
-	page.setSlotLength(page.slotCount, int16(recordLength))
-	page.slotCount++
+
+	slot := page.findReusableSlot()
+	if slot > 0 {
+		page.setSlotVersion(slot, page.getSlotVersion(slot)+1)
+		page.deletedCount--
+	} else {
+		// make a new slot table entry
+		slot = page.slotCount
+		page.setSlotVersion(slot, 0)
+		page.slotCount++
+	}
+	page.setSlotFlags(slot, recordOnPage)
+	page.setSlotOffset(slot, recordOffset)
+	page.setSlotLength(slot, recordLength)
 	copy(page.slotTable[recordOffset:recordOffset+recordLength], record)
 	page.setSlotOffset(0, page.getSlotOffset(0)+int16(recordLength))
-	page.setSlotLength(0, slotTableLen-page.getSlotOffset(0)-(int16(page.slotCount+1)*slotTableEntryLen))
+	page.setSlotLength(0, slotTableLen-page.getSlotOffset(0)-(int16(page.slotCount+1)*page.entryLen))
 	if page.getSlotLength(0) < 0 {
 		page.setSlotLength(0, 0)
 	}
-	return page.slotCount - 1, nil // slots are 0-based
+	return slot, nil // slots are 0-based
+}
+
+// findReusableSlot returns the lowest deleted slot that can be reused, or 0 if there is none.
+// Slots on pages without slot versions are never reused.
+func (page *heapPage) findReusableSlot() int16 {
+	if page.deletedCount == 0 || page.version < heapPageVersion {
+		return 0
+	}
+	for i := int16(1); i < page.slotCount; i++ {
+		if page.getSlotFlags(i) == recordDeleted && page.getSlotVersion(i) < page.maxVersion {
+			return i
+		}
+	}
+	return 0
 }
 
 // GetRecordLength returns length of record specified by recordNumber.
@@ -255,12 +435,15 @@ func (page *heapPage) AddRecord(record []byte) (int16, error) {
 func (page *heapPage) GetRecordLength(slotNumber int16) (int, error) {
 
 	// slots are 0 based
-	if slotNumber > page.slotCount-1 {
+	if slotNumber < 0 || slotNumber > page.slotCount-1 {
 		return 0, InvalidRID{page.id, slotNumber}
 	}
 
-	if page.getSlotFlags(slotNumber) == recordDeleted {
+	switch page.getSlotFlags(slotNumber) {
+	case recordDeleted:
 		return 0, RecordDeleted{page.id, slotNumber}
+	case recordForwarded:
+		return 0, RecordForwarded{page.id, slotNumber, page.getForward(slotNumber)}
 	}
 	length := int(page.getSlotLength(slotNumber))
 	return length, nil
@@ -271,11 +454,14 @@ func (page *heapPage) GetRecordLength(slotNumber int16) (int, error) {
 func (page *heapPage) GetRecord(slotNumber int16, buf []byte) (int, error) {
 
 	// slots are 0 based
-	if slotNumber == 0 || slotNumber > page.slotCount-1 {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
 		return 0, InvalidRID{page.id, slotNumber}
 	}
-	if page.getSlotFlags(slotNumber) == recordDeleted {
+	switch page.getSlotFlags(slotNumber) {
+	case recordDeleted:
 		return 0, RecordDeleted{page.id, slotNumber}
+	case recordForwarded:
+		return 0, RecordForwarded{page.id, slotNumber, page.getForward(slotNumber)}
 	}
 	offset := int(page.getSlotOffset(slotNumber))
 	length := int(page.getSlotLength(slotNumber))
@@ -291,9 +477,15 @@ func (page *heapPage) SetRecord(slotNumber int16, buf []byte) error {
 	defer page.l.Unlock()
 
 	// recordNumber is 0 based
-	if slotNumber == 0 || slotNumber > page.slotCount-1 {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
 		return InvalidRID{page.id, slotNumber}
 	}
+	switch page.getSlotFlags(slotNumber) {
+	case recordDeleted:
+		return RecordDeleted{page.id, slotNumber}
+	case recordForwarded:
+		return RecordForwarded{page.id, slotNumber, page.getForward(slotNumber)}
+	}
 	slotOffset := page.getSlotOffset(slotNumber)
 	slotLength := page.getSlotLength(slotNumber)
 	freeLength := page.getSlotLength(0)
@@ -304,16 +496,11 @@ func (page *heapPage) SetRecord(slotNumber int16, buf []byte) error {
 	case recordLength == int(slotLength): // record same length
 		// just update the slot
 		copy(page.slotTable[slotOffset:slotOffset+slotLength], buf)
-	case recordLength < int(slotLength): // record smaller than original length
-		if err := page.reallocateSlot(slotNumber, int16(recordLength)); err != nil {
-			panic(err) // TODO: replace panic once fully debugged
-		}
-		copy(page.slotTable[slotOffset:int(slotOffset)+recordLength], buf)
-		slotLength = int16(recordLength)
-	case recordLength < int(slotLength+freeLength): // still space enough in the page
+	case recordLength <= int(slotLength+freeLength): // record shrinks, or still space enough in the page
 		if err := page.reallocateSlot(slotNumber, int16(recordLength)); err != nil {
-			panic(err) // TODO: replace panic once fully debugged
+			return err
 		}
+		slotOffset = page.getSlotOffset(slotNumber) // reallocation moves the record
 		copy(page.slotTable[slotOffset:int(slotOffset)+recordLength], buf)
 	case recordLength < int(maxRecordLen):
 		return InsufficientPageSpace{PageID: page.id, Slot: slotNumber}
@@ -332,7 +519,7 @@ func (page *heapPage) DeleteRecord(slotNumber int16) error {
 	defer page.l.Unlock()
 
 	// recordNumber is 0 based
-	if slotNumber == 0 || slotNumber > page.slotCount-1 {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
 		return InvalidRID{page.id, slotNumber}
 	}
 	//slot := page.slots[slotNumber]
@@ -340,31 +527,122 @@ func (page *heapPage) DeleteRecord(slotNumber int16) error {
 		return nil // delete is idempotent
 	}
 	page.setSlotFlags(slotNumber, recordDeleted)
+	if page.version == heapPageVersion && page.getSlotVersion(slotNumber) < page.maxVersion {
+		page.deletedCount++
+	}
 	return page.compact() // TODO: compact later?
 }
 
-// TODO: implement
+// ForwardRecord replaces the record in slot with a forwarding stub pointing to to.
+// The slot keeps its number, so RIDs held by callers stay valid.
+func (page *heapPage) ForwardRecord(slotNumber int16, to RID) error {
+	page.l.Lock()
+	defer page.l.Unlock()
+
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return InvalidRID{page.id, slotNumber}
+	}
+	if page.getSlotFlags(slotNumber) == recordDeleted {
+		return RecordDeleted{page.id, slotNumber}
+	}
+	if length := page.getSlotLength(slotNumber); length != forwardStubLen {
+		if forwardStubLen > length+page.getSlotLength(0) {
+			return InsufficientPageSpace{PageID: page.id, Slot: slotNumber}
+		}
+		if err := page.reallocateSlot(slotNumber, forwardStubLen); err != nil {
+			return err
+		}
+	}
+	offset := page.getSlotOffset(slotNumber)
+	binary.LittleEndian.PutUint64(page.slotTable[offset:offset+8], uint64(to.PageID))
+	binary.LittleEndian.PutUint16(page.slotTable[offset+8:offset+forwardStubLen], uint16(to.Slot))
+	page.setSlotFlags(slotNumber, recordForwarded)
+	return nil
+}
+
+// MarkMoved flags the record in slot as having been moved here from another page.
+// Moved records are reached through their forwarding stub, so scanners skip them.
+func (page *heapPage) MarkMoved(slotNumber int16) error {
+	page.l.Lock()
+	defer page.l.Unlock()
+
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return InvalidRID{page.id, slotNumber}
+	}
+	flags := page.getSlotFlags(slotNumber)
+	if flags&recordOnPage == 0 {
+		return errors.New("Invalid record flag")
+	}
+	page.setSlotFlags(slotNumber, flags|recordMoved)
+	return nil
+}
+
+// IsMoved returns true if the record in slot was moved here from another page.
+func (page *heapPage) IsMoved(slotNumber int16) bool {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return false
+	}
+	return page.getSlotFlags(slotNumber)&recordMoved != 0
+}
+
+// SetCompressed flags the record in slot as stored compressed, or not.
+func (page *heapPage) SetCompressed(slotNumber int16, compressed bool) error {
+	page.l.Lock()
+	defer page.l.Unlock()
+
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return InvalidRID{page.id, slotNumber}
+	}
+	flags := page.getSlotFlags(slotNumber)
+	if flags&recordOnPage == 0 {
+		return errors.New("Invalid record flag")
+	}
+	if compressed {
+		page.setSlotFlags(slotNumber, flags|recordCompressed)
+	} else {
+		page.setSlotFlags(slotNumber, flags&^recordCompressed)
+	}
+	return nil
+}
+
+// IsCompressed returns true if the record in slot is stored compressed.
+func (page *heapPage) IsCompressed(slotNumber int16) bool {
+	if slotNumber < 1 || slotNumber > page.slotCount-1 {
+		return false
+	}
+	return page.getSlotFlags(slotNumber)&recordCompressed != 0
+}
+
+func (page *heapPage) getForward(slot int16) RID {
+	offset := page.getSlotOffset(slot)
+	return RID{
+		PageID: PageID(binary.LittleEndian.Uint64(page.slotTable[offset : offset+8])),
+		Slot:   int16(binary.LittleEndian.Uint16(page.slotTable[offset+8 : offset+forwardStubLen])),
+	}
+}
+
+// reallocateSlot resizes slot to requestedLength, compacting the page first. The slot keeps its flags
+// and as much of its current contents as fit.
 func (page *heapPage) reallocateSlot(slot int16, requestedLength int16) error {
 	// take a copy of the record
 	// temporarily delete then compact
 	// allocate new record length from freespace
 
 	flags := page.getSlotFlags(slot)
-	if flags != recordOnPage {
+	if flags == recordDeleted {
 		return errors.New("Invalid record flag")
 	}
 
 	buf := bufferPool.Get().([]byte)
-	buf = buf[0:requestedLength]
 	defer bufferPool.Put(buf)
 
 	offset := page.getSlotOffset(slot)
 	length := page.getSlotLength(slot)
-	copy(buf, page.slotTable[offset:offset+length]) // NB: requested length could be shorter than original
+	copy(buf[0:requestedLength], page.slotTable[offset:offset+length]) // NB: requested length could be shorter than original
 
 	page.setSlotFlags(slot, recordDeleted)
 	page.compact()
-	page.setSlotFlags(slot, recordOnPage)
+	page.setSlotFlags(slot, flags)
 
 	offset = page.getSlotOffset(0)
 	// make a new slot table entry
@@ -372,7 +650,7 @@ func (page *heapPage) reallocateSlot(slot int16, requestedLength int16) error {
 	page.setSlotLength(slot, requestedLength)
 	copy(page.slotTable[offset:offset+requestedLength], buf)
 	page.setSlotOffset(0, page.getSlotOffset(0)+requestedLength)
-	page.setSlotLength(0, slotTableLen-page.getSlotOffset(0)-(int16(page.slotCount+1)*slotTableEntryLen))
+	page.setSlotLength(0, slotTableLen-page.getSlotOffset(0)-(int16(page.slotCount+1)*page.entryLen))
 	if page.getSlotLength(0) < 0 {
 		page.setSlotLength(0, 0)
 	}
@@ -386,7 +664,7 @@ func (page *heapPage) compact() error {
 		// reset free space
 		page.setSlotFlags(0, recordOnPage)
 		page.setSlotOffset(0, 0)
-		page.setSlotLength(0, slotTableLen-(2*slotTableEntryLen))
+		page.setSlotLength(0, slotTableLen-(2*page.entryLen))
 		return nil
 	}
 
@@ -407,16 +685,16 @@ func (page *heapPage) compact() error {
 		case recordDeleted:
 			page.setSlotOffset(i, -1)
 			page.setSlotLength(i, -1)
-		case recordOnPage:
-			copy(buf[offset:offset+slotLength], page.bytes[slotOffset:slotOffset+slotLength])
+		default:
+			copy(buf[offset:offset+slotLength], page.slotTable[slotOffset:slotOffset+slotLength])
 			page.setSlotOffset(i, offset)
 			offset += slotLength
 		}
 	}
-	copy(buf[slotTableLen-((page.slotCount+1)*slotTableEntryLen):slotTableLen], page.slotTable[slotTableLen-((page.slotCount+1)*slotTableEntryLen):slotTableLen])
+	copy(buf[slotTableLen-((page.slotCount+1)*page.entryLen):slotTableLen], page.slotTable[slotTableLen-((page.slotCount+1)*page.entryLen):slotTableLen])
 	copy(page.slotTable, buf)
 	page.setSlotOffset(0, offset)
-	page.setSlotLength(0, slotTableLen-offset-((page.slotCount+1)*slotTableEntryLen))
+	page.setSlotLength(0, slotTableLen-offset-((page.slotCount+1)*page.entryLen))
 	return nil
 }
 
@@ -426,10 +704,12 @@ func (page *heapPage) Clear() error {
 	page.l.Lock()
 	defer page.l.Unlock()
 
+	page.version, page.entryLen = heapPageVersion, slotTableEntryLen
 	page.setSlotFlags(0, recordOnPage)
 	page.setSlotOffset(0, 0)
-	page.setSlotLength(0, slotTableLen-(2*slotTableEntryLen))
+	page.setSlotLength(0, slotTableLen-(2*page.entryLen))
 	page.slotCount = 1
+	page.deletedCount = 0
 
 	return nil
 }
@@ -2,6 +2,7 @@ package dbase
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
@@ -193,3 +194,116 @@ func BenchmarkFillPage(b *testing.B) {
 		}
 	}
 }
+
+func Test_ReuseDeletedSlots(t *testing.T) {
+	page := NewHeapPage()
+	recLen := 100
+	record := make([]byte, recLen)
+	for i := 0; i < 10; i++ {
+		if _, err := page.AddRecord(record); err != nil {
+			t.Fatalf("page.AddRecord, err: %s", err)
+		}
+	}
+	slotCount := page.GetSlotCount()
+
+	if err := page.DeleteRecord(3); err != nil {
+		t.Fatalf("page.DeleteRecord, err: %s", err)
+	}
+	if err := page.DeleteRecord(7); err != nil {
+		t.Fatalf("page.DeleteRecord, err: %s", err)
+	}
+
+	for _, expected := range []int16{3, 7, slotCount} {
+		slot, err := page.AddRecord(record)
+		if err != nil {
+			t.Fatalf("page.AddRecord, err: %s", err)
+		}
+		if slot != expected {
+			t.Errorf("reused slot, expected: %d, got: %d", expected, slot)
+		}
+	}
+	if page.GetSlotCount() != slotCount+1 {
+		t.Errorf("slotcount, expected: %d, got: %d", slotCount+1, page.GetSlotCount())
+	}
+
+	version, err := page.GetSlotVersion(3)
+	if err != nil {
+		t.Fatalf("page.GetSlotVersion, err: %s", err)
+	}
+	if version != 1 {
+		t.Errorf("slot version, expected: 1, got: %d", version)
+	}
+	version, _ = page.GetSlotVersion(1)
+	if version != 0 {
+		t.Errorf("slot version, expected: 0, got: %d", version)
+	}
+
+	// versions survive a marshal round trip
+	buf, _ := page.MarshalBinary()
+	page2 := NewHeapPage()
+	if err := page2.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("page2.UnmarshalBinary, err: %s", err)
+	}
+	if version, _ := page2.GetSlotVersion(7); version != 1 {
+		t.Errorf("slot version after unmarshal, expected: 1, got: %d", version)
+	}
+}
+
+func Test_VersionOnePage(t *testing.T) {
+	// a page written before slot versions: 5 byte slot table entries, and 0 in the version byte
+	records := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	buf := make([]byte, PageSize)
+	buf[pageTypeOffset] = byte(pageTypeHeap)
+	binary.LittleEndian.PutUint16(buf[slotCountOffset:], uint16(len(records)+1))
+	entry := func(slot int16, flags byte, offset int, length int) {
+		e := buf[int(slotTableOffset+slotTableLen-(slot+1)*slotTableEntryLenV1):]
+		e[0] = flags
+		binary.LittleEndian.PutUint16(e[1:], uint16(offset))
+		binary.LittleEndian.PutUint16(e[3:], uint16(length))
+	}
+	offset := 0
+	for i, record := range records {
+		copy(buf[int(slotTableOffset)+offset:], record)
+		entry(int16(i+1), recordOnPage, offset, len(record))
+		offset += len(record)
+	}
+	entry(0, recordOnPage, offset, int(slotTableLen)-offset-(len(records)+2)*int(slotTableEntryLenV1))
+
+	page := NewHeapPage()
+	if err := page.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("page.UnmarshalBinary, err: %s", err)
+	}
+	record := make([]byte, PageSize)
+	for i, expected := range records {
+		n, err := page.GetRecord(int16(i+1), record)
+		if err != nil || !bytes.Equal(record[0:n], expected) {
+			t.Errorf("record %d, expected: %q, got: %q, err: %v", i+1, expected, record[0:n], err)
+		}
+	}
+
+	// deleted slots aren't reused, having no version to tell the records apart
+	if err := page.DeleteRecord(2); err != nil {
+		t.Fatalf("page.DeleteRecord, err: %s", err)
+	}
+	slot, err := page.AddRecord([]byte("fourth"))
+	if err != nil || slot != 4 {
+		t.Errorf("page.AddRecord, expected: slot 4, got: %d, err: %v", slot, err)
+	}
+	out, _ := page.MarshalBinary()
+	if out[pageVersionOffset] != 0 {
+		t.Errorf("page version, expected: 0, got: %d", out[pageVersionOffset])
+	}
+	page2 := NewHeapPage()
+	if err := page2.UnmarshalBinary(out); err != nil {
+		t.Fatalf("page2.UnmarshalBinary, err: %s", err)
+	}
+	if n, err := page2.GetRecord(3, record); err != nil || string(record[0:n]) != "third" {
+		t.Errorf("record 3, expected: third, got: %q, err: %v", record[0:n], err)
+	}
+
+	// pages in a later format are refused
+	out[pageVersionOffset] = heapPageVersion + 1
+	if _, ok := page2.UnmarshalBinary(out).(ErrPageCorrupt); !ok {
+		t.Errorf("unknown page version, expected: ErrPageCorrupt, got: nil")
+	}
+}
@@ -1,23 +1,45 @@
 package dbase
 
 import (
+	"context"
 	"io"
+	"runtime"
 	"sync"
 )
 
 // HeapScanner is an iterable
 type HeapScanner interface {
 	Next(buf []byte) (RID, int, error)
+	// NextContext is Next, returning ctx.Err() if ctx is done before a page is read. The scan
+	// carries on from the same place on the next call.
+	NextContext(ctx context.Context, buf []byte) (RID, int, error)
+	// Close stops any read-ahead. Next returns io.EOF once the scanner is closed.
+	Close() error
+}
+
+// HeapScannerOptions is used to control a heap scanner
+type HeapScannerOptions struct {
+	// ReadAhead is the number of pages read in the background, ahead of the page being scanned;
+	// 0 reads each page when the scan reaches it. A page read ahead may miss changes made to it
+	// before the scan reaches it. Pages are read ahead as a batch if the store is a BatchPageStore.
+	ReadAhead int
+}
+
+// DefaultHeapScannerOptions - no read-ahead
+var DefaultHeapScannerOptions = &HeapScannerOptions{
+	ReadAhead: 0,
 }
 
 type heapScanner struct {
-	l      *sync.Mutex
-	heap   Heap
-	rid    RID
-	page   HeapPage
-	pageID PageID
-	slotID int16
-	state  int
+	l         *ctxMutex
+	heap      Heap
+	rid       RID
+	page      HeapPage
+	pageID    PageID
+	slotID    int16
+	state     int
+	readAhead int
+	ahead     *readAhead // nil unless reading ahead
 }
 
 // Scanner States
@@ -32,6 +54,9 @@ const (
 const (
 	_RecordRead int = 1 + iota
 	_DeletedRecordRead
+	_ForwardedRecordRead
+	_MovedRecordRead
+	_CorruptRecordRead
 	_EndOfPageReached
 	_PageRead
 	_EOF
@@ -39,20 +64,35 @@ const (
 
 // NewHeapScanner returns a new heap scanner
 func NewHeapScanner(heap Heap) HeapScanner {
+	return NewHeapScannerWithOptions(heap, nil)
+}
+
+// NewHeapScannerWithOptions returns a new heap scanner using options
+func NewHeapScannerWithOptions(heap Heap, options *HeapScannerOptions) HeapScanner {
+	if options == nil {
+		options = DefaultHeapScannerOptions
+	}
 	scanner := &heapScanner{
-		slotID: 0,
-		pageID: 0,
-		state:  _AtBOF,
-		heap:   heap,
-		page:   NewHeapPage(),
-		l:      &sync.Mutex{},
+		slotID:    0,
+		pageID:    0,
+		state:     _AtBOF,
+		heap:      heap,
+		page:      NewHeapPage(),
+		l:         newCtxMutex(),
+		readAhead: options.ReadAhead,
 	}
 	return scanner
 }
 
 func (scanner *heapScanner) Next(buf []byte) (RID, int, error) {
+	return scanner.NextContext(context.Background(), buf)
+}
 
-	scanner.l.Lock()
+func (scanner *heapScanner) NextContext(ctx context.Context, buf []byte) (RID, int, error) {
+
+	if err := scanner.l.LockContext(ctx); err != nil {
+		return RID{}, 0, err
+	}
 	defer scanner.l.Unlock()
 
 	var event int
@@ -61,34 +101,81 @@ func (scanner *heapScanner) Next(buf []byte) (RID, int, error) {
 
 		case _AtBOF:
 			//log.Println("AT_BOF")
+			if scanner.readAhead > 0 {
+				scanner.ahead = newReadAhead(scanner.heap.Store(), 1, scanner.readAhead)
+				// stop reading ahead if the scanner is dropped before the end of the scan
+				runtime.AddCleanup(scanner, func(ahead *readAhead) { ahead.close() }, scanner.ahead)
+			}
 			scanner.state = _ReadingPage
 		case _ReadingRecord:
 			//log.Print("READING_RECORD")
 			scanner.slotID++
-			n, err := scanner.page.GetRecord(scanner.slotID, buf)
-			if err != nil {
-				if _, ok := err.(RecordDeleted); ok {
-					event = _DeletedRecordRead
+			n, err := getRecord(scanner.page, scanner.slotID, buf)
+			switch err.(type) {
+			case nil:
+				if scanner.page.IsMoved(scanner.slotID) {
+					event = _MovedRecordRead
 				} else {
-					event = _EndOfPageReached
+					event = _RecordRead
 				}
-			} else {
-				event = _RecordRead
+			case RecordDeleted:
+				event = _DeletedRecordRead
+			case RecordForwarded:
+				event = _ForwardedRecordRead
+			case RecordCorrupt:
+				event = _CorruptRecordRead
+			default:
+				event = _EndOfPageReached
 			}
 			//log.Println(event)
 			switch event {
 			case _RecordRead:
 				scanner.state = _ReadingRecord
-				return RID{Slot: scanner.slotID, PageID: scanner.pageID}, n, nil
-			case _DeletedRecordRead:
+				return scanner.slotRID(), n, nil
+			case _ForwardedRecordRead:
+				// return the moved record under its home RID
+				scanner.state = _ReadingRecord
+				rid := scanner.slotRID()
+				n, err = scanner.heap.GetContext(ctx, rid, buf)
+				if err != nil && err == ctx.Err() {
+					// try this slot again on the next call
+					scanner.slotID--
+					return RID{}, 0, err
+				}
+				return rid, n, err
+			case _CorruptRecordRead:
+				// report the bad record, the next call carries on with the following slot
+				scanner.state = _ReadingRecord
+				return scanner.slotRID(), 0, err
+			case _DeletedRecordRead, _MovedRecordRead:
+				// moved records are returned via their forwarding stub
 				scanner.state = _ReadingRecord
 			case _EndOfPageReached:
 				scanner.state = _ReadingPage
 			}
 		case _ReadingPage:
 			//log.Print("READING_PAGE")
+			if err := ctx.Err(); err != nil {
+				return RID{}, 0, err
+			}
 			scanner.pageID++
-			err := scanner.heap.Store().Read(scanner.pageID, scanner.page)
+			var err error
+			if scanner.ahead != nil {
+				var page HeapPage
+				if page, err = scanner.ahead.next(ctx, scanner.page); err != nil && err == ctx.Err() {
+					// try this page again on the next call
+					scanner.pageID--
+					return RID{}, 0, err
+				}
+				if page != nil {
+					scanner.page = page
+				}
+			} else {
+				err = scanner.heap.Store().Read(scanner.pageID, scanner.page)
+			}
+			if err == ErrPageFree {
+				continue // skip pages freed from the store
+			}
 			if err != nil {
 				event = _EOF
 			} else {
@@ -109,3 +196,148 @@ func (scanner *heapScanner) Next(buf []byte) (RID, int, error) {
 		}
 	}
 }
+
+// Close stops any read-ahead.
+func (scanner *heapScanner) Close() error {
+	scanner.l.Lock()
+	defer scanner.l.Unlock()
+	if scanner.ahead != nil {
+		scanner.ahead.close()
+	}
+	scanner.state = _AtEOF
+	return nil
+}
+
+// readAhead reads the pages of a store in order, in the background, in batches of up to size
+// pages, keeping up to twice size pages ready for a scanner.
+type readAhead struct {
+	store PageStore
+	size  int
+	ready chan aheadPage // pages read, in page order
+	free  chan HeapPage  // pages the scanner has finished with
+	stop  chan struct{}
+	done  chan struct{} // closed when run returns
+	once  sync.Once
+}
+
+// aheadPage is a page read ahead, or the error that ended the read-ahead, or ErrPageFree for a
+// page skipped.
+type aheadPage struct {
+	page HeapPage
+	err  error
+}
+
+// newReadAhead starts reading store ahead from page id.
+func newReadAhead(store PageStore, id PageID, size int) *readAhead {
+	ahead := &readAhead{
+		store: store,
+		size:  size,
+		ready: make(chan aheadPage, 2*size+1),
+		free:  make(chan HeapPage, 2*size+1), // and the scanner's first page
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < 2*size; i++ {
+		ahead.free <- NewHeapPage()
+	}
+	go ahead.run(id)
+	return ahead
+}
+
+// next returns the next page read, or the error that ended the read-ahead, or ctx.Err() if ctx
+// is done first. done is the page the scanner has finished with, read into again.
+func (ahead *readAhead) next(ctx context.Context, done HeapPage) (HeapPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case p := <-ahead.ready:
+		if p.err != nil {
+			return nil, p.err
+		}
+		ahead.free <- done
+		return p.page, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// close stops the read-ahead, waiting for any read in progress.
+func (ahead *readAhead) close() {
+	ahead.once.Do(func() { close(ahead.stop) })
+	<-ahead.done
+}
+
+// run reads the pages from id on, until one can't be read, the end of the store, or close.
+func (ahead *readAhead) run(id PageID) {
+	defer close(ahead.done)
+	ids := make([]PageID, 0, ahead.size)
+	pages := make([]Page, 0, ahead.size)
+	for {
+		// wait for a free page, then take any others free, up to size and the end of the store
+		ids, pages = ids[:0], pages[:0]
+		count := PageID(ahead.store.Count())
+	take:
+		for len(ids) < ahead.size && id+PageID(len(ids)) < count {
+			var page HeapPage
+			if len(ids) == 0 {
+				select {
+				case page = <-ahead.free:
+				case <-ahead.stop:
+					return
+				}
+			} else {
+				select {
+				case page = <-ahead.free:
+				default:
+					break take
+				}
+			}
+			ids = append(ids, id+PageID(len(ids)))
+			pages = append(pages, page)
+		}
+		if len(ids) == 0 {
+			ahead.send(aheadPage{err: io.EOF})
+			return
+		}
+
+		batchErr := readPages(ahead.store, ids, pages)
+		for i := range ids {
+			var err error
+			if batchErr != nil {
+				// read the pages in turn, to find the free pages and the first that can't be read
+				err = ahead.store.Read(ids[i], pages[i])
+			}
+			if err == ErrPageFree {
+				ahead.free <- pages[i].(HeapPage)
+			} else if err != nil {
+				ahead.send(aheadPage{err: err})
+				return
+			}
+			p := aheadPage{err: err}
+			if err == nil {
+				p.page = pages[i].(HeapPage)
+			}
+			if !ahead.send(p) {
+				return
+			}
+		}
+		id += PageID(len(ids))
+	}
+}
+
+// send passes p to the scanner, returning false if the read-ahead has been closed.
+func (ahead *readAhead) send(p aheadPage) bool {
+	select {
+	case ahead.ready <- p:
+		return true
+	case <-ahead.stop:
+		return false
+	}
+}
+
+// slotRID returns the RID of the slot being read, at the slot's current version.
+func (scanner *heapScanner) slotRID() RID {
+	version, _ := scanner.page.GetSlotVersion(scanner.slotID)
+	return RID{PageID: scanner.pageID, Slot: scanner.slotID, Version: version}
+}
@@ -0,0 +1,184 @@
+package dbase
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	randstr "github.com/trpedersen/rand"
+)
+
+// scanAll returns the RIDs and records returned by scanner, in order.
+func scanAll(t *testing.T, scanner HeapScanner) ([]RID, [][]byte) {
+	var rids []RID
+	var records [][]byte
+	buf := make([]byte, maxRecordLen)
+	for {
+		rid, n, err := scanner.Next(buf)
+		if err == io.EOF {
+			return rids, records
+		} else if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		rids = append(rids, rid)
+		records = append(records, append([]byte(nil), buf[0:n]...))
+	}
+}
+
+func TestHeapScannerReadAhead(t *testing.T) {
+
+	path := tempfile()
+	file, err := Open(path, 0666, &FileStoreOptions{IOUring: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(path)
+	}()
+	memory, _ := NewMemoryStore()
+
+	for name, store := range map[string]PageStore{"file": file, "memory": memory} {
+		t.Run(name, func(t *testing.T) {
+			heap := NewHeap(store)
+			var rids []RID
+			for i := 0; i < 3000; i++ {
+				rid, err := heap.Put(jsonRecord(i))
+				if err != nil {
+					t.Fatalf("heap.Put, err: %s", err)
+				}
+				rids = append(rids, rid)
+			}
+			// deleted and forwarded records
+			for i := 0; i < len(rids); i += 7 {
+				if err := heap.Delete(rids[i]); err != nil {
+					t.Fatalf("heap.Delete, err: %s", err)
+				}
+			}
+			if err := heap.Set(rids[1], []byte(randstr.RandStr(4000, "alphanum"))); err != nil {
+				t.Fatalf("heap.Set, err: %s", err)
+			}
+
+			wantRIDs, wantRecords := scanAll(t, NewHeapScanner(heap))
+			if int64(len(wantRIDs)) != heap.Count() {
+				t.Fatalf("scan count, expected: %d, got: %d", heap.Count(), len(wantRIDs))
+			}
+			for _, readAhead := range []int{1, 4, 64} {
+				scanner := NewHeapScannerWithOptions(heap, &HeapScannerOptions{ReadAhead: readAhead})
+				gotRIDs, gotRecords := scanAll(t, scanner)
+				if len(gotRIDs) != len(wantRIDs) {
+					t.Fatalf("read-ahead %d scan count, expected: %d, got: %d", readAhead, len(wantRIDs), len(gotRIDs))
+				}
+				for i := range wantRIDs {
+					if gotRIDs[i] != wantRIDs[i] || !bytes.Equal(gotRecords[i], wantRecords[i]) {
+						t.Fatalf("read-ahead %d record %d, expected: %v %.20s, got: %v %.20s", readAhead, i, wantRIDs[i], wantRecords[i], gotRIDs[i], gotRecords[i])
+					}
+				}
+				scanner.Close()
+			}
+
+			// a cancelled scan carries on where it stopped, and a closed one stops
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			scanner := NewHeapScannerWithOptions(heap, &HeapScannerOptions{ReadAhead: 8})
+			buf := make([]byte, maxRecordLen)
+			var count int
+			for ; count < len(wantRIDs)/2; count++ {
+				if _, _, err := scanner.NextContext(cancelled, buf); err != nil && err != context.Canceled {
+					t.Fatalf("scanner.NextContext, expected: %v or nil, got: %v", context.Canceled, err)
+				}
+				rid, _, err := scanner.Next(buf)
+				if err != nil {
+					t.Fatalf("scanner.Next, err: %s", err)
+				}
+				if rid != wantRIDs[count] {
+					// the cancelled call returned a record from the current page
+					if rid != wantRIDs[count+1] {
+						t.Fatalf("scan after cancel, expected: %v, got: %v", wantRIDs[count+1], rid)
+					}
+					count++
+				}
+			}
+			if err := scanner.Close(); err != nil {
+				t.Fatalf("scanner.Close, err: %s", err)
+			}
+			if _, _, err := scanner.Next(buf); err != io.EOF {
+				t.Errorf("scanner.Next after Close, expected: %v, got: %v", io.EOF, err)
+			}
+		})
+	}
+}
+
+// slowStore adds latency to each read of a file store, and to each batch of reads, as a device
+// would.
+type slowStore struct {
+	FileStore
+	latency time.Duration
+}
+
+func (store slowStore) Read(id PageID, page Page) error {
+	time.Sleep(store.latency)
+	return store.FileStore.Read(id, page)
+}
+
+func (store slowStore) ReadBatch(ids []PageID, pages []Page) error {
+	time.Sleep(store.latency)
+	return store.FileStore.ReadBatch(ids, pages)
+}
+
+func BenchmarkHeapScan(b *testing.B) {
+	path := tempfile()
+	store, _ := Open(path, 0666, &FileStoreOptions{IOUring: true})
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	writer, _ := NewHeapWriter(store)
+	record := []byte(randstr.RandStr(100, "alphanum"))
+	for i := 0; i < 100000; i++ {
+		if _, err := writer.Write(record); err != nil {
+			b.Fatalf("writer.Write, err: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatalf("writer.Close, err: %s", err)
+	}
+	heaps := []struct {
+		name string
+		heap Heap
+	}{
+		{"cached", NewHeap(store)},
+		{"slow", NewHeap(slowStore{store, 100 * time.Microsecond})},
+	}
+
+	for _, h := range heaps {
+		heap := h.heap
+		for _, readAhead := range []int{0, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/ReadAhead=%d", h.name, readAhead), func(b *testing.B) {
+				b.SetBytes(store.Count() * int64(PageSize))
+				buf := make([]byte, maxRecordLen)
+				for i := 0; i < b.N; i++ {
+					scanner := NewHeapScannerWithOptions(heap, &HeapScannerOptions{ReadAhead: readAhead})
+					var count int64
+					for {
+						_, _, err := scanner.Next(buf)
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							b.Fatalf("scanner.Next, err: %s", err)
+						}
+						count++
+					}
+					if count != heap.Count() {
+						b.Fatalf("scan count, expected: %d, got: %d", heap.Count(), count)
+					}
+					scanner.Close()
+				}
+			})
+		}
+	}
+}
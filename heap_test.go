@@ -3,6 +3,7 @@ package dbase
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"log"
 	"math/rand"
 	"os"
@@ -119,6 +120,139 @@ func Test_HeapDelete(t *testing.T) {
 	}
 }
 
+func Test_HeapDeleteCount(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+
+	var rids []RID
+	for i := 0; i < 3; i++ {
+		rid, err := heap.Put(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+	// a forwarded record is counted once
+	if err := heap.Set(rids[1], make([]byte, 8000)); err != nil {
+		t.Fatalf("heap.Set, err: %s", err)
+	}
+	for _, rid := range rids[0:2] {
+		if err := heap.Delete(rid); err != nil {
+			t.Fatalf("heap.Delete %v, err: %s", rid, err)
+		}
+	}
+	if heap.Count() != 1 {
+		t.Errorf("Record count after deletes, expected: 1, got: %d", heap.Count())
+	}
+	// deleting again does nothing
+	if err := heap.Delete(rids[0]); err != nil {
+		t.Errorf("heap.Delete again, expected: nil, got: %s", err)
+	}
+	if heap.Count() != 1 {
+		t.Errorf("Record count after deleting again, expected: 1, got: %d", heap.Count())
+	}
+	if heap, err := OpenHeap(store); err != nil || heap.Count() != 1 {
+		t.Errorf("Reopened record count, expected: 1, got: %d, err: %v", heap.Count(), err)
+	}
+}
+
+func Test_HeapStaleRID(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+
+	old, err := heap.Put([]byte("old"))
+	if err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+	if err := heap.Delete(old); err != nil {
+		t.Fatalf("heap.Delete, err: %s", err)
+	}
+	rid, err := heap.Put([]byte("new"))
+	if err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+	if rid.PageID != old.PageID || rid.Slot != old.Slot || rid.Version != old.Version+1 {
+		t.Fatalf("reused RID, expected: %d:%d version %d, got: %+v", old.PageID, old.Slot, old.Version+1, rid)
+	}
+
+	// the old RID is stale, and leaves the record that reused its slot alone
+	buf := make([]byte, PageSize)
+	if _, err := heap.Get(old, buf); err != (StaleRID{old, rid.Version}) {
+		t.Errorf("heap.Get stale, expected: StaleRID, got: %v", err)
+	}
+	if err := heap.Set(old, []byte("changed")); err != (StaleRID{old, rid.Version}) {
+		t.Errorf("heap.Set stale, expected: StaleRID, got: %v", err)
+	}
+	if err := heap.Delete(old); err != (StaleRID{old, rid.Version}) {
+		t.Errorf("heap.Delete stale, expected: StaleRID, got: %v", err)
+	}
+	if _, err := heap.GetBatch([]RID{old}, [][]byte{buf}); err != (StaleRID{old, rid.Version}) {
+		t.Errorf("heap.GetBatch stale, expected: StaleRID, got: %v", err)
+	}
+	if err := heap.DeleteBatch([]RID{old}); err != (StaleRID{old, rid.Version}) {
+		t.Errorf("heap.DeleteBatch stale, expected: StaleRID, got: %v", err)
+	}
+	if n, err := heap.Get(rid, buf); err != nil || string(buf[0:n]) != "new" {
+		t.Errorf("heap.Get, expected: new, got: %q, err: %v", buf[0:n], err)
+	}
+	if scanned, _, err := NewHeapScanner(heap).Next(buf); err != nil || scanned != rid {
+		t.Errorf("scanner.Next, expected: %+v, got: %+v, err: %v", rid, scanned, err)
+	}
+
+	// a heap with one slot version never reuses slots
+	store, _ = NewMemoryStore()
+	heap, err = OpenHeapWithOptions(store, &HeapOptions{SlotVersions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ = heap.Put([]byte("old"))
+	heap.Delete(old)
+	if rid, _ = heap.Put([]byte("new")); rid.Slot == old.Slot {
+		t.Errorf("SlotVersions 1, expected: a new slot, got: slot %d reused", rid.Slot)
+	}
+	if _, err := OpenHeapWithOptions(store, &HeapOptions{SlotVersions: 257}); err == nil {
+		t.Errorf("SlotVersions 257, expected: error, got: nil")
+	}
+}
+
+func Test_HeapSlotVersionLimit(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap, err := OpenHeapWithOptions(store, &HeapOptions{SlotVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := heap.Put([]byte("first"))
+	heap.Delete(first)
+	second, _ := heap.Put([]byte("second"))
+	if second.Slot != first.Slot || second.Version != 1 {
+		t.Fatalf("reused RID, expected: slot %d version 1, got: %+v", first.Slot, second)
+	}
+
+	// deleted at the last version, the slot is retired, and not counted as free for reuse
+	if err := heap.Delete(second); err != nil {
+		t.Fatalf("heap.Delete, err: %s", err)
+	}
+	page := newRawPage()
+	if err := store.Read(second.PageID, page); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := binary.LittleEndian.Uint16(page.bytes[deletedCountOffset:]); deleted != 0 {
+		t.Errorf("deleted count, expected: 0, got: %d", deleted)
+	}
+	if rid, _ := heap.Put([]byte("third")); rid.Slot == second.Slot {
+		t.Errorf("retired slot, expected: a new slot, got: slot %d reused", rid.Slot)
+	}
+	if report := CheckWithOptions(store, &CheckOptions{SlotVersions: 2}); !report.OK() {
+		t.Errorf("Check, expected: no problems, got:\n%s", report)
+	}
+	if report := Check(store); report.OK() {
+		t.Errorf("Check with the default SlotVersions, expected: a deleted count problem, got: none")
+	}
+}
+
 func Test_FileUploadSequential(t *testing.T) {
 
 	datapath := "d:/algs4-data/leipzig1M.txt"
@@ -327,3 +461,120 @@ func logElapsedTime(start time.Time, name string) {
 	elapsed := time.Since(start)
 	log.Printf("%s took %s", name, elapsed)
 }
+
+func Test_HeapSetForwarding(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+
+	records := make(map[RID][]byte)
+	var rids []RID
+	for i := 0; i < 100; i++ {
+		record := []byte(randstr.RandStr(70, "alphanum"))
+		rid, err := heap.Put(record)
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = record
+		rids = append(rids, rid)
+	}
+
+	// grow a record on a full page beyond the space left, then grow it again
+	rid := rids[0]
+	for _, l := range []int{3000, 6000, 20} {
+		record := []byte(randstr.RandStr(l, "alphanum"))
+		if err := heap.Set(rid, record); err != nil {
+			t.Fatalf("heap.Set, len: %d, err: %s", l, err)
+		}
+		records[rid] = record
+	}
+
+	buf := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+
+	scanner := NewHeapScanner(heap)
+	var scans int
+	for {
+		rid, n, err := scanner.Next(buf)
+		if err != nil {
+			break
+		}
+		scans++
+		if !bytes.Equal(records[rid], buf[0:n]) {
+			t.Fatalf("scanner.Next %v, expecting: %s, got: %s", rid, records[rid], buf[0:n])
+		}
+	}
+	if scans != len(records) {
+		t.Errorf("scan count, expected: %d, got: %d", len(records), scans)
+	}
+
+	if err := heap.Delete(rid); err != nil {
+		t.Fatalf("heap.Delete, err: %s", err)
+	}
+	if _, err := heap.Get(rid, buf); err == nil {
+		t.Fatalf("heap.Get after delete, expected: RECORD_DELETED, got: nil")
+	}
+}
+
+func Test_OpenHeapErrors(t *testing.T) {
+
+	// a store that doesn't hold a heap
+	store, _ := NewMemoryStore()
+	store.Append(NewOverflowPage())
+	_, err := OpenHeap(store)
+	expected := ErrWrongPageType{Want: pageTypeHeapHeader, Got: pageTypeOverflow, PageID: 0}
+	if err != expected {
+		t.Errorf("OpenHeap overflow page, expected: %v, got: %v", expected, err)
+	}
+
+	if _, err := OpenHeapWithOptions(store, &HeapOptions{Compress: true, CompressionLevel: 42}); err == nil {
+		t.Errorf("OpenHeapWithOptions bad compression level, expected: error, got: nil")
+	}
+
+	// a heap page with a damaged slot table
+	store, _ = NewMemoryStore()
+	heap, err := OpenHeap(store)
+	if err != nil {
+		t.Fatalf("OpenHeap, err: %s", err)
+	}
+	rid, _ := heap.Put([]byte("record"))
+	raw := newRawPage()
+	store.Read(rid.PageID, raw)
+	binary.LittleEndian.PutUint16(raw.bytes[slotCountOffset:], 0x7fff)
+	store.Write(rid.PageID, raw)
+	buf := make([]byte, PageSize)
+	if _, err := heap.Get(rid, buf); err == nil {
+		t.Errorf("heap.Get damaged page, expected: error, got: nil")
+	} else if _, ok := err.(ErrPageCorrupt); !ok {
+		t.Errorf("heap.Get damaged page, expected: ErrPageCorrupt, got: %v", err)
+	}
+	if _, err := OpenHeap(store); err == nil {
+		t.Errorf("OpenHeap damaged last page, expected: error, got: nil")
+	}
+
+	page := NewHeapPage()
+	if err := page.UnmarshalBinary(buf[0:10]); err != ErrInvalidBuffer {
+		t.Errorf("UnmarshalBinary short buffer, expected: %v, got: %v", ErrInvalidBuffer, err)
+	}
+	if _, err := page.GetRecord(-1, buf); err == nil {
+		t.Errorf("GetRecord slot -1, expected: error, got: nil")
+	}
+	if err := page.SetRecord(-1, buf[0:10]); err == nil {
+		t.Errorf("SetRecord slot -1, expected: error, got: nil")
+	}
+
+	// an overflow page without a segment round trips
+	overflow := NewOverflowPage()
+	b, _ := overflow.MarshalBinary()
+	if err := NewOverflowPage().UnmarshalBinary(b); err != nil {
+		t.Errorf("overflow UnmarshalBinary, err: %s", err)
+	}
+}
@@ -0,0 +1,196 @@
+package dbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HeapWriter bulk loads records into a heap. Pages are filled in memory and appended to the store
+// as each one fills, and the heap header page is written once, on Close.
+//
+// The store must not be used by a Heap while a HeapWriter is open; open the Heap after Close.
+type HeapWriter interface {
+	// Write adds buf to the heap, returning the RID the record will have once the writer is closed.
+	Write(buf []byte) (RID, error)
+	// Count returns the number of records written so far.
+	Count() int64
+	// Close flushes the last page and updates the heap header page.
+	Close() error
+}
+
+type heapWriter struct {
+	store      PageStore
+	headerPage HeapHeaderPage
+	page       HeapPage
+	pageID     PageID // id the current page will be given when appended
+	pages      int64  // pages appended by the writer
+	count      int64
+	compressor *compressor // nil if records aren't compressed
+	indexes    []IndexBuilder
+	closed     bool
+}
+
+// IndexBuilder builds an index over the records written by a HeapWriter. Records are added in RID
+// order, so an index over records loaded in key order can be built bottom-up, filling each index
+// page in turn, rather than by inserting one key at a time.
+type IndexBuilder interface {
+	// Add indexes record buf, which will have RID rid.
+	Add(rid RID, buf []byte) error
+	// Finish completes the index, once every record has been added. It is called by Close.
+	Finish() error
+}
+
+// NewHeapWriter returns a HeapWriter that appends to the heap in store, initialising a new heap if
+// the store is empty. Records are always written to new pages at the end of the store.
+func NewHeapWriter(store PageStore) (HeapWriter, error) {
+	return NewHeapWriterWithOptions(store, nil)
+}
+
+// NewHeapWriterWithOptions returns a HeapWriter, as NewHeapWriter, that compresses records as a heap
+// opened with options would, and adds each record written to indexes.
+func NewHeapWriterWithOptions(store PageStore, options *HeapOptions, indexes ...IndexBuilder) (HeapWriter, error) {
+	writer := &heapWriter{
+		store:      store,
+		headerPage: NewHeapHeaderPage(),
+		page:       NewHeapPage(),
+		indexes:    indexes,
+	}
+	if options == nil {
+		options = DefaultHeapOptions
+	}
+	if options.Compress {
+		var err error
+		if writer.compressor, err = newCompressor(options.CompressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	if store.Count() == 0 {
+		if _, err := store.Append(writer.headerPage); err != nil {
+			return nil, err
+		}
+	} else if err := store.Read(0, writer.headerPage); err != nil {
+		return nil, err
+	}
+	writer.pageID = PageID(store.Count())
+	return writer, nil
+}
+
+// BulkLoad creates or appends to the heap in store with the records returned by next, until next
+// returns io.EOF. Returns the number of records loaded.
+func BulkLoad(store PageStore, next func() ([]byte, error)) (int64, error) {
+	return BulkLoadWithOptions(store, nil, next)
+}
+
+// BulkLoadWithOptions is BulkLoad through a HeapWriter made with NewHeapWriterWithOptions.
+func BulkLoadWithOptions(store PageStore, options *HeapOptions, next func() ([]byte, error), indexes ...IndexBuilder) (int64, error) {
+	writer, err := NewHeapWriterWithOptions(store, options, indexes...)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		buf, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			writer.Close()
+			return writer.Count(), err
+		}
+		if _, err := writer.Write(buf); err != nil {
+			writer.Close()
+			return writer.Count(), err
+		}
+	}
+	return writer.Count(), writer.Close()
+}
+
+func (writer *heapWriter) Write(buf []byte) (RID, error) {
+	var rid RID
+
+	if writer.closed {
+		return rid, errors.New("HeapWriter closed")
+	}
+	if len(buf) == 0 {
+		return rid, errors.New("Zero length record")
+	}
+	// checked before flushing, so a record that can't be written doesn't leave an empty page
+	if len(buf) > int(maxRecordLen) {
+		return rid, RecordExceedsMaxSize{Len: len(buf)}
+	}
+	stored, compressed := buf, false
+	if writer.compressor != nil {
+		var err error
+		if stored, compressed, err = writer.compressor.compress(buf); err != nil {
+			return rid, err
+		}
+	}
+	if len(stored) > writer.page.GetFreeSpace() {
+		if err := writer.flush(); err != nil {
+			return rid, err
+		}
+	}
+	slot, err := writer.page.AddRecord(stored)
+	if err != nil {
+		return rid, err
+	}
+	if compressed {
+		if err := writer.page.SetCompressed(slot, true); err != nil {
+			return rid, err
+		}
+	}
+	writer.count++
+	rid.PageID = writer.pageID
+	rid.Slot = slot
+	rid.Version, _ = writer.page.GetSlotVersion(slot)
+	for _, index := range writer.indexes {
+		if err := index.Add(rid, buf); err != nil {
+			return rid, err
+		}
+	}
+	return rid, nil
+}
+
+func (writer *heapWriter) Count() int64 {
+	return writer.count
+}
+
+func (writer *heapWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+	writer.closed = true
+
+	// always leave a last page, even if empty, for a new heap
+	if writer.page.GetSlotCount() > 1 || writer.store.Count() == 1 {
+		if err := writer.flush(); err != nil {
+			return err
+		}
+	}
+	if writer.pages > 0 {
+		writer.headerPage.SetLastPageID(writer.pageID - 1)
+	}
+	writer.headerPage.SetRecordCount(writer.headerPage.GetRecordCount() + writer.count)
+	if err := writer.store.Write(0, writer.headerPage); err != nil {
+		return err
+	}
+	for _, index := range writer.indexes {
+		if err := index.Finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush appends the current page to the store and starts a new one.
+func (writer *heapWriter) flush() error {
+	id, err := writer.store.Append(writer.page)
+	if err != nil {
+		return err
+	}
+	if id != writer.pageID {
+		return fmt.Errorf("HeapWriter: store appended page %d, expected %d; is the store in use?", id, writer.pageID)
+	}
+	writer.pageID++
+	writer.pages++
+	return writer.page.Clear()
+}
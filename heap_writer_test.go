@@ -0,0 +1,219 @@
+package dbase
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	randstr "github.com/trpedersen/rand"
+)
+
+func Test_BulkLoad(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+
+	records := make([][]byte, 10000)
+	for i := range records {
+		records[i] = []byte(randstr.RandStr(1+i%300, "alphanum"))
+	}
+	var i int
+	next := func() ([]byte, error) {
+		if i == len(records) {
+			return nil, io.EOF
+		}
+		i++
+		return records[i-1], nil
+	}
+	n, err := BulkLoad(store, next)
+	if err != nil {
+		t.Fatalf("BulkLoad, err: %s", err)
+	}
+	if n != int64(len(records)) {
+		t.Fatalf("BulkLoad count, expected: %d, got: %d", len(records), n)
+	}
+
+	heap := NewHeap(store)
+	if heap.Count() != int64(len(records)) {
+		t.Fatalf("Record count, expected: %d, got: %d", len(records), heap.Count())
+	}
+
+	buf := make([]byte, maxRecordLen)
+	scanner := NewHeapScanner(heap)
+	for i := range records {
+		_, n, err := scanner.Next(buf)
+		if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		if !bytes.Equal(records[i], buf[0:n]) {
+			t.Fatalf("scanner.Next, expecting: %s, got: %s", records[i], buf[0:n])
+		}
+	}
+	if _, _, err := scanner.Next(buf); err != io.EOF {
+		t.Fatalf("scanner.Next, expected: EOF, got: %v", err)
+	}
+
+	// the loaded heap can be added to as normal
+	rid, err := heap.Put(records[0])
+	if err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+	if rid.PageID != PageID(store.Count()-1) {
+		t.Errorf("heap.Put page, expected: %d, got: %d", store.Count()-1, rid.PageID)
+	}
+}
+
+func Test_HeapWriterRIDs(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	heap := NewHeap(store)
+	if _, err := heap.Put([]byte("existing")); err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+
+	writer, err := NewHeapWriter(store)
+	if err != nil {
+		t.Fatalf("NewHeapWriter, err: %s", err)
+	}
+	records := make(map[RID][]byte)
+	for i := 0; i < 1000; i++ {
+		record := []byte(randstr.RandStr(100, "alphanum"))
+		rid, err := writer.Write(record)
+		if err != nil {
+			t.Fatalf("writer.Write, err: %s", err)
+		}
+		records[rid] = record
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("writer.Close, err: %s", err)
+	}
+
+	heap = NewHeap(store)
+	if heap.Count() != 1001 {
+		t.Fatalf("Record count, expected: 1001, got: %d", heap.Count())
+	}
+	buf := make([]byte, maxRecordLen)
+	for rid, record := range records {
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(record, buf[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, record, buf[0:n])
+		}
+	}
+}
+
+// ridIndex is an IndexBuilder that keeps the RIDs added, in order
+type ridIndex struct {
+	rids     []RID
+	finished bool
+}
+
+func (index *ridIndex) Add(rid RID, buf []byte) error {
+	index.rids = append(index.rids, rid)
+	return nil
+}
+
+func (index *ridIndex) Finish() error {
+	index.finished = true
+	return nil
+}
+
+func Test_HeapWriterOptions(t *testing.T) {
+
+	store, _ := NewMemoryStore()
+	index := &ridIndex{}
+	writer, err := NewHeapWriterWithOptions(store, &HeapOptions{Compress: true, CompressionLevel: 1}, index)
+	if err != nil {
+		t.Fatalf("NewHeapWriterWithOptions, err: %s", err)
+	}
+	var rids []RID
+	for i := 0; i < 1000; i++ {
+		rid, err := writer.Write(jsonRecord(i))
+		if err != nil {
+			t.Fatalf("writer.Write, err: %s", err)
+		}
+		rids = append(rids, rid)
+	}
+
+	// a record too long is rejected without leaving an empty page behind
+	count := store.Count()
+	for i := 0; i < 3; i++ {
+		if _, err := writer.Write(make([]byte, maxRecordLen+1)); err == nil {
+			t.Fatalf("writer.Write too long, expected: RecordExceedsMaxSize, got: nil")
+		}
+	}
+	if store.Count() != count {
+		t.Errorf("store pages after writes too long, expected: %d, got: %d", count, store.Count())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("writer.Close, err: %s", err)
+	}
+
+	if !index.finished || len(index.rids) != len(rids) {
+		t.Fatalf("index, expected: %d RIDs and finished, got: %d, finished: %v", len(rids), len(index.rids), index.finished)
+	}
+	heap := NewHeap(store)
+	buf := make([]byte, maxRecordLen)
+	compressed := 0
+	for i, rid := range rids {
+		if index.rids[i] != rid {
+			t.Fatalf("index RID %d, expected: %v, got: %v", i, rid, index.rids[i])
+		}
+		n, err := heap.Get(rid, buf)
+		if err != nil {
+			t.Fatalf("heap.Get %v, err: %s", rid, err)
+		}
+		if !bytes.Equal(jsonRecord(i), buf[0:n]) {
+			t.Fatalf("heap.Get %v, expecting: %s, got: %s", rid, jsonRecord(i), buf[0:n])
+		}
+		page := NewHeapPage()
+		store.Read(rid.PageID, page)
+		if page.IsCompressed(rid.Slot) {
+			compressed++
+		}
+	}
+	if compressed == 0 {
+		t.Errorf("compressed records, expected: some, got: none")
+	}
+}
+
+func BenchmarkHeapPut(b *testing.B) {
+	path := tempfile()
+	store, _ := Open(path, 0666, nil)
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	heap := NewHeap(store)
+	record := []byte(randstr.RandStr(100, "alphanum"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := heap.Put(record); err != nil {
+			b.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+}
+
+func BenchmarkHeapWriter(b *testing.B) {
+	path := tempfile()
+	store, _ := Open(path, 0666, nil)
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	writer, _ := NewHeapWriter(store)
+	record := []byte(randstr.RandStr(100, "alphanum"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write(record); err != nil {
+			b.Fatalf("writer.Write, err: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatalf("writer.Close, err: %s", err)
+	}
+}
@@ -0,0 +1,190 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// PageInfo is the decoded contents of a page, for debugging storage layout. Only the field for
+// the page's type is set.
+type PageInfo struct {
+	ID         PageID              `json:"id"`
+	HeaderID   PageID              `json:"header_id"` // page ID recorded in the page header
+	Type       string              `json:"type"`
+	TypeCode   byte                `json:"type_code"`
+	LSN        LSN                 `json:"lsn"`
+	Checksum   uint32              `json:"checksum"`
+	ChecksumOK bool                `json:"checksum_ok"`
+	Heap       *HeapPageInfo       `json:"heap,omitempty"`
+	HeapHeader *HeapHeaderPageInfo `json:"heap_header,omitempty"`
+	Overflow   *OverflowPageInfo   `json:"overflow,omitempty"`
+	Allocation *AllocationPageInfo `json:"allocation,omitempty"`
+}
+
+// HeapPageInfo is the decoded slot table of a heap page.
+type HeapPageInfo struct {
+	Version      byte       `json:"version"` // page format, 0 for pages without slot versions
+	SlotCount    int16      `json:"slot_count"`
+	DeletedCount int16      `json:"deleted_count"`
+	FreeOffset   int16      `json:"free_offset"`
+	FreeSpace    int16      `json:"free_space"`
+	Slots        []SlotInfo `json:"slots"`
+}
+
+// SlotInfo is a decoded heap page slot table entry.
+type SlotInfo struct {
+	Slot    int16  `json:"slot"`
+	Flags   byte   `json:"flags"`
+	State   string `json:"state"` // flags by name, e.g. "on page|compressed"
+	Version byte   `json:"version"`
+	Offset  int16  `json:"offset"`
+	Length  int16  `json:"length"`
+	To      *RID   `json:"to,omitempty"` // forwarding stubs only
+}
+
+// HeapHeaderPageInfo is the decoded heap header page.
+type HeapHeaderPageInfo struct {
+	LastPageID  PageID `json:"last_page_id"`
+	RecordCount int64  `json:"record_count"`
+}
+
+// OverflowPageInfo is the decoded overflow page header.
+type OverflowPageInfo struct {
+	PreviousPageID PageID `json:"previous_page_id"`
+	NextPageID     PageID `json:"next_page_id"`
+	SegmentID      int32  `json:"segment_id"`
+	SegmentLength  int    `json:"segment_length"`
+}
+
+// AllocationPageInfo summarises an allocation page bitmap.
+type AllocationPageInfo struct {
+	Bits           int `json:"bits"`
+	Allocated      int `json:"allocated"`
+	FirstFree      int `json:"first_free"` // -1 if every bit is allocated
+	LargestFreeRun int `json:"largest_free_run"`
+}
+
+// InspectPage reads page id from store and decodes it. The raw page image is returned too. A page
+// that fails its checksum is still decoded, with ChecksumOK false, as is a free page, if store is a
+// RawPageReader. Allocation page k of a store's allocation map is page -(k+1).
+func InspectPage(store PageStore, id PageID) (*PageInfo, []byte, error) {
+	page := newRawPage()
+	if raw, ok := store.(RawPageReader); ok {
+		// read around the checksum and free page checks, to see damaged pages
+		if err := raw.ReadRaw(id, page.bytes); err != nil {
+			return nil, nil, err
+		}
+	} else if err := store.Read(id, page); err != nil {
+		return nil, nil, err
+	}
+	return decodePageInfo(id, page.bytes), page.bytes, nil
+}
+
+func decodePageInfo(id PageID, b []byte) *PageInfo {
+	info := &PageInfo{
+		ID:         id,
+		HeaderID:   PageID(binary.LittleEndian.Uint64(b[pageIDOffset:])),
+		Type:       PageType(b[pageTypeOffset]).String(),
+		TypeCode:   b[pageTypeOffset],
+		LSN:        pageLSN(b),
+		Checksum:   binary.LittleEndian.Uint32(b[pageChecksumOffset:]),
+		ChecksumOK: checkPageChecksum(b),
+	}
+	switch PageType(b[pageTypeOffset]) {
+	case pageTypeHeap:
+		info.Heap = decodeHeapPageInfo(b)
+	case pageTypeHeapHeader:
+		info.HeapHeader = &HeapHeaderPageInfo{
+			LastPageID:  PageID(binary.LittleEndian.Uint64(b[heapLastPageIDOffset:])),
+			RecordCount: int64(binary.LittleEndian.Uint64(b[heapRecordCountOffset:])),
+		}
+	case pageTypeOverflow:
+		info.Overflow = &OverflowPageInfo{
+			PreviousPageID: PageID(binary.LittleEndian.Uint64(b[overflowPreviousIDOffset:])),
+			NextPageID:     PageID(binary.LittleEndian.Uint64(b[overflowNextIDOffset:])),
+			SegmentID:      int32(binary.LittleEndian.Uint32(b[overflowSegmentIDOffset:])),
+			SegmentLength:  int(binary.LittleEndian.Uint16(b[overflowSegmentLenOffset:])),
+		}
+	case pageTypeAllocationMap:
+		info.Allocation = decodeAllocationPageInfo(b[allocationBitMapOffset : allocationBitMapOffset+allocationBitMapLen])
+	}
+	return info
+}
+
+func decodeHeapPageInfo(b []byte) *HeapPageInfo {
+	slotTable := b[slotTableOffset:]
+	info := &HeapPageInfo{
+		SlotCount:    int16(binary.LittleEndian.Uint16(b[slotCountOffset:])),
+		DeletedCount: int16(binary.LittleEndian.Uint16(b[deletedCountOffset:])),
+		Version:      b[pageVersionOffset],
+	}
+	entryLen, ok := heapEntryLen(b)
+	if !ok {
+		return info // a format the slot table can't be read in
+	}
+	_, _, info.FreeOffset, info.FreeSpace = slotEntry(slotTable, entryLen, 0)
+	count := info.SlotCount
+	if max := slotTableLen / entryLen; count > max {
+		count = max // damaged, show as much of the table as there is
+	}
+	for slot := int16(1); slot < count; slot++ {
+		flags, version, offset, length := slotEntry(slotTable, entryLen, slot)
+		s := SlotInfo{Slot: slot, Flags: flags, State: slotState(flags), Version: version, Offset: offset, Length: length}
+		if flags == recordForwarded && offset >= 0 && int(offset)+int(forwardStubLen) <= len(slotTable) {
+			s.To = &RID{
+				PageID: PageID(binary.LittleEndian.Uint64(slotTable[offset:])),
+				Slot:   int16(binary.LittleEndian.Uint16(slotTable[offset+8:])),
+			}
+		}
+		info.Slots = append(info.Slots, s)
+	}
+	return info
+}
+
+// slotState returns slot flags by name.
+func slotState(flags byte) string {
+	if flags == slotUnallocated {
+		return "unallocated"
+	}
+	names := []struct {
+		flag byte
+		name string
+	}{
+		{recordOnPage, "on page"},
+		{recordOnOverflow, "on overflow"},
+		{recordDeleted, "deleted"},
+		{recordForwarded, "forwarded"},
+		{recordMoved, "moved"},
+		{recordCompressed, "compressed"},
+	}
+	var state []string
+	for _, n := range names {
+		if flags&n.flag != 0 {
+			state = append(state, n.name)
+			flags &^= n.flag
+		}
+	}
+	if flags != 0 {
+		state = append(state, "unknown")
+	}
+	return strings.Join(state, "|")
+}
+
+func decodeAllocationPageInfo(bitmap []byte) *AllocationPageInfo {
+	info := &AllocationPageInfo{Bits: len(bitmap) * 8, FirstFree: -1}
+	run := 0
+	for n := 0; n < info.Bits; n++ {
+		if bitmap[n/8]&orMasks[n%8] != 0 {
+			info.Allocated++
+			run = 0
+			continue
+		}
+		if info.FirstFree < 0 {
+			info.FirstFree = n
+		}
+		if run++; run > info.LargestFreeRun {
+			info.LargestFreeRun = run
+		}
+	}
+	return info
+}
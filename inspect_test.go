@@ -0,0 +1,120 @@
+package dbase
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectPage(t *testing.T) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	heap := NewHeap(store)
+	for i := 0; i < 10; i++ {
+		if _, err := heap.Put(jsonRecord(i)); err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+	}
+	heap.Delete(RID{PageID: 1, Slot: 3})
+	overflow := NewOverflowPage()
+	overflow.SetNextPageID(7)
+	overflowID, _ := store.Append(overflow)
+	allocation := NewAllocationPage()
+	allocation.GetAllocationBitMap().AllocateExplicit(0, 10)
+	allocationID, _ := store.Append(allocation)
+
+	info, _, err := InspectPage(store, 0)
+	if err != nil {
+		t.Fatalf("InspectPage header, err: %s", err)
+	}
+	if info.HeapHeader == nil || info.HeapHeader.RecordCount != 9 || info.HeapHeader.LastPageID != 1 {
+		t.Errorf("InspectPage header, expected: 9 records, last page 1, got: %+v", info.HeapHeader)
+	}
+
+	info, _, err = InspectPage(store, 1)
+	if err != nil {
+		t.Fatalf("InspectPage heap, err: %s", err)
+	}
+	if info.Heap == nil || info.Heap.SlotCount != 11 || info.Heap.DeletedCount != 1 || len(info.Heap.Slots) != 10 {
+		t.Fatalf("InspectPage heap, expected: 11 slots, 1 deleted, got: %+v", info.Heap)
+	}
+	if s := info.Heap.Slots[2]; s.Slot != 3 || s.State != "deleted" {
+		t.Errorf("InspectPage slot 3, expected: deleted, got: %+v", s)
+	}
+	if !info.ChecksumOK || info.LSN == 0 {
+		t.Errorf("InspectPage heap, expected: checksum ok and an LSN, got: %+v", info)
+	}
+
+	info, _, _ = InspectPage(store, overflowID)
+	if info.Overflow == nil || info.Overflow.NextPageID != 7 {
+		t.Errorf("InspectPage overflow, expected: next page 7, got: %+v", info.Overflow)
+	}
+	info, _, _ = InspectPage(store, allocationID)
+	if info.Allocation == nil || info.Allocation.Allocated != 10 || info.Allocation.FirstFree != 10 {
+		t.Errorf("InspectPage allocation, expected: 10 allocated, first free 10, got: %+v", info.Allocation)
+	}
+
+	// a damaged page is still decoded
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff}, fileHeaderLen+int64(PageSize)+4000)
+	file.Close()
+	if err := store.Read(1, newRawPage()); err == nil {
+		t.Errorf("store.Read damaged page, expected: %v, got: nil", PageChecksumFailed{1})
+	}
+	info, _, err = InspectPage(store, 1)
+	if err != nil {
+		t.Fatalf("InspectPage damaged page, err: %s", err)
+	}
+	if info.ChecksumOK || info.Heap == nil {
+		t.Errorf("InspectPage damaged page, expected: decoded with a bad checksum, got: %+v", info)
+	}
+}
+
+func TestInspectAllocationPages(t *testing.T) {
+
+	file, err := Open(filepath.Join(t.TempDir(), "store"), 0666, &FileStoreOptions{Compress: true, AllocationMap: true, AllocationInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	memory, _ := NewMemoryStore()
+	for _, store := range []PageStore{file, memory} {
+		appendPages(t, store, 6)
+		if err := store.Free(5); err != nil {
+			t.Fatal(err)
+		}
+
+		// allocation page 1 tracks pages 4 and 5 of the file, 1 of the 6 in the memory store
+		info, _, err := InspectPage(store, -2)
+		allocated := 1
+		if store == memory {
+			info, _, err = InspectPage(store, -1)
+			allocated = 5
+		}
+		if err != nil {
+			t.Fatalf("InspectPage allocation page, err: %s", err)
+		}
+		if info.Allocation == nil || info.Allocation.Allocated != allocated {
+			t.Errorf("InspectPage allocation page, expected: %d allocated, got: %+v", allocated, info.Allocation)
+		}
+
+		// a free page is read as it is
+		if info, _, err = InspectPage(store, 5); err != nil || info.TypeCode != 0 {
+			t.Errorf("InspectPage free page, expected: an empty page, got: %+v, err: %v", info, err)
+		}
+		if _, _, err := InspectPage(store, -10); err == nil {
+			t.Errorf("InspectPage -10, expected: error, got: nil")
+		}
+	}
+}
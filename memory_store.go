@@ -1,38 +1,39 @@
 package dbase
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // MemoryStore is an in-memory implementation of a page store - useful for testing.
 type MemoryStore interface {
 	PageStore
+	ExtentManager
+	AllocationMapReader
+	RawPageReader
 }
 
 type memoryStore struct {
-	bufferPool *sync.Pool
+	bufferPool *countingPool
 	lastPageID PageID
 	count      int64
 	l          sync.Mutex
 	pages      [][]byte
-	gets       int
-	sets       int
-	news       int
-	appends    int
-	wipes      int
+	alloc      *allocationMap
+	counters   storeCounters
 }
 
 // NewMemoryStore returns a new MemoryStore. Under the covers
 // it just uses sync.Pool to manage a buffer of page-size bytes
 func NewMemoryStore() (MemoryStore, error) {
 	store := &memoryStore{
-		bufferPool: &sync.Pool{
-			New: func() any {
-				return make([]byte, PageSize, PageSize)
-			},
-		},
+		bufferPool: newCountingPool(func() any {
+			return make([]byte, PageSize, PageSize)
+		}),
+		alloc: newAllocationMap(allocationPageSpan),
 	}
 	store.count = 0
 	store.lastPageID = -1
@@ -41,49 +42,74 @@ func NewMemoryStore() (MemoryStore, error) {
 
 // Read returns the page with ID=id. Caller's responsibility to create page.
 func (store *memoryStore) Read(id PageID, page Page) error {
-	if id > store.lastPageID {
+	defer store.counters.readLatency.since(time.Now())
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
 	}
+	if !store.alloc.isAllocated(id) {
+		return ErrPageFree
+	}
 	buf := store.pages[int(id)]
-	store.gets++
+	store.counters.reads.Add(1)
+	store.counters.bytesRead.Add(uint64(PageSize))
 	return page.UnmarshalBinary(buf)
 }
 
 // Write updates the page with id=ID.
 func (store *memoryStore) Write(id PageID, page Page) error {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
 
-	if id > store.lastPageID {
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
+	} else if !store.alloc.isAllocated(id) {
+		return ErrPageFree
 	} else if buf, err := page.MarshalBinary(); err != nil {
 		return err
 	} else {
 		copy(store.pages[int(id)], buf)
 	}
-	store.sets++
+	store.counters.writes.Add(1)
+	store.counters.bytesWritten.Add(uint64(PageSize))
 	return nil
 }
 
-// New creates an empty page at the end of the memory store.
-// Returns the page ID of the new page. Page count & Last page ID will be increased by 1.
+// New creates an empty page, reusing the lowest free page if there is one, otherwise at the end
+// of the memory store. Returns the page ID of the new page. Page count & Last page ID will be
+// increased by 1 if the page is added at the end.
 func (store *memoryStore) New() (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
 
+	if id := store.alloc.findRun(store.count, 1); int64(id) < store.count {
+		if err := store.alloc.allocate(id, 1, store.count); err != nil {
+			return 0, err
+		}
+		clear(store.pages[int(id)])
+		store.counters.news.Add(1)
+		store.counters.bytesWritten.Add(uint64(PageSize))
+		return id, nil
+	}
+	if err := store.alloc.allocate(store.lastPageID+1, 1, store.count); err != nil {
+		return 0, err
+	}
 	buf := make([]byte, PageSize)
 	store.pages = append(store.pages, buf)
 	store.lastPageID++
 	store.count++
-	store.news++
+	store.counters.news.Add(1)
+	store.counters.bytesWritten.Add(uint64(PageSize))
 	return PageID(store.lastPageID), nil
 }
 
 // Append appends the given page at the end of the memory store.
 // Returns the page ID of the new page. Page count & Last page ID will be increased by 1.
 func (store *memoryStore) Append(page Page) (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
@@ -92,29 +118,184 @@ func (store *memoryStore) Append(page Page) (PageID, error) {
 	if err != nil {
 		return 0, err
 	}
+	if err := store.alloc.allocate(store.lastPageID+1, 1, store.count); err != nil {
+		return 0, err
+	}
 	buf2 := make([]byte, PageSize)
 	copy(buf2, buf)
 	store.pages = append(store.pages, buf2)
 	store.lastPageID++
 	store.count++
-	store.appends++
+	store.counters.appends.Add(1)
+	store.counters.bytesWritten.Add(uint64(PageSize))
 	return PageID(store.lastPageID), nil
 }
 
+// ReadContext is Read, returning ctx.Err() if ctx is done.
+func (store *memoryStore) ReadContext(ctx context.Context, id PageID, page Page) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Read(id, page)
+}
+
+// WriteContext is Write, returning ctx.Err() if ctx is done.
+func (store *memoryStore) WriteContext(ctx context.Context, id PageID, page Page) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Write(id, page)
+}
+
+// NewContext is New, returning ctx.Err() if ctx is done.
+func (store *memoryStore) NewContext(ctx context.Context) (PageID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return store.New()
+}
+
+// AppendContext is Append, returning ctx.Err() if ctx is done.
+func (store *memoryStore) AppendContext(ctx context.Context, page Page) (PageID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return store.Append(page)
+}
+
 // Wipe zeros out the specified page. It does not reduce page count. Use with care!
 func (store *memoryStore) Wipe(id PageID) error {
+	defer store.counters.writeLatency.since(time.Now())
 
 	store.l.Lock()
 	defer store.l.Unlock()
 
-	if id > store.lastPageID {
+	if id < 0 || id > store.lastPageID {
 		return errors.New("Invalid page ID")
 	}
+	if !store.alloc.isAllocated(id) {
+		return ErrPageFree
+	}
 	buf := store.pages[int(id)]
 	for i := range buf {
 		buf[i] = 0
 	}
-	store.wipes++
+	store.counters.wipes.Add(1)
+	store.counters.bytesWritten.Add(uint64(PageSize))
+	return nil
+}
+
+// Free zeros out the specified page and marks it free, for New to reuse.
+func (store *memoryStore) Free(id PageID) error {
+	return store.Deallocate(id, 1)
+}
+
+// Deallocate zeros out the runlength pages from id and marks them free.
+func (store *memoryStore) Deallocate(id PageID, runlength int) error {
+	defer store.counters.writeLatency.since(time.Now())
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if err := store.alloc.checkRun(id, runlength, store.count); err != nil {
+		return err
+	}
+	for _, buf := range store.pages[id : id+PageID(runlength)] {
+		clear(buf)
+	}
+	if err := store.alloc.deallocate(id, int64(runlength), store.count); err != nil {
+		return err
+	}
+	store.counters.frees.Add(uint64(runlength))
+	store.counters.bytesWritten.Add(uint64(runlength) * uint64(PageSize))
+	return nil
+}
+
+// Allocate allocates runlength contiguous empty pages, reusing free pages, and adding pages at the
+// end of the memory store as needed. Returns the ID of the first page.
+func (store *memoryStore) Allocate(runlength int) (PageID, error) {
+	defer store.counters.writeLatency.since(time.Now())
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if runlength < 1 {
+		return 0, errors.New("Invalid run length")
+	}
+	id := store.alloc.findRun(store.count, int64(runlength))
+	if err := store.alloc.allocate(id, int64(runlength), store.count); err != nil {
+		return 0, err
+	}
+	// free pages are already empty
+	for int64(store.lastPageID+1) < int64(id)+int64(runlength) {
+		store.pages = append(store.pages, make([]byte, PageSize))
+		store.lastPageID++
+		store.count++
+		store.counters.bytesWritten.Add(uint64(PageSize))
+	}
+	store.counters.news.Add(uint64(runlength))
+	return id, nil
+}
+
+// AllocationSpan returns the number of pages each allocation page tracks, and the number of
+// allocation pages.
+func (store *memoryStore) AllocationSpan() (int64, int) {
+	store.l.Lock()
+	defer store.l.Unlock()
+	return store.alloc.span, len(store.alloc.pages)
+}
+
+// ReadAllocationPage reads allocation page k into page.
+func (store *memoryStore) ReadAllocationPage(k int, page AllocationPage) error {
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if k < 0 || k >= len(store.alloc.pages) {
+		return errors.New("Invalid allocation page")
+	}
+	data, err := store.alloc.pages[k].MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return page.UnmarshalBinary(data)
+}
+
+// ReadRaw copies the image of page id into buf, free pages included. Allocation page k is page
+// -(k+1).
+func (store *memoryStore) ReadRaw(id PageID, buf []byte) error {
+	if len(buf) != int(PageSize) {
+		return ErrInvalidBuffer
+	}
+
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	if id < 0 && int(-id-1) < len(store.alloc.pages) {
+		data, err := store.alloc.pages[-id-1].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		copy(buf, data)
+		return nil
+	}
+	if id < 0 || id > store.lastPageID {
+		return errors.New("Invalid page ID")
+	}
+	copy(buf, store.pages[id])
+	return nil
+}
+
+// Truncate drops the free pages at the end of the memory store.
+func (store *memoryStore) Truncate() error {
+	store.l.Lock()
+	defer store.l.Unlock()
+
+	count := store.alloc.trailing(store.count)
+	store.alloc.drop(count, store.count)
+	clear(store.pages[count:])
+	store.pages = store.pages[0:count]
+	store.count = count
+	store.lastPageID = PageID(count - 1)
 	return nil
 }
 
@@ -128,7 +309,18 @@ func (store *memoryStore) Close() error {
 	return nil
 }
 
-//Statistics returns a string containing stats for gets, sets, news, appends.
+// Stats returns the store's activity counts.
+func (store *memoryStore) Stats() StoreStats {
+	stats := store.counters.stats()
+	stats.Pages = store.Count()
+	stats.Size = stats.Pages * int64(PageSize)
+	stats.BufferPool = store.bufferPool.stats()
+	return stats
+}
+
+// Statistics returns a string with the store's activity counts.
+//
+// Deprecated: use Stats.
 func (store *memoryStore) Statistics() string {
-	return fmt.Sprintf("memory store: gets: %d, sets: %d, news: %d, appends: %d", store.gets, store.sets, store.news, store.appends)
+	return fmt.Sprintf("memory store: %s", store.Stats())
 }
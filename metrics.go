@@ -0,0 +1,212 @@
+package dbase
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics exposes the Stats of named stores and heaps, as Prometheus text via ServeHTTP, e.g.
+//
+//	metrics := dbase.NewMetrics()
+//	metrics.AddStore("orders", store)
+//	metrics.AddHeap("orders", heap)
+//	http.Handle("/metrics", metrics)
+//
+// and as JSON through expvar, see Publish. Each exposition calls Stats, which doesn't read the
+// store, so scrapes are cheap. The space free on heap pages isn't exposed: finding it, see
+// Heap.FreeSpace, reads every page of the store.
+type Metrics struct {
+	l      sync.Mutex
+	stores map[string]PageStore
+	heaps  map[string]Heap
+}
+
+// NewMetrics returns a new Metrics exposing nothing.
+func NewMetrics() *Metrics {
+	return &Metrics{stores: make(map[string]PageStore), heaps: make(map[string]Heap)}
+}
+
+// AddStore exposes the stats of store, labelled store="name". A store already added with name is replaced.
+func (m *Metrics) AddStore(name string, store PageStore) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.stores[name] = store
+}
+
+// AddHeap exposes the stats of heap, labelled heap="name". A heap already added with name is replaced.
+func (m *Metrics) AddHeap(name string, heap Heap) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.heaps[name] = heap
+}
+
+// Remove stops exposing the store and heap with name.
+func (m *Metrics) Remove(name string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delete(m.stores, name)
+	delete(m.heaps, name)
+}
+
+// Publish publishes the stats as the expvar variable name, a JSON object of the form
+// {"stores": {name: StoreStats}, "heaps": {name: HeapStats}}. Like expvar.Publish, it panics if
+// name is already published.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stores, heaps := m.stats()
+		return map[string]any{"stores": stores, "heaps": heaps}
+	}))
+}
+
+// stats returns the current stats of each store and heap, by name.
+func (m *Metrics) stats() (map[string]StoreStats, map[string]HeapStats) {
+	m.l.Lock()
+	stores := make(map[string]PageStore, len(m.stores))
+	for name, store := range m.stores {
+		stores[name] = store
+	}
+	heaps := make(map[string]Heap, len(m.heaps))
+	for name, heap := range m.heaps {
+		heaps[name] = heap
+	}
+	m.l.Unlock()
+
+	storeStats := make(map[string]StoreStats, len(stores))
+	for name, store := range stores {
+		storeStats[name] = store.Stats()
+	}
+	heapStats := make(map[string]HeapStats, len(heaps))
+	for name, heap := range heaps {
+		heapStats[name] = heap.Stats()
+	}
+	return storeStats, heapStats
+}
+
+// ServeHTTP writes the stats in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// metric is a counter or gauge taken from a StoreStats or HeapStats.
+type metric[S any] struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value func(s *S) float64
+}
+
+// histogramMetric is a latency histogram taken from a StoreStats or HeapStats.
+type histogramMetric[S any] struct {
+	name  string
+	help  string
+	value func(s *S) Histogram
+}
+
+var storeMetrics = []metric[StoreStats]{
+	{"dbase_store_reads_total", "counter", "Pages read.", func(s *StoreStats) float64 { return float64(s.Reads) }},
+	{"dbase_store_writes_total", "counter", "Pages written.", func(s *StoreStats) float64 { return float64(s.Writes) }},
+	{"dbase_store_news_total", "counter", "Empty pages added.", func(s *StoreStats) float64 { return float64(s.News) }},
+	{"dbase_store_appends_total", "counter", "Pages appended.", func(s *StoreStats) float64 { return float64(s.Appends) }},
+	{"dbase_store_wipes_total", "counter", "Pages wiped.", func(s *StoreStats) float64 { return float64(s.Wipes) }},
+	{"dbase_store_frees_total", "counter", "Pages freed.", func(s *StoreStats) float64 { return float64(s.Frees) }},
+	{"dbase_store_read_bytes_total", "counter", "Bytes read from backing storage.", func(s *StoreStats) float64 { return float64(s.BytesRead) }},
+	{"dbase_store_written_bytes_total", "counter", "Bytes written to backing storage.", func(s *StoreStats) float64 { return float64(s.BytesWritten) }},
+	{"dbase_store_pages", "gauge", "Pages in the store.", func(s *StoreStats) float64 { return float64(s.Pages) }},
+	{"dbase_store_size_bytes", "gauge", "Bytes of backing storage in use.", func(s *StoreStats) float64 { return float64(s.Size) }},
+	{"dbase_store_buffer_gets_total", "counter", "Page buffers taken from the buffer pool.", func(s *StoreStats) float64 { return float64(s.BufferPool.Gets) }},
+	{"dbase_store_buffer_allocs_total", "counter", "Page buffers allocated because the buffer pool was empty.", func(s *StoreStats) float64 { return float64(s.BufferPool.Allocs) }},
+	{"dbase_store_buffer_reuse_ratio", "gauge", "Fraction of buffer pool gets met with a pooled buffer rather than an allocation.", func(s *StoreStats) float64 { return s.BufferPool.ReuseRatio() }},
+}
+
+var storeHistograms = []histogramMetric[StoreStats]{
+	{"dbase_store_read_seconds", "Page read latency.", func(s *StoreStats) Histogram { return s.ReadLatency }},
+	{"dbase_store_write_seconds", "Page write, new, append and wipe latency.", func(s *StoreStats) Histogram { return s.WriteLatency }},
+}
+
+var heapMetrics = []metric[HeapStats]{
+	{"dbase_heap_puts_total", "counter", "Records added.", func(s *HeapStats) float64 { return float64(s.Puts) }},
+	{"dbase_heap_gets_total", "counter", "Records read.", func(s *HeapStats) float64 { return float64(s.Gets) }},
+	{"dbase_heap_sets_total", "counter", "Records updated.", func(s *HeapStats) float64 { return float64(s.Sets) }},
+	{"dbase_heap_deletes_total", "counter", "Records deleted.", func(s *HeapStats) float64 { return float64(s.Deletes) }},
+	{"dbase_heap_in_bytes_total", "counter", "Record bytes given to put and set.", func(s *HeapStats) float64 { return float64(s.BytesIn) }},
+	{"dbase_heap_stored_bytes_total", "counter", "Record bytes stored by put and set, after compression.", func(s *HeapStats) float64 { return float64(s.BytesStored) }},
+	{"dbase_heap_compression_ratio", "gauge", "Record bytes in over record bytes stored.", func(s *HeapStats) float64 { return s.CompressionRatio }},
+	{"dbase_heap_records", "gauge", "Records in the heap.", func(s *HeapStats) float64 { return float64(s.Records) }},
+	{"dbase_heap_buffer_gets_total", "counter", "Pages taken from the page pool.", func(s *HeapStats) float64 { return float64(s.BufferPool.Gets) }},
+	{"dbase_heap_buffer_allocs_total", "counter", "Pages allocated because the page pool was empty.", func(s *HeapStats) float64 { return float64(s.BufferPool.Allocs) }},
+	{"dbase_heap_buffer_reuse_ratio", "gauge", "Fraction of page pool gets met with a pooled page rather than an allocation.", func(s *HeapStats) float64 { return s.BufferPool.ReuseRatio() }},
+}
+
+var heapHistograms = []histogramMetric[HeapStats]{
+	{"dbase_heap_get_seconds", "Record get latency.", func(s *HeapStats) Histogram { return s.GetLatency }},
+	{"dbase_heap_put_seconds", "Record put latency.", func(s *HeapStats) Histogram { return s.PutLatency }},
+	{"dbase_heap_set_seconds", "Record set latency.", func(s *HeapStats) Histogram { return s.SetLatency }},
+	{"dbase_heap_delete_seconds", "Record delete latency.", func(s *HeapStats) Histogram { return s.DeleteLatency }},
+}
+
+// WritePrometheus writes the stats to w in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	stores, heaps := m.stats()
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, "store", stores, storeMetrics, storeHistograms)
+	writeMetrics(bw, "heap", heaps, heapMetrics, heapHistograms)
+	return bw.Flush()
+}
+
+// writeMetrics writes each metric for every source in stats, labelled label="name", in name order.
+func writeMetrics[S any](w *bufio.Writer, label string, stats map[string]S, metrics []metric[S], histograms []histogramMetric[S]) {
+	if len(stats) == 0 {
+		return
+	}
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = label + `="` + escapeLabel(name) + `"`
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, name := range names {
+			s := stats[name]
+			fmt.Fprintf(w, "%s{%s} %s\n", metric.name, labels[i], formatFloat(metric.value(&s)))
+		}
+	}
+	for _, metric := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", metric.name, metric.help, metric.name)
+		for i, name := range names {
+			s := stats[name]
+			h := metric.value(&s)
+			var cumulative uint64
+			for b, bound := range h.Bounds {
+				cumulative += h.Counts[b]
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", metric.name, labels[i], formatFloat(bound.Seconds()), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", metric.name, labels[i], h.Count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", metric.name, labels[i], formatFloat(h.Sum.Seconds()))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", metric.name, labels[i], h.Count)
+		}
+	}
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
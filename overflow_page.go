@@ -92,13 +92,13 @@ func (page *overflowPage) UnmarshalBinary(buf []byte) error {
 	page.l.Lock()
 	defer page.l.Unlock()
 
-	if len(buf) != int(PageSize) {
-		panic("Invalid buffer")
+	if err := checkUnmarshal(buf, pageTypeOverflow); err != nil {
+		return err
 	}
-	// check page type, panic if wrong
-	pageType := PageType(buf[pageTypeOffset])
-	if pageType != pageTypeOverflow {
-		panic("Invalid page type")
+	segmentLength := int(int16(binary.LittleEndian.Uint16(buf[overflowSegmentLenOffset:])))
+	if segmentLength < -1 || segmentLength > int(maxSegmentLen) {
+		id := PageID(binary.LittleEndian.Uint64(buf[pageIDOffset:]))
+		return ErrPageCorrupt{id, 0, fmt.Sprintf("segment length %d out of range", segmentLength)}
 	}
 
 	copy(page.bytes, buf)
@@ -113,8 +113,8 @@ func (page *overflowPage) UnmarshalBinary(buf []byte) error {
 	page.nextID = PageID(binary.LittleEndian.Uint64(page.header[overflowNextIDOffset:]))
 
 	page.segmentID = int32(binary.LittleEndian.Uint32(page.header[overflowSegmentIDOffset:]))
-	page.segmentLength = int(binary.LittleEndian.Uint16(page.header[overflowSegmentLenOffset:]))
-	page.segment = page.bytes[overflowSegmentOffset : overflowSegmentOffset+page.segmentLength]
+	page.segmentLength = segmentLength // -1 if no segment has been set
+	page.segment = page.bytes[overflowSegmentOffset : overflowSegmentOffset+max(segmentLength, 0)]
 
 	return nil
 }
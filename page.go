@@ -4,6 +4,14 @@
 
 package dbase
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
 const (
 	// PageSize is typically the same as the filesystem blocksize
 	PageSize = int16(8192)
@@ -12,8 +20,10 @@ const (
 	maxPagePayload   = PageSize - pageHeaderLength // Maximum page payload bytes
 
 	// Page buffer offsets for page fields
-	pageIDOffset   = 0
-	pageTypeOffset = 8 // single bytes
+	pageIDOffset       = 0
+	pageTypeOffset     = 8  // single bytes
+	pageChecksumOffset = 44 // CRC-32C of the page, stamped by the file store on each write; 0 if never stamped
+	pageLSNOffset      = 48 // last 8 bytes of the header, stamped by the file store on each write
 
 	// Page types:
 	dbHeaderPage          = PageType(0x01)
@@ -27,6 +37,16 @@ const (
 // PageID is (usually) the same as the block number on disk
 type PageID int64
 
+// LSN is a log sequence number. A file store stamps every page it writes with a new LSN, so pages
+// changed since a given LSN can be found. LSNs are taken from the clock, in nanoseconds, and are
+// strictly increasing within a store.
+type LSN uint64
+
+// LSNAt returns the LSN for time t; pages written after t have a greater LSN.
+func LSNAt(t time.Time) LSN {
+	return LSN(t.UnixNano())
+}
+
 // PageType is one of
 // DB_HEADER_PAGE        = PageType(0x01)
 // DB_DIRECTORY_PAGE     = PageType(0x02)
@@ -35,6 +55,39 @@ type PageID int64
 // PAGE_TYPE_OVERFLOW    = PageType(0x05)
 type PageType byte
 
+// pageLSN returns the LSN stamped in page image buf.
+func pageLSN(buf []byte) LSN {
+	return LSN(binary.LittleEndian.Uint64(buf[pageLSNOffset:]))
+}
+
+// setPageLSN stamps page image buf with lsn.
+func setPageLSN(buf []byte, lsn LSN) {
+	binary.LittleEndian.PutUint64(buf[pageLSNOffset:], uint64(lsn))
+}
+
+// crcTable is used for page and log record checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// pageChecksum returns the checksum of page image buf, excluding the checksum itself. It is never 0.
+func pageChecksum(buf []byte) uint32 {
+	crc := crc32.Update(crc32.Checksum(buf[0:pageChecksumOffset], crcTable), crcTable, buf[pageChecksumOffset+4:])
+	if crc == 0 {
+		crc = 1
+	}
+	return crc
+}
+
+// setPageChecksum stamps page image buf with its checksum.
+func setPageChecksum(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[pageChecksumOffset:], pageChecksum(buf))
+}
+
+// checkPageChecksum returns false if page image buf has been stamped with a checksum that doesn't match.
+func checkPageChecksum(buf []byte) bool {
+	stored := binary.LittleEndian.Uint32(buf[pageChecksumOffset:])
+	return stored == 0 || stored == pageChecksum(buf)
+}
+
 // Page is the main abstraction that other page types inherit from
 type Page interface {
 	// GetID returns the page ID for this page
@@ -49,6 +102,44 @@ type Page interface {
 	UnmarshalBinary(buf []byte) error
 }
 
+// ErrInvalidBuffer is returned by UnmarshalBinary when buf isn't PageSize bytes long.
+var ErrInvalidBuffer = errors.New("Invalid buffer")
+
+// ErrWrongPageType is an error type - a page isn't of the type expected, e.g. an overflow page
+// read as a heap page.
+type ErrWrongPageType struct {
+	Want   PageType
+	Got    PageType
+	PageID PageID
+}
+
+func (e ErrWrongPageType) Error() string {
+	return fmt.Sprintf("Wrong page type, PageID: %d, expected: %s, got: %s", e.PageID, e.Want, e.Got)
+}
+
+// ErrPageCorrupt is an error type - a page's contents are inconsistent, e.g. a heap page slot
+// pointing outside the page.
+type ErrPageCorrupt struct {
+	PageID PageID
+	Slot   int16
+	Reason string
+}
+
+func (e ErrPageCorrupt) Error() string {
+	return fmt.Sprintf("Page corrupt, PageID: %d, Slot: %d, %s", e.PageID, e.Slot, e.Reason)
+}
+
+// checkUnmarshal returns an error unless buf is a page image of type want.
+func checkUnmarshal(buf []byte, want PageType) error {
+	if len(buf) != int(PageSize) {
+		return ErrInvalidBuffer
+	}
+	if got := PageType(buf[pageTypeOffset]); got != want {
+		return ErrWrongPageType{Want: want, Got: got, PageID: PageID(binary.LittleEndian.Uint64(buf[pageIDOffset:]))}
+	}
+	return nil
+}
+
 // Concrete implementation of a page
 type page struct {
 	id       PageID   // 0:8
@@ -72,3 +163,43 @@ func (page *page) SetID(id PageID) error {
 func (page *page) GetType() PageType {
 	return page.pagetype
 }
+
+// rawPage is a page of any type, held as raw bytes. Reading one never fails on the page's
+// contents, so damaged pages can be examined.
+type rawPage struct {
+	bytes []byte
+}
+
+func newRawPage() *rawPage {
+	return &rawPage{bytes: make([]byte, PageSize)}
+}
+
+// GetID returns the page ID recorded in the page header
+func (page *rawPage) GetID() PageID {
+	return PageID(binary.LittleEndian.Uint64(page.bytes[pageIDOffset:]))
+}
+
+// SetID sets the page ID recorded in the page header
+func (page *rawPage) SetID(id PageID) error {
+	binary.LittleEndian.PutUint64(page.bytes[pageIDOffset:], uint64(id))
+	return nil
+}
+
+// GetType returns the page type recorded in the page header
+func (page *rawPage) GetType() PageType {
+	return PageType(page.bytes[pageTypeOffset])
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (page *rawPage) MarshalBinary() ([]byte, error) {
+	return page.bytes, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (page *rawPage) UnmarshalBinary(buf []byte) error {
+	if len(buf) != int(PageSize) {
+		return ErrInvalidBuffer
+	}
+	copy(page.bytes, buf)
+	return nil
+}
@@ -0,0 +1,103 @@
+package dbase
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	gcmNonceLen = 12
+	gcmTagLen   = 16
+
+	// sealedOverhead is the number of bytes encryption adds to a page image
+	sealedOverhead = gcmNonceLen + gcmTagLen
+
+	keyCheckLen = sealedOverhead + 16
+
+	// legacyKeyCheckID sealed the key check of files created before allocation pages, which can't
+	// have an allocation page -1
+	legacyKeyCheckID = PageID(-1)
+)
+
+// ErrEncryptionKey is returned when opening an encrypted file store without its key, or with the wrong one.
+var ErrEncryptionKey = errors.New("Encryption key missing or doesn't match file store")
+
+// PageAuthenticationFailed is an error type - a page failed decryption, it is corrupt, has been
+// tampered with, or has been moved from another page ID
+type PageAuthenticationFailed struct {
+	PageID PageID
+}
+
+func (e PageAuthenticationFailed) Error() string {
+	return fmt.Sprintf("Page authentication failed, PageID: %d", e.PageID)
+}
+
+// sealer encrypts and authenticates page images with AES-GCM. The page ID is used as associated
+// data, so a page can't be swapped with another.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer returns a sealer for key, which must be 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns nonce + ciphertext for the page image buf.
+func (s *sealer) seal(id PageID, buf []byte) ([]byte, error) {
+	out := make([]byte, gcmNonceLen, gcmNonceLen+len(buf)+gcmTagLen)
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(out, out, buf, pageAAD(id)), nil
+}
+
+// open returns the page image sealed in data.
+func (s *sealer) open(id PageID, data []byte) ([]byte, error) {
+	if len(data) < sealedOverhead {
+		return nil, PageAuthenticationFailed{id}
+	}
+	buf, err := s.aead.Open(nil, data[0:gcmNonceLen], data[gcmNonceLen:], pageAAD(id))
+	if err != nil {
+		return nil, PageAuthenticationFailed{id}
+	}
+	return buf, nil
+}
+
+// keyCheck returns a value stored in the file header, used to check the key on Open. It is sealed
+// with keyCheckID, which is no page's ID.
+func (s *sealer) keyCheck() ([]byte, error) {
+	return s.seal(keyCheckID, make([]byte, keyCheckLen-sealedOverhead))
+}
+
+// checkKey returns ErrEncryptionKey if check wasn't produced by keyCheck with the same key. If
+// legacy, check may also have been sealed with legacyKeyCheckID.
+func (s *sealer) checkKey(check []byte, legacy bool) error {
+	if _, err := s.open(keyCheckID, check); err == nil {
+		return nil
+	}
+	if legacy {
+		if _, err := s.open(legacyKeyCheckID, check); err == nil {
+			return nil
+		}
+	}
+	return ErrEncryptionKey
+}
+
+func pageAAD(id PageID) []byte {
+	aad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(aad, uint64(id))
+	return aad
+}
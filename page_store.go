@@ -1,12 +1,94 @@
 package dbase
 
+import "context"
+
 // PageStore is the primary interface for types that store pages.
 type PageStore interface {
 	Read(id PageID, page Page) error
 	Write(id PageID, page Page) error
 	New() (PageID, error)
 	Append(page Page) (PageID, error)
+	// The Context variants return ctx.Err(), without reading or writing, if ctx is done.
+	ReadContext(ctx context.Context, id PageID, page Page) error
+	WriteContext(ctx context.Context, id PageID, page Page) error
+	NewContext(ctx context.Context) (PageID, error)
+	AppendContext(ctx context.Context, page Page) (PageID, error)
+	// Free gives page id back to the store: it is zeroed, can't be read or written, and is reused
+	// by a later New. Pages appended after it keep their IDs.
+	Free(id PageID) error
+	// Truncate drops the free pages at the end of the store, reducing its count and size.
+	Truncate() error
 	Count() int64
 	Statistics() string
+	Stats() StoreStats
 	Close() error
 }
+
+// BatchPageStore is a PageStore that can read and write several existing pages at once, e.g. with
+// a single io_uring submission. The ids in a batch must be distinct.
+type BatchPageStore interface {
+	PageStore
+	ReadBatch(ids []PageID, pages []Page) error
+	WriteBatch(ids []PageID, pages []Page) error
+}
+
+// ExtentManager is a PageStore that allocates and frees contiguous runs of pages, extents, which
+// may cross the allocation pages tracking them.
+type ExtentManager interface {
+	PageStore
+	// Allocate allocates runlength contiguous empty pages, returning the first: the lowest run of
+	// free pages long enough, otherwise pages added at the end of the store, following any free
+	// pages there.
+	Allocate(runlength int) (PageID, error)
+	// Deallocate frees the runlength pages from id, as Free does.
+	Deallocate(id PageID, runlength int) error
+}
+
+// AllocationMapReader is a PageStore that keeps a map of the pages it has allocated apart from its
+// pages, in allocation pages each tracking span pages: bit n of allocation page k is set when page
+// k * span + n is allocated.
+type AllocationMapReader interface {
+	PageStore
+	// AllocationSpan returns the number of pages each allocation page tracks, and the number of
+	// allocation pages; 0 pages if the store has no allocation map.
+	AllocationSpan() (span int64, pages int)
+	// ReadAllocationPage reads allocation page k into page, as the store is using it, with any
+	// changes not yet written.
+	ReadAllocationPage(k int, page AllocationPage) error
+}
+
+// RawPageReader is a PageStore that can read its page images as they are held, without the
+// checks Read makes, to inspect damaged pages.
+type RawPageReader interface {
+	PageStore
+	// ReadRaw reads the image of page id into buf, PageSize bytes long. Pages that fail their
+	// checksum and free pages are read as they are. Allocation page k of an allocation map kept
+	// apart from the pages, see AllocationMapReader, is read as page -(k+1).
+	ReadRaw(id PageID, buf []byte) error
+}
+
+// readPages reads page ids[i] into pages[i], as one batch if store is a BatchPageStore.
+func readPages(store PageStore, ids []PageID, pages []Page) error {
+	if batch, ok := store.(BatchPageStore); ok {
+		return batch.ReadBatch(ids, pages)
+	}
+	for i, id := range ids {
+		if err := store.Read(id, pages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePages writes pages[i] as page ids[i], as one batch if store is a BatchPageStore.
+func writePages(store PageStore, ids []PageID, pages []Page) error {
+	if batch, ok := store.(BatchPageStore); ok {
+		return batch.WriteBatch(ids, pages)
+	}
+	for i, id := range ids {
+		if err := store.Write(id, pages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
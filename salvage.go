@@ -0,0 +1,140 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// PageRange is a run of pages, First to Last inclusive.
+type PageRange struct {
+	First PageID
+	Last  PageID
+}
+
+func (r PageRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%d", r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// SalvageReport is the result of salvaging a heap store.
+type SalvageReport struct {
+	Pages       int64       // pages examined
+	Records     int64       // records written to the new heap
+	LostPages   []PageRange // pages skipped as unreadable, of the wrong type, or with a damaged slot table
+	LostRecords int64       // damaged records skipped on pages that were otherwise readable
+}
+
+func (report *SalvageReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "pages: %d, records salvaged: %d, records lost: %d", report.Pages, report.Records, report.LostRecords)
+	if len(report.LostPages) > 0 {
+		ranges := make([]string, len(report.LostPages))
+		for i, r := range report.LostPages {
+			ranges[i] = r.String()
+		}
+		fmt.Fprintf(&sb, ", pages lost: %s", strings.Join(ranges, ", "))
+	}
+	return sb.String()
+}
+
+// Salvage copies every readable record in the heap store src to a new heap in dst, which must be
+// empty. Pages that can't be read, fail their checksum, aren't heap pages, or have a damaged slot
+// table are skipped, as are damaged records. The new heap's header is rebuilt from the records
+// salvaged. Records are given new RIDs.
+func Salvage(src PageStore, dst PageStore) (*SalvageReport, error) {
+	if dst.Count() != 0 {
+		return nil, fmt.Errorf("Salvage: destination store isn't empty, it has %d pages", dst.Count())
+	}
+	writer, err := NewHeapWriter(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SalvageReport{Pages: src.Count()}
+	page := newRawPage()
+	buf := make([]byte, PageSize)
+	lost := func(id PageID) {
+		if n := len(report.LostPages); n > 0 && report.LostPages[n-1].Last == id-1 {
+			report.LostPages[n-1].Last = id
+		} else {
+			report.LostPages = append(report.LostPages, PageRange{First: id, Last: id})
+		}
+	}
+
+	for id := PageID(0); int64(id) < report.Pages; id++ {
+		if err := src.Read(id, page); err == ErrPageFree {
+			continue
+		} else if err != nil {
+			lost(id)
+			continue
+		}
+		switch page.GetType() {
+		case pageTypeHeap:
+		case pageTypeHeapHeader, pageTypeOverflow, pageTypeAllocationMap:
+			continue // rebuilt, or not used for records
+		default:
+			lost(id)
+			continue
+		}
+		records, damaged, ok := salvagePage(page.bytes, buf)
+		if !ok {
+			lost(id)
+			continue
+		}
+		report.LostRecords += damaged
+		for _, record := range records {
+			if _, err := writer.Write(record); err != nil {
+				writer.Close()
+				return report, err
+			}
+			report.Records++
+		}
+	}
+	return report, writer.Close()
+}
+
+// salvagePage returns the readable records on heap page b, using buf, at least maxRecordLen long,
+// to decompress records, and the number of damaged records, including any too long for buf.
+// Returns false if the slot table is damaged.
+func salvagePage(b []byte, buf []byte) (records [][]byte, damaged int64, ok bool) {
+	slotTable := b[slotTableOffset:]
+	slotCount := int16(binary.LittleEndian.Uint16(b[slotCountOffset:]))
+	entryLen, ok := heapEntryLen(b)
+	if !ok || slotCount < 1 || int(slotCount)*int(entryLen) > int(slotTableLen) {
+		return nil, 0, false
+	}
+	_, _, freeOffset, _ := slotEntry(slotTable, entryLen, 0)
+	if freeOffset < 0 || freeOffset > slotTableLen-slotCount*entryLen {
+		return nil, 0, false
+	}
+	for slot := int16(1); slot < slotCount; slot++ {
+		flags, _, offset, length := slotEntry(slotTable, entryLen, slot)
+		switch {
+		case flags == recordDeleted, flags == recordForwarded:
+			continue // forwarded records are salvaged from the page they moved to
+		case flags&recordOnPage == 0 || flags&^(recordOnPage|recordMoved|recordCompressed) != 0:
+			damaged++
+			continue
+		}
+		if offset < 0 || length <= 0 || offset+length > freeOffset {
+			damaged++
+			continue
+		}
+		record := slotTable[offset : offset+length]
+		if flags&recordCompressed != 0 {
+			n, err := decompress(record, buf)
+			if err != nil || n == 0 || n > len(buf) {
+				// damaged, or too long for a heap to hold, as records compressed before their
+				// length was limited can be
+				damaged++
+				continue
+			}
+			record = buf[0:n]
+		}
+		records = append(records, append([]byte(nil), record...))
+	}
+	return records, damaged, true
+}
@@ -0,0 +1,146 @@
+package dbase
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+
+	path := tempfile()
+	src, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		src.Close()
+		os.Remove(path)
+	}()
+	heap := NewHeapWithOptions(src, &HeapOptions{Compress: true, CompressionLevel: 1})
+	records := make(map[RID][]byte)
+	for i := 0; i < 2000; i++ {
+		record := jsonRecord(i)
+		rid, err := heap.Put(record)
+		if err != nil {
+			t.Fatalf("heap.Put, err: %s", err)
+		}
+		records[rid] = record
+	}
+	if src.Count() < 12 {
+		t.Fatalf("store pages, expected: >= 12, got: %d", src.Count())
+	}
+
+	// flip bytes on disk in pages 3 and 4, so they fail their checksums
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{3, 4} {
+		if _, err := file.WriteAt([]byte{0xde, 0xad}, fileHeaderLen+id*int64(PageSize)+1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	page := newRawPage()
+	src.Read(6, page)
+	binary.LittleEndian.PutUint16(page.bytes[slotCountOffset:], 0x7fff)
+	src.Write(6, page)
+	src.Read(8, page)
+	page.bytes[pageTypeOffset] = 0x42
+	src.Write(8, page)
+	src.Read(10, page)
+	binary.LittleEndian.PutUint16(page.bytes[slotTableOffset+slotTableLen-2*slotTableEntryLen+4:], uint16(slotTableLen))
+	src.Write(10, page)
+
+	expected := make(map[string]int)
+	for rid, record := range records {
+		switch {
+		case rid.PageID == 3, rid.PageID == 4, rid.PageID == 6, rid.PageID == 8:
+		case rid.PageID == 10 && rid.Slot == 1:
+		default:
+			expected[string(record)]++
+		}
+	}
+
+	dst, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Salvage(src, dst)
+	if err != nil {
+		t.Fatalf("Salvage, err: %s", err)
+	}
+	lost := []PageRange{{3, 4}, {6, 6}, {8, 8}}
+	if !reflect.DeepEqual(report.LostPages, lost) {
+		t.Errorf("Salvage lost pages, expected: %v, got: %v", lost, report.LostPages)
+	}
+	if report.LostRecords != 1 {
+		t.Errorf("Salvage lost records, expected: 1, got: %d", report.LostRecords)
+	}
+
+	if check := Check(dst); !check.OK() {
+		t.Fatalf("Check salvaged heap, expected: no problems, got:\n%s", check)
+	}
+	salvaged := NewHeap(dst)
+	if salvaged.Count() != report.Records {
+		t.Errorf("salvaged record count, expected: %d, got: %d", report.Records, salvaged.Count())
+	}
+	found := make(map[string]int)
+	scanner := NewHeapScanner(salvaged)
+	buf := make([]byte, maxRecordLen)
+	for {
+		_, n, err := scanner.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("scanner.Next, err: %s", err)
+		}
+		found[string(buf[0:n])]++
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("salvaged records, expected: %d distinct, got: %d distinct", len(expected), len(found))
+	}
+}
+
+func TestSalvageRecordTooLong(t *testing.T) {
+
+	src, _ := NewMemoryStore()
+	heap := NewHeapWithOptions(src, &HeapOptions{Compress: true, CompressionLevel: 1})
+	record := jsonRecord(1)
+	rid, err := heap.Put(record)
+	if err != nil {
+		t.Fatalf("heap.Put, err: %s", err)
+	}
+
+	// a compressed record longer than a page, as heaps once accepted
+	c, _ := newCompressor(1)
+	long, compressed, err := c.compress(make([]byte, 20000))
+	if err != nil || !compressed {
+		t.Fatalf("compress, err: %v, compressed: %v", err, compressed)
+	}
+	page := NewHeapPage()
+	if err := src.Read(rid.PageID, page); err != nil {
+		t.Fatal(err)
+	}
+	slot, err := page.AddRecord(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.SetCompressed(slot, true)
+	if err := src.Write(rid.PageID, page); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, _ := NewMemoryStore()
+	report, err := Salvage(src, dst)
+	if err != nil {
+		t.Fatalf("Salvage, err: %s", err)
+	}
+	if report.Records != 1 || report.LostRecords != 1 {
+		t.Errorf("Salvage, expected: 1 record salvaged and 1 lost, got: %s", report)
+	}
+}
@@ -0,0 +1,247 @@
+package dbase
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histogramBuckets is the number of bounded latency histogram buckets. Bucket i counts
+// observations no longer than 1µs<<i, from 1µs up to about 8s; a last bucket counts the rest.
+const histogramBuckets = 24
+
+// histogramBounds are the upper bounds of the bounded buckets, shared by every Histogram.
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, histogramBuckets)
+	for i := range bounds {
+		bounds[i] = time.Microsecond << i
+	}
+	return bounds
+}()
+
+// Histogram is a snapshot of a latency histogram. Counts[i] is the number of observations longer
+// than Bounds[i-1] and no longer than Bounds[i]; the last count, one more than there are bounds,
+// is of the observations longer than every bound.
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+	Count  uint64          `json:"count"`
+	Sum    time.Duration   `json:"sum"`
+}
+
+// Mean returns the mean observation, or 0 if there are none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding quantile q, 0 to 1, of the observations;
+// the longest bound if it falls in the last, unbounded, bucket, or 0 if there are none.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen > rank || seen == h.Count {
+			if i == len(h.Bounds) {
+				i--
+			}
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// histogram is a latency histogram maintained atomically.
+type histogram struct {
+	counts [histogramBuckets + 1]atomic.Uint64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	if d > time.Microsecond {
+		// round up to whole microseconds, bucket i holds (1µs<<(i-1), 1µs<<i]
+		i = min(bits.Len64(uint64((d+time.Microsecond-1)/time.Microsecond)-1), histogramBuckets)
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// since observes the time since start, e.g. defer h.since(time.Now())
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Bounds: histogramBounds, Counts: make([]uint64, len(h.counts))}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	s.Sum = time.Duration(h.sum.Load())
+	return s
+}
+
+// countingPool is a sync.Pool that counts Gets, and the Gets that had to allocate, for the
+// buffer reuse ratio.
+type countingPool struct {
+	pool   sync.Pool
+	gets   atomic.Uint64
+	allocs atomic.Uint64
+}
+
+func newCountingPool(new func() any) *countingPool {
+	p := &countingPool{}
+	p.pool.New = func() any {
+		p.allocs.Add(1)
+		return new()
+	}
+	return p
+}
+
+func (p *countingPool) Get() any {
+	p.gets.Add(1)
+	return p.pool.Get()
+}
+
+func (p *countingPool) Put(x any) {
+	p.pool.Put(x)
+}
+
+// BufferPoolStats are the counts of a pool of reusable page buffers. The pool is a sync.Pool, which
+// saves allocating scratch buffers; it doesn't cache pages, so says nothing of how often pages are
+// read from the backing storage.
+type BufferPoolStats struct {
+	Gets   uint64 `json:"gets"`   // buffers taken from the pool
+	Allocs uint64 `json:"allocs"` // buffers the pool had to allocate because none was free
+}
+
+// ReuseRatio returns the fraction of Gets met with a pooled buffer rather than a new allocation,
+// or 1 if there were none.
+func (s BufferPoolStats) ReuseRatio() float64 {
+	if s.Gets == 0 {
+		return 1
+	}
+	return float64(s.Gets-min(s.Allocs, s.Gets)) / float64(s.Gets)
+}
+
+func (p *countingPool) stats() BufferPoolStats {
+	// allocs first, so a Get racing with stats can't make allocs exceed gets
+	allocs := p.allocs.Load()
+	return BufferPoolStats{Gets: p.gets.Load(), Allocs: allocs}
+}
+
+// StoreStats are the activity counts of a page store, since it was opened.
+type StoreStats struct {
+	Reads        uint64          `json:"reads"`
+	Writes       uint64          `json:"writes"`
+	News         uint64          `json:"news"`
+	Appends      uint64          `json:"appends"`
+	Wipes        uint64          `json:"wipes"`
+	Frees        uint64          `json:"frees"`
+	BytesRead    uint64          `json:"bytes_read"`    // bytes read from the backing storage, in on-disk form for a file store
+	BytesWritten uint64          `json:"bytes_written"` // bytes written to the backing storage, likewise
+	Pages        int64           `json:"pages"`
+	Size         int64           `json:"size"`          // bytes of backing storage in use
+	ReadLatency  Histogram       `json:"read_latency"`  // Read, and ReadBatch once per batch
+	WriteLatency Histogram       `json:"write_latency"` // Write, New, Append, Wipe and Free, and WriteBatch once per batch
+	BufferPool   BufferPoolStats `json:"buffer_pool"`
+}
+
+func (s StoreStats) String() string {
+	return fmt.Sprintf("reads: %d, writes: %d, news: %d, appends: %d, wipes: %d, frees: %d, pages: %d, read latency: %s, write latency: %s, buffer reuse ratio: %.2f",
+		s.Reads, s.Writes, s.News, s.Appends, s.Wipes, s.Frees, s.Pages, s.ReadLatency.Mean(), s.WriteLatency.Mean(), s.BufferPool.ReuseRatio())
+}
+
+// storeCounters are the counters behind StoreStats.
+type storeCounters struct {
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+	news         atomic.Uint64
+	appends      atomic.Uint64
+	wipes        atomic.Uint64
+	frees        atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	readLatency  histogram
+	writeLatency histogram
+}
+
+func (c *storeCounters) stats() StoreStats {
+	return StoreStats{
+		Reads:        c.reads.Load(),
+		Writes:       c.writes.Load(),
+		News:         c.news.Load(),
+		Appends:      c.appends.Load(),
+		Wipes:        c.wipes.Load(),
+		Frees:        c.frees.Load(),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		ReadLatency:  c.readLatency.snapshot(),
+		WriteLatency: c.writeLatency.snapshot(),
+	}
+}
+
+// HeapStats are the activity counts of a heap, since it was opened, and its record count.
+type HeapStats struct {
+	Puts             uint64          `json:"puts"` // records added by Put and PutBatch
+	Gets             uint64          `json:"gets"`
+	Sets             uint64          `json:"sets"`
+	Deletes          uint64          `json:"deletes"`
+	BytesIn          uint64          `json:"bytes_in"`     // record bytes given to Put and Set
+	BytesStored      uint64          `json:"bytes_stored"` // record bytes stored by Put and Set, after compression
+	CompressionRatio float64         `json:"compression_ratio"`
+	Records          int64           `json:"records"`
+	GetLatency       Histogram       `json:"get_latency"`
+	PutLatency       Histogram       `json:"put_latency"`
+	SetLatency       Histogram       `json:"set_latency"`
+	DeleteLatency    Histogram       `json:"delete_latency"`
+	BufferPool       BufferPoolStats `json:"buffer_pool"`
+}
+
+// heapCounters are the counters behind HeapStats.
+type heapCounters struct {
+	puts          atomic.Uint64
+	gets          atomic.Uint64
+	sets          atomic.Uint64
+	deletes       atomic.Uint64
+	bytesIn       atomic.Uint64
+	bytesStored   atomic.Uint64
+	getLatency    histogram
+	putLatency    histogram
+	setLatency    histogram
+	deleteLatency histogram
+}
+
+func (c *heapCounters) stats() HeapStats {
+	stats := HeapStats{
+		Puts:             c.puts.Load(),
+		Gets:             c.gets.Load(),
+		Sets:             c.sets.Load(),
+		Deletes:          c.deletes.Load(),
+		BytesIn:          c.bytesIn.Load(),
+		BytesStored:      c.bytesStored.Load(),
+		CompressionRatio: 1,
+		GetLatency:       c.getLatency.snapshot(),
+		PutLatency:       c.putLatency.snapshot(),
+		SetLatency:       c.setLatency.snapshot(),
+		DeleteLatency:    c.deleteLatency.snapshot(),
+	}
+	if stats.BytesStored != 0 {
+		stats.CompressionRatio = float64(stats.BytesIn) / float64(stats.BytesStored)
+	}
+	return stats
+}
+
+func (s HeapStats) String() string {
+	return fmt.Sprintf("puts: %d, gets: %d, sets: %d, deletes: %d, records: %d, compression: %.2f, get latency: %s, put latency: %s",
+		s.Puts, s.Gets, s.Sets, s.Deletes, s.Records, s.CompressionRatio, s.GetLatency.Mean(), s.PutLatency.Mean())
+}
@@ -0,0 +1,135 @@
+package dbase
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, d := range []time.Duration{0, time.Microsecond, 1500 * time.Nanosecond, 2 * time.Microsecond, 3 * time.Microsecond, time.Minute} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	expected := map[int]uint64{0: 2, 1: 2, 2: 1, histogramBuckets: 1}
+	for i, n := range s.Counts {
+		if n != expected[i] {
+			t.Errorf("bucket %d (%s), expected: %d, got: %d", i, s.Bounds[min(i, histogramBuckets-1)], expected[i], n)
+		}
+	}
+	if s.Count != 6 {
+		t.Errorf("Count, expected: 6, got: %d", s.Count)
+	}
+	if q := s.Quantile(0.5); q != 2*time.Microsecond {
+		t.Errorf("Quantile(0.5), expected: 2µs, got: %s", q)
+	}
+	if q := s.Quantile(1); q != s.Bounds[histogramBuckets-1] {
+		t.Errorf("Quantile(1), expected: %s, got: %s", s.Bounds[histogramBuckets-1], q)
+	}
+}
+
+func TestStats(t *testing.T) {
+
+	path := tempfile()
+	store, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.Close()
+		os.Remove(path)
+	}()
+	heap := NewHeap(store)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, PageSize)
+			for i := 0; i < 100; i++ {
+				rid, err := heap.Put(jsonRecord(i))
+				if err != nil {
+					t.Errorf("heap.Put, err: %s", err)
+					return
+				}
+				if _, err := heap.Get(rid, buf); err != nil {
+					t.Errorf("heap.Get, err: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	heap.Delete(RID{PageID: 1, Slot: 1})
+
+	hs := heap.Stats()
+	if hs.Puts != 400 || hs.Gets != 400 || hs.Deletes != 1 || hs.Records != 399 {
+		t.Errorf("heap stats, expected: 400 puts and gets, 1 delete, 399 records, got: %s", hs)
+	}
+	if hs.PutLatency.Count != 400 || hs.GetLatency.Count != 400 || hs.DeleteLatency.Count != 1 {
+		t.Errorf("heap latency counts, expected: 400, 400, 1, got: %d, %d, %d", hs.PutLatency.Count, hs.GetLatency.Count, hs.DeleteLatency.Count)
+	}
+	if hs.BufferPool.Gets == 0 || hs.BufferPool.ReuseRatio() <= 0 {
+		t.Errorf("heap buffer pool, expected: gets and reuse, got: %+v", hs.BufferPool)
+	}
+	// Stats doesn't read the store, FreeSpace reads every page
+	reads := store.Stats().Reads
+	heap.Stats()
+	if store.Stats().Reads != reads {
+		t.Errorf("heap.Stats, expected: no store reads, got: %d", store.Stats().Reads-reads)
+	}
+	pages, free := heap.FreeSpace()
+	if pages != store.Count()-1 || free <= 0 || free >= pages*int64(PageSize) {
+		t.Errorf("heap free space, expected: %d pages with some space free, got: %d pages, %d bytes free", store.Count()-1, pages, free)
+	}
+
+	ss := store.Stats()
+	if ss.Reads == 0 || ss.Writes == 0 || ss.Appends != uint64(store.Count()) || ss.Pages != store.Count() {
+		t.Errorf("store stats, expected: reads, writes and %d appends, got: %s", store.Count(), ss)
+	}
+	if ss.BytesWritten < (ss.Writes+ss.Appends)*uint64(PageSize) || ss.Size != store.(*fileStore).pageOffset(PageID(store.Count())) {
+		t.Errorf("store bytes, expected: a page per write, got: %d written, size %d", ss.BytesWritten, ss.Size)
+	}
+	// the heap flushes its last page and header page as one batch, observed once
+	if ss.ReadLatency.Count != ss.Reads || ss.WriteLatency.Count == 0 || ss.WriteLatency.Count > ss.Writes+ss.Appends {
+		t.Errorf("store latency counts, expected: %d reads and up to %d writes, got: %d and %d", ss.Reads, ss.Writes+ss.Appends, ss.ReadLatency.Count, ss.WriteLatency.Count)
+	}
+
+	metrics := NewMetrics()
+	metrics.AddStore("orders", store)
+	metrics.AddHeap("orders", heap)
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE dbase_store_reads_total counter\n",
+		"dbase_heap_puts_total{heap=\"orders\"} 400\n",
+		"dbase_heap_records{heap=\"orders\"} 399\n",
+		"dbase_heap_put_seconds_bucket{heap=\"orders\",le=\"+Inf\"} 400\n",
+		"dbase_heap_put_seconds_count{heap=\"orders\"} 400\n",
+		"dbase_store_read_seconds_bucket{store=\"orders\",le=\"1e-06\"} ",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics, expected: %q, got:\n%s", line, body)
+		}
+	}
+
+	metrics.Publish("dbase_test")
+	var published struct {
+		Stores map[string]StoreStats `json:"stores"`
+		Heaps  map[string]HeapStats  `json:"heaps"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("dbase_test").String()), &published); err != nil {
+		t.Fatalf("expvar, err: %s", err)
+	}
+	if published.Heaps["orders"].Records != 399 || published.Stores["orders"].Pages != store.Count() {
+		t.Errorf("expvar, expected: 399 records and %d pages, got: %+v", store.Count(), published)
+	}
+}